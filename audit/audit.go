@@ -0,0 +1,37 @@
+// Package audit defines the audit trail of the administrative and security events,
+// separate from the operational logs.
+package audit
+
+import "time"
+
+// EventType of an audit Event.
+type EventType string
+
+const (
+	ConnectionAccepted EventType = "connection_accepted"
+	// ConnectionRejected is a connection closed as soon as accepted (quota exceeded, server draining...).
+	ConnectionRejected EventType = "connection_rejected"
+	ConnectionClosed   EventType = "connection_closed"
+	// ForcedDisconnect is a client disconnected by the server (slow consumer, write timeout...).
+	ForcedDisconnect EventType = "forced_disconnect"
+
+	TunnelCreated EventType = "tunnel_created"
+	// TunnelCreationDenied is a Tunnel creation rejected by a quota.
+	TunnelCreationDenied EventType = "tunnel_creation_denied"
+	// ListenDenied is a listen rejected by a quota.
+	ListenDenied EventType = "listen_denied"
+	// PublicationDenied is a publication rejected by a quota or a rate limit.
+	PublicationDenied EventType = "publication_denied"
+)
+
+// Event of the audit trail.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	// Client is the id of the connection performing or undergoing the action.
+	Client     string `json:"client,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Tunnel     string `json:"tunnel,omitempty"`
+	// Reason of a rejection or a disconnection.
+	Reason string `json:"reason,omitempty"`
+}
@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// DefaultMaxFileBytes is the size of an audit file above which it's rotated when not configured.
+const DefaultMaxFileBytes = 100 << 20
+
+type FileSinkOption struct {
+	// Path of the current audit file. The rotated ones are suffixed by their generation: Path.1 being the most recent.
+	Path string
+	// MaxBytes is the size above which the file is rotated. Defaults to DefaultMaxFileBytes.
+	MaxBytes int64
+	// MaxBackups is the number of rotated files kept. The older ones are deleted. Keeps all of them if zero.
+	MaxBackups int
+}
+
+func (opts *FileSinkOption) defaults() {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxFileBytes
+	}
+}
+
+// FileSink appends the events as JSON lines to a file, rotated once it reaches its maximum size.
+type FileSink struct {
+	opts *FileSinkOption
+
+	file *os.File
+	size int64
+	mtx  sync.Mutex
+}
+
+func NewFileSink(opts *FileSinkOption) (*FileSink, error) {
+	opts.defaults()
+	sink := &FileSink{opts: opts}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat audit file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Audit appends the event to the file. An event that cannot be written is logged as an error.
+func (f *FileSink) Audit(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Cannot marshal audit event", "type", event.Type, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.file == nil {
+		slog.Error("Cannot write audit event: sink closed", "type", event.Type)
+		return
+	}
+	if f.size > 0 && f.size+int64(len(line)) > f.opts.MaxBytes {
+		if err = f.rotate(); err != nil { // Keeps writing to the current file, so that no event is lost.
+			slog.Error("Cannot rotate audit file", "error", err)
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		slog.Error("Cannot write audit event", "type", event.Type, "error", err)
+	}
+}
+
+// rotate shifts the rotated files by one generation and starts a new file. Must be called with the lock held.
+// The new file is opened before the current one is rotated: on failure, the current file is kept open.
+func (f *FileSink) rotate() error {
+	nextPath := f.opts.Path + ".next"
+	next, err := os.OpenFile(nextPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open next audit file: %w", err)
+	}
+	abort := func(err error) error {
+		next.Close()
+		os.Remove(nextPath)
+		return err
+	}
+
+	oldest := f.opts.MaxBackups
+	if oldest == 0 { // Keeps all of them: finds the first free generation
+		for oldest = 1; exists(f.backupPath(oldest)); oldest++ {
+		}
+	}
+	if err = os.Remove(f.backupPath(oldest)); err != nil && !os.IsNotExist(err) {
+		return abort(fmt.Errorf("remove oldest audit file: %w", err))
+	}
+	for generation := oldest - 1; generation >= 1; generation-- {
+		if err = os.Rename(f.backupPath(generation), f.backupPath(generation+1)); err != nil && !os.IsNotExist(err) {
+			return abort(fmt.Errorf("shift audit file: %w", err))
+		}
+	}
+	if err = os.Rename(f.opts.Path, f.backupPath(1)); err != nil {
+		return abort(fmt.Errorf("rotate audit file: %w", err))
+	}
+	if err = os.Rename(nextPath, f.opts.Path); err != nil {
+		os.Rename(f.backupPath(1), f.opts.Path) // Restores the current file at its path
+		return abort(fmt.Errorf("rename next audit file: %w", err))
+	}
+
+	if err = f.file.Close(); err != nil {
+		slog.Warn("Cannot close rotated audit file", "error", err)
+	}
+	f.file = next
+	f.size = 0
+	return nil
+}
+
+func (f *FileSink) backupPath(generation int) string {
+	return fmt.Sprintf("%s.%d", f.opts.Path, generation)
+}
+
+func (f *FileSink) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
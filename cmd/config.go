@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/codingLayce/tunnel-server/server"
+)
+
+// config is the part of the configuration reloaded on SIGHUP.
+type config struct {
+	LogLevel   slog.Level             `json:"log_level"`
+	RateLimits server.RateLimitOption `json:"rate_limits"`
+	Quotas     server.QuotaOption     `json:"quotas"`
+}
+
+// loadConfig from the flags, overridden by the keys of the configuration file if any.
+func loadConfig() (*config, error) {
+	rateLimits, err := parseRateLimits()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit: %w", err)
+	}
+	var logLevel slog.Level
+	if err = logLevel.UnmarshalText([]byte(logLevelName)); err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	cfg := &config{
+		LogLevel:   logLevel,
+		RateLimits: rateLimits,
+		Quotas:     quotas,
+	}
+	if configPath == "" {
+		return cfg, nil
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	if err = json.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("parse config file: %w", err)
+	}
+	return cfg, nil
+}
+
+// reloadConfig applies the configuration and the TLS certificates of the listeners to the running server,
+// without dropping any connection. The current configuration and certificates are kept if they cannot be loaded.
+func reloadConfig(srv *server.Server) {
+	if err := srv.ReloadCertificates(); err != nil {
+		slog.Error("Cannot reload TLS certificates. Keeping current ones", "error", err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Cannot reload configuration. Keeping current one", "error", err)
+		return
+	}
+	logOpts.Level.Set(cfg.LogLevel)
+	srv.SetRateLimits(cfg.RateLimits)
+	srv.SetQuotas(cfg.Quotas)
+	slog.Info("Configuration reloaded", "config", configPath)
+}
@@ -1,41 +1,293 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/logging"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/ratelimit"
 	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+var (
+	addr             string
+	unixSocketPath   string
+	unixSocketMode   string
+	listenerSpecs    []string
+	metricsAddr      string
+	webSocketAddr    string
+	webSocketOrigins []string
+	httpAddr         string
+	webhookHosts     []string
+	mqttAddr         string
+	redisAddr        string
+	stompAddr        string
+	tunnelBufferSize int
+	tunnelOverflow   string
+	publishConfirm   string
+	tunnelDedup      time.Duration
+	tunnelPriority   bool
+	rateLimitGlobal  string
+	rateLimitClient  string
+	rateLimitTunnel  string
+	quotas           server.QuotaOption
+	shutdownTimeout  time.Duration
+	configPath       string
+	heartbeat        server.HeartbeatOption
+	slowConsumer     server.SlowConsumerOption
+	logFormat        string
+	logLevelName     string
+	logOpts          = logging.Option{Level: new(slog.LevelVar)}
+	traceOutput      string
+	auditOpts        audit.FileSinkOption
 )
 
 var RootCmd = &cobra.Command{
 	Short: "Start a Tunnel server",
 	Run: func(_ *cobra.Command, _ []string) {
-		srv := server.NewServer(":19917")
+		var err error
+		logOpts.Format, err = logging.ParseFormat(logFormat)
+		if err != nil {
+			slog.Error("Invalid log format", "error", err)
+			os.Exit(1)
+		}
+		slog.SetDefault(logging.New(&logOpts))
+
+		if err = setupTracing(); err != nil {
+			slog.Error("Cannot setup tracing", "error", err)
+			os.Exit(1)
+		}
+
+		overflow, err := tunnel.ParseOverflowPolicy(tunnelOverflow)
+		if err != nil {
+			slog.Error("Invalid tunnel overflow policy", "error", err)
+			os.Exit(1)
+		}
+
+		confirm, err := tunnel.ParseConfirmMode(publishConfirm)
+		if err != nil {
+			slog.Error("Invalid publish confirm mode", "error", err)
+			os.Exit(1)
+		}
+
+		cfg, err := loadConfig()
+		if err != nil {
+			slog.Error("Invalid configuration", "error", err)
+			os.Exit(1)
+		}
+		logOpts.Level.Set(cfg.LogLevel)
+
+		auditSink, err := setupAudit()
+		if err != nil {
+			slog.Error("Cannot setup audit", "error", err)
+			os.Exit(1)
+		}
 
-		err := srv.Start()
+		socketMode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+		if err != nil {
+			slog.Error("Invalid unix socket mode", "error", err)
+			os.Exit(1)
+		}
+
+		var listeners []server.ListenerOption
+		for _, spec := range listenerSpecs {
+			listener, err := server.ParseListenerOption(spec)
+			if err != nil {
+				slog.Error("Invalid listener", "error", err)
+				os.Exit(1)
+			}
+			listeners = append(listeners, listener)
+		}
+
+		srv := server.NewServerWithOption(&server.ServerOption{
+			Addr:                    addr,
+			Listeners:               listeners,
+			UnixSocketPath:          unixSocketPath,
+			UnixSocketMode:          fs.FileMode(socketMode),
+			WebSocketAddr:           webSocketAddr,
+			WebSocketAllowedOrigins: webSocketOrigins,
+			HTTPAddr:                httpAddr,
+			WebhookAllowedHosts:     webhookHosts,
+			MQTTAddr:                mqttAddr,
+			RedisAddr:               redisAddr,
+			STOMPAddr:               stompAddr,
+			TunnelBufferSize:        tunnelBufferSize,
+			PublishConfirm:          confirm,
+			TunnelOverflow:          overflow,
+			TunnelPriority:          tunnelPriority,
+			TunnelDedupWindow:       tunnelDedup,
+			RateLimits:              cfg.RateLimits,
+			Quotas:                  cfg.Quotas,
+			Heartbeat:               heartbeat,
+			SlowConsumer:            slowConsumer,
+			Audit:                   auditSink,
+		})
+
+		err = srv.Start()
 		if err != nil {
 			slog.Error("Cannot start server", "error", err)
 			os.Exit(1)
 		}
 		slog.Info("Tunnel server started")
 
-		signalChan := make(chan os.Signal)
-		signal.Notify(signalChan)
+		if metricsAddr != "" {
+			go serveMetrics()
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+		defer signal.Stop(signals)
 
-		select {
-		case <-signalChan:
-			slog.Info("Received signal. Stopping server")
-			srv.Stop()
-		case <-srv.Done():
-			slog.Error("Server stopped it self")
+		for running := true; running; {
+			select {
+			case sig := <-signals:
+				running = handleSignal(srv, sig)
+			case <-srv.Done():
+				slog.Error("Server stopped it self")
+				running = false
+			}
 		}
 		slog.Info("Tunnel server stopped")
 	},
 }
 
+func init() {
+	RootCmd.Flags().StringVar(&configPath, "config", "", "JSON configuration file overriding the flags, reloaded on SIGHUP: log_level, rate_limits and quotas")
+	RootCmd.Flags().StringVar(&logFormat, "log-format", string(logging.FormatText), "Format of the logs: text or json")
+	RootCmd.Flags().StringVar(&logLevelName, "log-level", "info", "Level of the logs: debug, info, warn or error. Adjustable at runtime with the configuration file")
+	RootCmd.Flags().BoolVar(&logOpts.RedactPayloads, "log-redact-payloads", false, "Replace the logged payloads by their size")
+	RootCmd.Flags().IntVar(&logOpts.MaxPayloadBytes, "log-max-payload-bytes", 0, "Truncate the logged payloads longer than it (unlimited if 0)")
+	RootCmd.Flags().IntVar(&logOpts.Sampling.First, "log-sample-first", 0, "Number of info and debug logs with the same message kept per second (sampling disabled if 0)")
+	RootCmd.Flags().IntVar(&logOpts.Sampling.Thereafter, "log-sample-thereafter", 0, "Keep one info or debug log every N once the first ones are kept (all dropped if 0)")
+	RootCmd.Flags().StringVar(&traceOutput, "trace-output", "", "Output of the traces as JSON lines: stdout or a file path (disabled if empty)")
+	RootCmd.Flags().StringVar(&auditOpts.Path, "audit-file", "", "Audit trail file, as JSON lines (disabled if empty)")
+	RootCmd.Flags().Int64Var(&auditOpts.MaxBytes, "audit-max-bytes", audit.DefaultMaxFileBytes, "Size above which the audit file is rotated")
+	RootCmd.Flags().IntVar(&auditOpts.MaxBackups, "audit-max-backups", 0, "Number of rotated audit files kept (all if 0)")
+	RootCmd.Flags().StringVar(&addr, "addr", ":19917", "TCP address of the Tunnel protocol (disabled if empty while --unix-socket or --listener is set)")
+	RootCmd.Flags().StringArrayVar(&listenerSpecs, "listener", nil, "Additional listener of the Tunnel protocol, repeatable: tcp://HOST:PORT, tls://HOST:PORT?cert=FILE&key=FILE[&client-ca=FILE] or unix:///PATH[?mode=0660], with optional allow=CIDR[,CIDR], max-connections=N, read-timeout=DURATION and name=NAME")
+	RootCmd.Flags().StringVar(&unixSocketPath, "unix-socket", "", "Path of a Unix domain socket serving the Tunnel protocol (disabled if empty)")
+	RootCmd.Flags().StringVar(&unixSocketMode, "unix-socket-mode", "0660", "File permissions of the Unix domain socket, in octal")
+	RootCmd.Flags().StringVar(&webSocketAddr, "websocket-addr", "", "Address of the WebSocket gateway for browser clients (disabled if empty)")
+	RootCmd.Flags().StringArrayVar(&webSocketOrigins, "websocket-allowed-origin", nil, "Origin of the web pages allowed to connect to the WebSocket gateway besides its own host, repeatable: https://HOST[:PORT] or * for any")
+	RootCmd.Flags().StringVar(&httpAddr, "http-addr", "", "Address of the HTTP gateway: publish with POST and subscribe with Server-Sent Events (disabled if empty)")
+	RootCmd.Flags().StringArrayVar(&webhookHosts, "webhook-allowed-host", nil, "Host webhooks can be subscribed to through the HTTP gateway, repeatable: HOST, HOST:PORT or * for any (none if unset)")
+	RootCmd.Flags().StringVar(&mqttAddr, "mqtt-addr", "", "Address of the MQTT 3.1.1 gateway, mapping the topics onto Tunnels (disabled if empty)")
+	RootCmd.Flags().StringVar(&redisAddr, "redis-addr", "", "Address of the Redis pub/sub gateway, mapping the channels onto Tunnels (disabled if empty)")
+	RootCmd.Flags().StringVar(&stompAddr, "stomp-addr", "", "Address of the STOMP 1.2 gateway, mapping the destinations onto Tunnels (disabled if empty)")
+	RootCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "Address serving the metrics as JSON (disabled if empty)")
+	RootCmd.Flags().IntVar(&tunnelBufferSize, "tunnel-buffer-size", tunnel.DefaultBufferSize, "Maximum number of in-flight messages per Tunnel")
+	RootCmd.Flags().StringVar(&tunnelOverflow, "tunnel-overflow", "reject", "Policy when a Tunnel buffer is full: reject (nack), block (pause the publisher) or drop")
+	RootCmd.Flags().StringVar(&publishConfirm, "publish-confirm", "none", "When a publication is acknowledged: none (once queued), one (once a listener acked it) or all (once every listener acked it)")
+	RootCmd.Flags().DurationVar(&server.PublishConfirmTimeout, "publish-confirm-timeout", server.PublishConfirmTimeout, "Maximum duration to wait for the listeners acknowledgements before nacking a publication")
+	RootCmd.Flags().BoolVar(&tunnelPriority, "tunnel-priority", false, "Deliver the pending messages of higher priority first in the Tunnels created by clients")
+	RootCmd.Flags().DurationVar(&tunnelDedup, "tunnel-dedup-window", 0, "Window during which a message published again with the same transaction id is dropped (disabled if 0)")
+	RootCmd.Flags().StringVar(&rateLimitGlobal, "rate-limit-global", "", "Publications rate limit of the server, as RATE[:BURST] per second (unlimited if empty)")
+	RootCmd.Flags().StringVar(&rateLimitClient, "rate-limit-client", "", "Publications rate limit per client IP, as RATE[:BURST] per second (unlimited if empty)")
+	RootCmd.Flags().StringVar(&rateLimitTunnel, "rate-limit-tunnel", "", "Publications rate limit per Tunnel, as RATE[:BURST] per second (unlimited if empty)")
+	RootCmd.Flags().IntVar(&quotas.MaxConnections, "max-connections", 0, "Maximum number of simultaneous connections (unlimited if 0)")
+	RootCmd.Flags().IntVar(&quotas.MaxConnectionsPerIP, "max-connections-per-ip", 0, "Maximum number of simultaneous connections from the same IP (unlimited if 0)")
+	RootCmd.Flags().IntVar(&quotas.MaxTunnelsPerOwner, "max-tunnels-per-owner", 0, "Maximum number of Tunnels created from the same IP (unlimited if 0)")
+	RootCmd.Flags().IntVar(&quotas.MaxListenersPerTunnel, "max-listeners-per-tunnel", 0, "Maximum number of listeners of a Tunnel (unlimited if 0)")
+	RootCmd.Flags().DurationVar(&heartbeat.Interval, "heartbeat-interval", 0, "Interval between two heartbeats (15s if 0)")
+	RootCmd.Flags().IntVar(&heartbeat.MissedBeats, "heartbeat-missed-beats", 0, "Number of missed heartbeats before closing a connection (4 if 0)")
+	RootCmd.Flags().DurationVar(&server.WriteTimeout, "write-timeout", server.WriteTimeout, "Maximum duration to write a payload to a client before closing its connection")
+	RootCmd.Flags().IntVar(&slowConsumer.MaxPending, "slow-consumer-max-pending", 0, "Number of messages waiting to be notified to a client above which it's slow (disabled if 0)")
+	RootCmd.Flags().DurationVar(&slowConsumer.Grace, "slow-consumer-grace", 10*time.Second, "Duration a client can stay slow before being disconnected")
+	RootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum duration to deliver the in-flight messages when shutting down on SIGINT or SIGTERM")
+	RootCmd.Flags().IntVar(&quotas.MaxMessageBytes, "max-message-bytes", 0, "Maximum size of a published message (unlimited if 0)")
+}
+
+// handleSignal received by the server. Returns false once the server is stopped.
+func handleSignal(srv *server.Server, sig os.Signal) bool {
+	switch sig {
+	case syscall.SIGHUP:
+		slog.Info("Received SIGHUP. Reloading configuration")
+		reloadConfig(srv)
+		return true
+	case syscall.SIGUSR1:
+		slog.Info("State snapshot", "state", srv.Snapshot(), "goroutines", runtime.NumGoroutine())
+		return true
+	default:
+		slog.Info("Received signal. Shutting down server", "signal", sig.String(), "timeout", shutdownTimeout.String())
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("Graceful shutdown incomplete", "error", err)
+		}
+		return false
+	}
+}
+
+func parseRateLimits() (server.RateLimitOption, error) {
+	var (
+		opts server.RateLimitOption
+		err  error
+	)
+	if opts.Global, err = ratelimit.ParseLimit(rateLimitGlobal); err != nil {
+		return opts, fmt.Errorf("global: %w", err)
+	}
+	if opts.PerClient, err = ratelimit.ParseLimit(rateLimitClient); err != nil {
+		return opts, fmt.Errorf("client: %w", err)
+	}
+	if opts.PerTunnel, err = ratelimit.ParseLimit(rateLimitTunnel); err != nil {
+		return opts, fmt.Errorf("tunnel: %w", err)
+	}
+	return opts, nil
+}
+
+// setupAudit opens the audit file, if any.
+func setupAudit() (server.AuditSink, error) {
+	if auditOpts.Path == "" {
+		return nil, nil
+	}
+	sink, err := audit.NewFileSink(&auditOpts)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Writing audit trail", "path", auditOpts.Path)
+	return sink, nil
+}
+
+// setupTracing exports the spans to the trace output, if any.
+func setupTracing() error {
+	switch traceOutput {
+	case "":
+		return nil
+	case "stdout":
+		tracing.SetExporter(tracing.NewStdoutExporter())
+	default:
+		exporter, err := tracing.NewFileExporter(traceOutput)
+		if err != nil {
+			return err
+		}
+		tracing.SetExporter(exporter)
+	}
+	slog.Info("Exporting traces", "output", traceOutput)
+	return nil
+}
+
+func serveMetrics() {
+	slog.Info("Serving metrics", "addr", metricsAddr)
+	if err := http.ListenAndServe(metricsAddr, metrics.Handler()); err != nil {
+		slog.Error("Cannot serve metrics", "error", err)
+	}
+}
+
 func Exec() {
 	RootCmd.Execute()
 }
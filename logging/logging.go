@@ -0,0 +1,120 @@
+// Package logging builds the server logger: text or JSON output, runtime-adjustable level,
+// payload redaction or truncation and sampling of high-volume logs.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// PayloadKey is the attribute key of the logged payloads, redacted or truncated according to the Option.
+const PayloadKey = "payload"
+
+// Format of the logs.
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// ParseFormat parses the name of a Format: "text" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q", name)
+	}
+}
+
+type Option struct {
+	// Format of the logs. Defaults to FormatText.
+	Format Format
+	// Output of the logs. Defaults to os.Stderr.
+	Output io.Writer
+	// Level of the logs, adjustable at runtime. Defaults to slog.LevelInfo.
+	Level *slog.LevelVar
+
+	// RedactPayloads replaces the payloads by their size.
+	RedactPayloads bool
+	// MaxPayloadBytes truncates the payloads longer than it. Unlimited if zero.
+	MaxPayloadBytes int
+
+	// Sampling of the logs below slog.LevelWarn. Disabled by default.
+	Sampling SamplingOption
+}
+
+func (opts *Option) defaults() {
+	if opts.Format == "" {
+		opts.Format = FormatText
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stderr
+	}
+	if opts.Level == nil {
+		opts.Level = new(slog.LevelVar)
+	}
+}
+
+// New creates a logger configured by the options.
+func New(opts *Option) *slog.Logger {
+	opts.defaults()
+
+	handlerOpts := &slog.HandlerOptions{
+		Level:       opts.Level,
+		ReplaceAttr: opts.replacePayload,
+	}
+	var handler slog.Handler
+	switch opts.Format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(opts.Output, handlerOpts)
+	default:
+		handler = slog.NewTextHandler(opts.Output, handlerOpts)
+	}
+
+	if opts.Sampling.First > 0 {
+		handler = newSamplingHandler(handler, &opts.Sampling)
+	}
+	return slog.New(handler)
+}
+
+// replacePayload redacts or truncates the payload attributes.
+func (opts *Option) replacePayload(_ []string, attr slog.Attr) slog.Attr {
+	if attr.Key != PayloadKey {
+		return attr
+	}
+
+	var payload string
+	switch value := attr.Value.Any().(type) {
+	case []byte:
+		payload = string(value)
+	case string:
+		payload = value
+	default:
+		return attr
+	}
+
+	switch {
+	case opts.RedactPayloads:
+		return slog.String(PayloadKey, fmt.Sprintf("[REDACTED %d bytes]", len(payload)))
+	case opts.MaxPayloadBytes > 0 && len(payload) > opts.MaxPayloadBytes:
+		return slog.String(PayloadKey, fmt.Sprintf("%s...[TRUNCATED %d bytes]", payload[:opts.MaxPayloadBytes], len(payload)))
+	default:
+		return slog.String(PayloadKey, payload)
+	}
+}
+
+// SamplingOption configures the sampling of the logs below slog.LevelWarn, by message:
+// during each Tick, the First logs with the same message are kept, then one every Thereafter.
+type SamplingOption struct {
+	// First is the number of logs with the same message kept during a tick. Disabled if zero.
+	First int
+	// Thereafter keeps one log every Thereafter once First is reached. Drops all of them if zero.
+	Thereafter int
+	// Tick is the sampling period. Defaults to a second.
+	Tick time.Duration
+}
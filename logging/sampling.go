@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// samplingHandler drops the high-volume logs below slog.LevelWarn according to a SamplingOption.
+type samplingHandler struct {
+	next     slog.Handler
+	opts     *SamplingOption
+	counters *samplingCounters
+}
+
+// samplingCounters count the logs by message during the current tick.
+// They are shared between a handler and the ones derived from it with WithAttrs and WithGroup.
+type samplingCounters struct {
+	tickStart time.Time
+	counts    map[string]int
+	mtx       sync.Mutex
+}
+
+func newSamplingHandler(next slog.Handler, opts *SamplingOption) *samplingHandler {
+	if opts.Tick <= 0 {
+		opts.Tick = time.Second
+	}
+	return &samplingHandler{
+		next: next,
+		opts: opts,
+		counters: &samplingCounters{
+			tickStart: time.Now(),
+			counts:    make(map[string]int),
+		},
+	}
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn || h.sampled(record.Message) {
+		return h.next.Handle(ctx, record)
+	}
+	return nil
+}
+
+// sampled indicates whether the log with the given message is kept.
+func (h *samplingHandler) sampled(message string) bool {
+	c := h.counters
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if current := time.Now(); current.Sub(c.tickStart) >= h.opts.Tick {
+		c.tickStart = current
+		clear(c.counts)
+	}
+	c.counts[message]++
+	count := c.counts[message]
+	if count <= h.opts.First {
+		return true
+	}
+	return h.opts.Thereafter > 0 && (count-h.opts.First)%h.opts.Thereafter == 0
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), opts: h.opts, counters: h.counters}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), opts: h.opts, counters: h.counters}
+}
@@ -0,0 +1,32 @@
+// Package metrics publishes the server metrics with expvar.
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"runtime"
+
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// RateLimited counts the publications rejected by rate limiting, by limit scope.
+var RateLimited = expvar.NewMap("rate_limited")
+
+// QuotaExceeded counts the commands and connections rejected by quotas, by quota name.
+var QuotaExceeded = expvar.NewMap("quota_exceeded")
+
+// SlowConsumersEvicted counts the clients disconnected for not keeping up with their messages.
+var SlowConsumersEvicted = expvar.NewInt("slow_consumers_evicted")
+
+// FrozenClientsEvicted counts the clients disconnected for missing their heartbeats.
+var FrozenClientsEvicted = expvar.NewInt("frozen_clients_evicted")
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("tunnels", expvar.Func(func() any { return tunnel.AllStats() }))
+}
+
+// Handler serves every published metric as JSON.
+func Handler() http.Handler {
+	return expvar.Handler()
+}
@@ -0,0 +1,417 @@
+// Package mqtt encodes and decodes the MQTT 3.1.1 control packets.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxPacketBytes is the maximum remaining length of a received packet. A bigger packet is an error.
+var MaxPacketBytes = 1 << 20
+
+const (
+	TypeConnect     byte = 1
+	TypeConnack     byte = 2
+	TypePublish     byte = 3
+	TypePuback      byte = 4
+	TypeSubscribe   byte = 8
+	TypeSuback      byte = 9
+	TypeUnsubscribe byte = 10
+	TypeUnsuback    byte = 11
+	TypePingreq     byte = 12
+	TypePingresp    byte = 13
+	TypeDisconnect  byte = 14
+)
+
+// ProtocolLevel of MQTT 3.1.1.
+const ProtocolLevel byte = 4
+
+// CONNACK return codes.
+const (
+	ConnectionAccepted    byte = 0
+	UnacceptableProtocol  byte = 1
+	IdentifierRejected    byte = 2
+	ServerUnavailable     byte = 3
+	BadUsernameOrPassword byte = 4
+	NotAuthorized         byte = 5
+)
+
+// SubscriptionFailure is the SUBACK return code of a rejected topic filter.
+const SubscriptionFailure byte = 0x80
+
+// maxRemainingLengthEncoding is the maximum number of bytes encoding the remaining length of a packet.
+const maxRemainingLengthEncoding = 4
+
+var (
+	ErrPacketTooLarge = errors.New("mqtt packet too large")
+	ErrMalformed      = errors.New("malformed mqtt packet")
+)
+
+// Packet is an MQTT control packet.
+type Packet interface {
+	// encode returns the flags of the fixed header and the variable header followed by the payload.
+	encode() (typeAndFlags byte, body []byte)
+}
+
+type Connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16
+	ClientID      string
+	WillTopic     string
+	WillMessage   []byte
+	WillQoS       byte
+	WillRetain    bool
+	Username      string
+	Password      []byte
+	HasWill       bool
+	HasUsername   bool
+	HasPassword   bool
+}
+
+type Connack struct {
+	SessionPresent bool
+	ReturnCode     byte
+}
+
+type Publish struct {
+	Dup      bool
+	QoS      byte
+	Retain   bool
+	Topic    string
+	PacketID uint16
+	Payload  []byte
+}
+
+type Puback struct {
+	PacketID uint16
+}
+
+// TopicFilter of a Subscribe, with its requested QoS.
+type TopicFilter struct {
+	Topic string
+	QoS   byte
+}
+
+type Subscribe struct {
+	PacketID uint16
+	Filters  []TopicFilter
+}
+
+type Suback struct {
+	PacketID uint16
+	// ReturnCodes are the granted QoS of each filter, or SubscriptionFailure.
+	ReturnCodes []byte
+}
+
+type Unsubscribe struct {
+	PacketID uint16
+	Topics   []string
+}
+
+type Unsuback struct {
+	PacketID uint16
+}
+
+type (
+	Pingreq    struct{}
+	Pingresp   struct{}
+	Disconnect struct{}
+)
+
+// Marshal the packet with its fixed header.
+func Marshal(p Packet) []byte {
+	typeAndFlags, body := p.encode()
+	packet := []byte{typeAndFlags}
+	for length := len(body); ; {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// Read the next packet.
+func Read(r *bufio.Reader) (Packet, error) {
+	typeAndFlags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == maxRemainingLengthEncoding {
+			return nil, fmt.Errorf("%w: remaining length", ErrMalformed)
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > MaxPacketBytes {
+		return nil, ErrPacketTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return decode(typeAndFlags, body)
+}
+
+func decode(typeAndFlags byte, body []byte) (Packet, error) {
+	d := &decoder{body: body}
+	var p Packet
+	switch typeAndFlags >> 4 {
+	case TypeConnect:
+		p = d.connect()
+	case TypeConnack:
+		p = &Connack{SessionPresent: d.byte()&1 == 1, ReturnCode: d.byte()}
+	case TypePublish:
+		p = d.publish(typeAndFlags)
+	case TypePuback:
+		p = &Puback{PacketID: d.uint16()}
+	case TypeSubscribe:
+		p = d.subscribe()
+	case TypeSuback:
+		p = &Suback{PacketID: d.uint16(), ReturnCodes: d.rest()}
+	case TypeUnsubscribe:
+		p = d.unsubscribe()
+	case TypeUnsuback:
+		p = &Unsuback{PacketID: d.uint16()}
+	case TypePingreq:
+		p = &Pingreq{}
+	case TypePingresp:
+		p = &Pingresp{}
+	case TypeDisconnect:
+		p = &Disconnect{}
+	default:
+		return nil, fmt.Errorf("unsupported mqtt packet type %d", typeAndFlags>>4)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+// decoder reads the fields of a packet body, recording the first error.
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.body) < n {
+		d.err = fmt.Errorf("%w: truncated", ErrMalformed)
+		return nil
+	}
+	field := d.body[:n]
+	d.body = d.body[n:]
+	return field
+}
+
+func (d *decoder) byte() byte {
+	if field := d.next(1); field != nil {
+		return field[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if field := d.next(2); field != nil {
+		return binary.BigEndian.Uint16(field)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	return d.next(int(d.uint16()))
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) rest() []byte {
+	rest := d.body
+	d.body = nil
+	return rest
+}
+
+func (d *decoder) connect() *Connect {
+	c := &Connect{ProtocolName: d.string(), ProtocolLevel: d.byte()}
+	flags := d.byte()
+	c.CleanSession = flags&0x02 != 0
+	c.HasWill = flags&0x04 != 0
+	c.WillQoS = (flags >> 3) & 0x03
+	c.WillRetain = flags&0x20 != 0
+	c.HasPassword = flags&0x40 != 0
+	c.HasUsername = flags&0x80 != 0
+	c.KeepAlive = d.uint16()
+	c.ClientID = d.string()
+	if c.HasWill {
+		c.WillTopic = d.string()
+		c.WillMessage = d.bytes()
+	}
+	if c.HasUsername {
+		c.Username = d.string()
+	}
+	if c.HasPassword {
+		c.Password = d.bytes()
+	}
+	return c
+}
+
+func (d *decoder) publish(typeAndFlags byte) *Publish {
+	p := &Publish{
+		Dup:    typeAndFlags&0x08 != 0,
+		QoS:    (typeAndFlags >> 1) & 0x03,
+		Retain: typeAndFlags&0x01 != 0,
+		Topic:  d.string(),
+	}
+	if p.QoS > 0 {
+		p.PacketID = d.uint16()
+	}
+	p.Payload = d.rest()
+	return p
+}
+
+func (d *decoder) subscribe() *Subscribe {
+	s := &Subscribe{PacketID: d.uint16()}
+	for d.err == nil && len(d.body) > 0 {
+		s.Filters = append(s.Filters, TopicFilter{Topic: d.string(), QoS: d.byte()})
+	}
+	if d.err == nil && len(s.Filters) == 0 {
+		d.err = fmt.Errorf("%w: subscribe without topic filter", ErrMalformed)
+	}
+	return s
+}
+
+func (d *decoder) unsubscribe() *Unsubscribe {
+	u := &Unsubscribe{PacketID: d.uint16()}
+	for d.err == nil && len(d.body) > 0 {
+		u.Topics = append(u.Topics, d.string())
+	}
+	if d.err == nil && len(u.Topics) == 0 {
+		d.err = fmt.Errorf("%w: unsubscribe without topic filter", ErrMalformed)
+	}
+	return u
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b, field []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(field)))
+	return append(b, field...)
+}
+
+func (c *Connect) encode() (byte, []byte) {
+	var flags byte
+	if c.CleanSession {
+		flags |= 0x02
+	}
+	if c.HasWill {
+		flags |= 0x04 | c.WillQoS<<3
+		if c.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if c.HasPassword {
+		flags |= 0x40
+	}
+	if c.HasUsername {
+		flags |= 0x80
+	}
+
+	body := appendString(nil, c.ProtocolName)
+	body = append(body, c.ProtocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, c.KeepAlive)
+	body = appendString(body, c.ClientID)
+	if c.HasWill {
+		body = appendString(body, c.WillTopic)
+		body = appendBytes(body, c.WillMessage)
+	}
+	if c.HasUsername {
+		body = appendString(body, c.Username)
+	}
+	if c.HasPassword {
+		body = appendBytes(body, c.Password)
+	}
+	return TypeConnect << 4, body
+}
+
+func (c *Connack) encode() (byte, []byte) {
+	var sessionPresent byte
+	if c.SessionPresent {
+		sessionPresent = 1
+	}
+	return TypeConnack << 4, []byte{sessionPresent, c.ReturnCode}
+}
+
+func (p *Publish) encode() (byte, []byte) {
+	flags := p.QoS << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+	body := appendString(nil, p.Topic)
+	if p.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, p.PacketID)
+	}
+	return TypePublish<<4 | flags, append(body, p.Payload...)
+}
+
+func (p *Puback) encode() (byte, []byte) {
+	return TypePuback << 4, binary.BigEndian.AppendUint16(nil, p.PacketID)
+}
+
+func (s *Subscribe) encode() (byte, []byte) {
+	body := binary.BigEndian.AppendUint16(nil, s.PacketID)
+	for _, filter := range s.Filters {
+		body = appendString(body, filter.Topic)
+		body = append(body, filter.QoS)
+	}
+	return TypeSubscribe<<4 | 0x02, body
+}
+
+func (s *Suback) encode() (byte, []byte) {
+	return TypeSuback << 4, append(binary.BigEndian.AppendUint16(nil, s.PacketID), s.ReturnCodes...)
+}
+
+func (u *Unsubscribe) encode() (byte, []byte) {
+	body := binary.BigEndian.AppendUint16(nil, u.PacketID)
+	for _, topic := range u.Topics {
+		body = appendString(body, topic)
+	}
+	return TypeUnsubscribe<<4 | 0x02, body
+}
+
+func (u *Unsuback) encode() (byte, []byte) {
+	return TypeUnsuback << 4, binary.BigEndian.AppendUint16(nil, u.PacketID)
+}
+
+func (*Pingreq) encode() (byte, []byte)    { return TypePingreq << 4, nil }
+func (*Pingresp) encode() (byte, []byte)   { return TypePingresp << 4, nil }
+func (*Disconnect) encode() (byte, []byte) { return TypeDisconnect << 4, nil }
@@ -0,0 +1,153 @@
+// Package ratelimit implements token bucket rate limiting.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit of a token bucket. A zero Rate means unlimited.
+type Limit struct {
+	// Rate is the number of tokens added per second.
+	Rate float64 `json:"rate"`
+	// Burst is the maximum number of tokens. Defaults to 1 when Rate is set.
+	Burst int `json:"burst"`
+}
+
+// ParseLimit parses a limit formatted as "RATE[:BURST]", RATE being per second. An empty string is unlimited.
+func ParseLimit(value string) (Limit, error) {
+	if value == "" {
+		return Limit{}, nil
+	}
+	rate, burst, hasBurst := strings.Cut(value, ":")
+	var (
+		limit Limit
+		err   error
+	)
+	limit.Rate, err = strconv.ParseFloat(rate, 64)
+	if err != nil {
+		return Limit{}, fmt.Errorf("invalid rate %q: %w", rate, err)
+	}
+	if hasBurst {
+		limit.Burst, err = strconv.Atoi(burst)
+		if err != nil {
+			return Limit{}, fmt.Errorf("invalid burst %q: %w", burst, err)
+		}
+	}
+	return limit, nil
+}
+
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// Bucket is a token bucket. Starts full.
+type Bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+	mtx    sync.Mutex
+}
+
+func NewBucket(limit Limit) *Bucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &Bucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token if available.
+func (b *Bucket) Allow() bool {
+	if b.limit.Unlimited() {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full indicates whether the bucket has all of its tokens, meaning it's idle.
+func (b *Bucket) full() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// refill the tokens accumulated since the last call. Must be called with the lock held.
+func (b *Bucket) refill() {
+	current := time.Now()
+	b.tokens += current.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = current
+}
+
+// pruneThreshold is the number of buckets above which the idle ones are pruned.
+const pruneThreshold = 1024
+
+// Limiter holds a Bucket per key, created on first use.
+// Idle buckets are pruned to bound memory usage.
+type Limiter struct {
+	limit     Limit
+	overrides map[string]Limit
+	buckets   map[string]*Bucket
+	mtx       sync.Mutex
+}
+
+// NewLimiter creates a Limiter applying the limit to every key, unless overridden.
+func NewLimiter(limit Limit, overrides map[string]Limit) *Limiter {
+	return &Limiter{
+		limit:     limit,
+		overrides: overrides,
+		buckets:   make(map[string]*Bucket),
+	}
+}
+
+// Allow takes a token from the bucket of the key if available.
+func (l *Limiter) Allow(key string) bool {
+	limit, overridden := l.overrides[key]
+	if !overridden {
+		limit = l.limit
+	}
+	if limit.Unlimited() {
+		return true
+	}
+	return l.bucket(key, limit).Allow()
+}
+
+func (l *Limiter) bucket(key string, limit Limit) *Bucket {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	bucket, exists := l.buckets[key]
+	if !exists {
+		if len(l.buckets) >= pruneThreshold {
+			l.prune()
+		}
+		bucket = NewBucket(limit)
+		l.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// prune the idle buckets: a full bucket is the same as a new one. Must be called with the lock held.
+func (l *Limiter) prune() {
+	for key, bucket := range l.buckets {
+		if bucket.full() {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package resp encodes and decodes the Redis serialization protocol (RESP2).
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	// MaxBulkBytes is the maximum length of a received bulk string. A bigger one is an error.
+	MaxBulkBytes = 1 << 20
+	// MaxArrayLen is the maximum number of elements of a received array. A bigger one is an error.
+	MaxArrayLen = 1024
+	// MaxArrayDepth is the maximum nesting of a received array. A deeper one is an error.
+	MaxArrayDepth = 32
+)
+
+var (
+	ErrTooLarge = errors.New("resp value too large")
+	ErrProtocol = errors.New("resp protocol error")
+)
+
+// SimpleString is a decoded simple string, bulk strings being decoded as string.
+type SimpleString string
+
+// Error is a decoded error reply.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Read the next value: a SimpleString, an Error, an int64, a string (bulk string), nil (null bulk string or array)
+// or an []any (array).
+func Read(r *bufio.Reader) (any, error) {
+	return read(r, 0)
+}
+
+func read(r *bufio.Reader, depth int) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+
+	switch line[0] {
+	case '+':
+		return SimpleString(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return parseInteger(line[1:])
+	case '$':
+		return readBulk(r, line)
+	case '*':
+		if depth >= MaxArrayDepth {
+			return nil, fmt.Errorf("%w: arrays nested too deep", ErrProtocol)
+		}
+		length, err := parseLength(line[1:], MaxArrayLen)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		array := make([]any, length)
+		for i := range array {
+			if array[i], err = read(r, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrProtocol, line[0])
+	}
+}
+
+// readBulk reads the bulk string of the header line. A null bulk string is nil.
+func readBulk(r *bufio.Reader, line []byte) (any, error) {
+	length, err := parseLength(line[1:], MaxBulkBytes)
+	if err != nil || length < 0 {
+		return nil, err
+	}
+	bulk := make([]byte, length+2)
+	if _, err = io.ReadFull(r, bulk); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(bulk, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return string(bulk[:length]), nil
+}
+
+// ReadCommand reads the next command sent by a client: an array of bulk strings, or an inline command
+// (space separated arguments on a single line). Empty inline commands are skipped.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] == '*' {
+			return readArrayCommand(r)
+		}
+
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if args := strings.Fields(string(line)); len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+// readArrayCommand reads a flat array of bulk strings, any other element being an error.
+func readArrayCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	length, err := parseLength(line[1:], MaxArrayLen)
+	if err != nil {
+		return nil, err
+	}
+	if length <= 0 {
+		return nil, fmt.Errorf("%w: empty command", ErrProtocol)
+	}
+	args := make([]string, length)
+	for i := range args {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: command arguments must be bulk strings", ErrProtocol)
+		}
+		bulk, err := readBulk(r, line)
+		if err != nil {
+			return nil, err
+		}
+		arg, ok := bulk.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: command arguments must be bulk strings", ErrProtocol)
+		}
+		args[i] = arg
+	}
+	return args, nil
+}
+
+// readLine reads a line without its CRLF. A line longer than the reader buffer is an error.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: line too long", ErrTooLarge)
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return line, nil
+}
+
+func parseInteger(field []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(field), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid integer %q", ErrProtocol, field)
+	}
+	return n, nil
+}
+
+// parseLength of a bulk string or an array, -1 being null.
+func parseLength(field []byte, maxLength int) (int, error) {
+	n, err := parseInteger(field)
+	if err != nil {
+		return 0, err
+	}
+	if n < -1 {
+		return 0, fmt.Errorf("%w: invalid length %d", ErrProtocol, n)
+	}
+	if n > int64(maxLength) {
+		return 0, ErrTooLarge
+	}
+	return int(n), nil
+}
+
+func AppendSimpleString(b []byte, s string) []byte {
+	return append(append(append(b, '+'), s...), "\r\n"...)
+}
+
+func AppendError(b []byte, message string) []byte {
+	return append(append(append(b, '-'), message...), "\r\n"...)
+}
+
+func AppendInteger(b []byte, n int64) []byte {
+	return append(strconv.AppendInt(append(b, ':'), n, 10), "\r\n"...)
+}
+
+func AppendBulkString(b []byte, s string) []byte {
+	b = append(strconv.AppendInt(append(b, '$'), int64(len(s)), 10), "\r\n"...)
+	return append(append(b, s...), "\r\n"...)
+}
+
+func AppendNull(b []byte) []byte {
+	return append(b, "$-1\r\n"...)
+}
+
+// AppendArray appends the header of an array of n elements, to be followed by its elements.
+func AppendArray(b []byte, n int) []byte {
+	return append(strconv.AppendInt(append(b, '*'), int64(n), 10), "\r\n"...)
+}
+
+// AppendCommand appends the command as an array of bulk strings.
+func AppendCommand(b []byte, args ...string) []byte {
+	b = AppendArray(b, len(args))
+	for _, arg := range args {
+		b = AppendBulkString(b, arg)
+	}
+	return b
+}
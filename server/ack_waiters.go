@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/common/maps"
+
+	"github.com/codingLayce/tunnel-server/tracing"
+)
+
+// ackWaiters are the messages sent to a client waiting for its acknowledgement, by acknowledgement id:
+// the transaction id of the Tunnel protocol, the packet id of MQTT or the ack header of STOMP.
+type ackWaiters[K comparable] struct {
+	clientID string
+	// ackAttribute is the name of the span attribute holding the acknowledgement id.
+	ackAttribute string
+	// waiters stores channels waiting for an acknowledgement. Writes true when ack, false otherwise.
+	waiters *maps.SyncMap[K, chan bool]
+	// closed once the client is disconnected.
+	closed <-chan struct{}
+}
+
+func newAckWaiters[K comparable](clientID, ackAttribute string, closed <-chan struct{}) *ackWaiters[K] {
+	return &ackWaiters[K]{
+		clientID:     clientID,
+		ackAttribute: ackAttribute,
+		waiters:      maps.NewSyncMap[K, chan bool](),
+		closed:       closed,
+	}
+}
+
+// deliver the message with send, then waits for its acknowledgement, recorded as an "ack" span.
+// Returns false if nacked, not acknowledged within MessageAckTimeout or if the client disconnects.
+func (w *ackWaiters[K]) deliver(logger *slog.Logger, trace tracing.SpanContext, ackID K, send func() error) bool {
+	ackCh := make(chan bool)
+	w.waiters.Put(ackID, ackCh)
+	defer w.waiters.Delete(ackID)
+
+	if err := send(); err != nil {
+		// The connection is closed: waits for the disconnection so the message is redelivered.
+		logger.Warn("Cannot send message", "error", err)
+		<-w.closed
+		return false
+	}
+
+	logger.Info("Message sent")
+	span := tracing.Start(trace, "ack")
+	span.SetAttribute("client", w.clientID)
+	span.SetAttribute(w.ackAttribute, fmt.Sprint(ackID))
+	defer span.End()
+
+	select {
+	case isAck := <-ackCh:
+		if isAck {
+			logger.Info("Message acked by client")
+			span.SetAttribute("outcome", "ack")
+		} else {
+			logger.Info("Message nacked by client")
+			span.SetAttribute("outcome", "nack")
+		}
+		return isAck
+	case <-time.After(MessageAckTimeout):
+		logger.Warn("Timeout waiting for client ack. Discard message")
+		span.SetAttribute("outcome", "timeout")
+		return false
+	case <-w.closed:
+		logger.Info("Disconnected before acknowledging the message")
+		span.SetAttribute("outcome", "disconnected")
+		return false
+	}
+}
+
+// resolve the message waiting for the acknowledgement. Returns false if no message waits for it.
+func (w *ackWaiters[K]) resolve(ackID K, isAck bool) bool {
+	waiter, exists := w.waiters.Get(ackID)
+	if !exists {
+		return false
+	}
+	select { // Try to push to waiter while connection isn't closed.
+	case waiter <- isAck:
+	case <-w.closed:
+	}
+	return true
+}
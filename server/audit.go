@@ -0,0 +1,21 @@
+package server
+
+import (
+	"time"
+
+	"github.com/codingLayce/tunnel-server/audit"
+)
+
+// AuditSink receives the audit trail of the server: connections, Tunnel creations, denials and forced disconnects.
+// See audit.FileSink for a JSON lines rotating file.
+type AuditSink interface {
+	Audit(event audit.Event)
+}
+
+func (s *Server) audit(event audit.Event) {
+	if s.opts.Audit == nil {
+		return
+	}
+	event.Time = time.Now()
+	s.opts.Audit.Audit(event)
+}
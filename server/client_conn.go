@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+	"github.com/codingLayce/tunnel.go/tcp"
+)
+
+// clientConn is the connection of a client, whatever its transport and encoding.
+type clientConn interface {
+	RemoteAddr() net.Addr
+	SetWriteDeadline(t time.Time) error
+	Write(payload []byte) (int, error)
+	Close() error
+
+	// encode the command into a payload to write.
+	encode(cmd command.Command) ([]byte, error)
+	// decode a payload received from the client.
+	decode(payload []byte) (command.Command, error)
+}
+
+// tcpClientConn is the connection of a client speaking the Tunnel protocol.
+type tcpClientConn struct {
+	*tcp.Connection
+}
+
+func (c tcpClientConn) encode(cmd command.Command) ([]byte, error) {
+	return pdu.Marshal(cmd), nil
+}
+
+func (c tcpClientConn) decode(payload []byte) (command.Command, error) {
+	return pdu.Unmarshal(payload)
+}
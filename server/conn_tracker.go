@@ -0,0 +1,49 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// connTracker tracks the connections served outside of the tcp.Server, to close them when stopping.
+type connTracker struct {
+	conns   map[io.Closer]struct{}
+	stopped bool
+	mtx     sync.Mutex
+	wg      sync.WaitGroup
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[io.Closer]struct{})}
+}
+
+// track the connection until untracked. Returns false once stopped: the connection must be closed.
+func (t *connTracker) track(conn io.Closer) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) untrack(conn io.Closer) {
+	t.mtx.Lock()
+	delete(t.conns, conn)
+	t.mtx.Unlock()
+	t.wg.Done()
+}
+
+// stop closes the tracked connections and waits for them to be untracked.
+func (t *connTracker) stop() {
+	t.mtx.Lock()
+	t.stopped = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mtx.Unlock()
+
+	t.wg.Wait()
+}
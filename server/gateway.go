@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// Delays between two attempts to accept a connection after a failure, as too many open files.
+const (
+	acceptRetryMinDelay = 5 * time.Millisecond
+	acceptRetryMaxDelay = time.Second
+)
+
+// gateway is an optional front-end listening besides the TCP listener: serving clients of another protocol than the
+// Tunnel one, or the Tunnel protocol on a Unix domain socket.
+type gateway interface {
+	start(addr string) error
+	// stop accepting connections and closes the connected ones.
+	stop()
+}
+
+// enabledGateway is a gateway with its configured address.
+type enabledGateway struct {
+	gateway gateway
+	addr    string
+}
+
+// connGateway is a gateway accepting the connections of its own TCP listener, each one served in its own goroutine.
+type connGateway struct {
+	// name of the protocol, for the logs.
+	name     string
+	serve    func(conn net.Conn)
+	listener net.Listener
+	conns    *connTracker
+}
+
+func newConnGateway(name string, serve func(conn net.Conn)) *connGateway {
+	return &connGateway{name: name, serve: serve, conns: newConnTracker()}
+}
+
+func (g *connGateway) start(addr string) error {
+	var err error
+	g.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", strings.ToLower(g.name), err)
+	}
+	go acceptLoop(g.name, g.listener, g.conns, g.serve)
+	slog.Info(g.name+" gateway started", "addr", g.listener.Addr().String())
+	return nil
+}
+
+// stop accepting connections, closes the connected ones and waits for their release.
+func (g *connGateway) stop() {
+	if g.listener != nil {
+		g.listener.Close()
+	}
+	g.conns.stop()
+}
+
+// listenerAddr is the address of the listener of a gateway. Empty if disabled or not started.
+func listenerAddr(listener net.Listener) string {
+	if listener == nil {
+		return ""
+	}
+	return listener.Addr().String()
+}
+
+// acceptLoop serves each accepted connection in its own goroutine until the listener is closed.
+// Accept failures are retried with an exponential backoff, as net/http.Server does.
+// The connections are tracked until served, and closed if accepted once the tracker is stopped.
+func acceptLoop(name string, listener net.Listener, conns *connTracker, serve func(conn net.Conn)) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			delay = min(max(2*delay, acceptRetryMinDelay), acceptRetryMaxDelay)
+			slog.Warn(name+" cannot accept connection. Retrying", "error", err, "delay", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		if !conns.track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer conns.untrack(conn)
+			serve(conn)
+		}()
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is the interval between two heartbeats when not configured.
+	DefaultHeartbeatInterval = 15 * time.Second
+	// DefaultMissedBeats is the number of missed heartbeats before evicting a client when not configured.
+	DefaultMissedBeats = 4
+)
+
+// HeartbeatOption configures the detection of dead connections (half-open connections, frozen or unreachable hosts).
+//
+// Heartbeats are checked at two levels:
+//   - TCP keep-alive probes sent by the server detect the unreachable hosts and half-open connections;
+//   - the server expects a response from a client it sent a message to (its acknowledgement, or the pong of a
+//     WebSocket ping). A client sending nothing during MissedBeats intervals while owing a response is frozen.
+//
+// A dead or frozen client is disconnected: its listeners are unregistered and its unacknowledged messages are
+// redelivered to the other members of their groups.
+type HeartbeatOption struct {
+	// Interval between two heartbeats. Defaults to DefaultHeartbeatInterval.
+	Interval time.Duration
+	// MissedBeats is the number of missed heartbeats before closing the connection. Defaults to DefaultMissedBeats.
+	MissedBeats int
+}
+
+func (opts *HeartbeatOption) defaults() {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultHeartbeatInterval
+	}
+	if opts.MissedBeats <= 0 {
+		opts.MissedBeats = DefaultMissedBeats
+	}
+}
+
+// enableHeartbeat on the connection.
+func enableHeartbeat(clientID string, conn net.Conn, opts *HeartbeatOption) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	err := tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     opts.Interval,
+		Interval: opts.Interval,
+		Count:    opts.MissedBeats,
+	})
+	if err != nil {
+		slog.Warn("Cannot enable heartbeat", "client", clientID, "error", err)
+	}
+}
+
+// pinger is a client connection able to ping its peer, the peer answering on its own (as WebSocket).
+type pinger interface {
+	ping() error
+}
+
+// liveness detects a frozen client: a client still holding its connection open, but not processing it anymore.
+// Each interval is a heartbeat, missed when the client owes a response and hasn't sent anything since the last one.
+type liveness struct {
+	opts *HeartbeatOption
+	// received is set when the client sends anything, owed when the server expects a response from it.
+	received atomic.Bool
+	owed     atomic.Bool
+}
+
+func newLiveness(opts *HeartbeatOption) *liveness {
+	return &liveness{opts: opts}
+}
+
+// expectResponse from the client, as the acknowledgement of the message sent.
+func (l *liveness) expectResponse() {
+	l.owed.Store(true)
+}
+
+// receive anything from the client: it's alive.
+func (l *liveness) receive() {
+	l.owed.Store(false)
+	l.received.Store(true)
+}
+
+// watch the heartbeats until closed. The ping function, if any, is called at each heartbeat and expects a response.
+// Calls evict once MissedBeats heartbeats are missed in a row.
+func (l *liveness) watch(closed <-chan struct{}, ping func() error, evict func()) {
+	ticker := time.NewTicker(l.opts.Interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+
+		if l.received.Swap(false) || !l.owed.Load() {
+			missed = 0
+		} else if missed++; missed >= l.opts.MissedBeats {
+			evict()
+			return
+		}
+		if ping != nil {
+			l.expectResponse()
+			if err := ping(); err != nil {
+				return // The connection is closed
+			}
+		}
+	}
+}
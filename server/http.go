@@ -0,0 +1,427 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/id"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel-server/webhook"
+)
+
+var (
+	// MaxHTTPBodyBytes is the maximum size of a message published over HTTP, whatever the quotas.
+	MaxHTTPBodyBytes int64 = 1 << 20
+	// HTTPReadHeaderTimeout is the maximum duration to read the headers of a request, so that slow clients
+	// don't hold their connections.
+	HTTPReadHeaderTimeout = 10 * time.Second
+)
+
+// httpGateway serves the HTTP endpoints:
+//   - POST /tunnels/{name}/messages publishes the request body to the Tunnel, now or at a scheduled time.
+//   - DELETE /scheduled/{id} cancels a scheduled message.
+//   - GET /tunnels/{name}/events streams the messages of the Tunnel as Server-Sent Events.
+//   - POST /tunnels/{name}/webhooks subscribes a webhook of an allowed host to the Tunnel (see webhook.Subscribe).
+//   - DELETE /webhooks/{id} unsubscribes a webhook.
+type httpGateway struct {
+	srv      *Server
+	http     *http.Server
+	listener net.Listener
+}
+
+func newHTTPGateway(srv *Server) *httpGateway {
+	g := &httpGateway{srv: srv}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tunnels/{name}/messages", g.publish)
+	mux.HandleFunc("DELETE /scheduled/{id}", g.cancelScheduled)
+	mux.HandleFunc("GET /tunnels/{name}/events", g.subscribe)
+	mux.HandleFunc("POST /tunnels/{name}/webhooks", g.subscribeWebhook)
+	mux.HandleFunc("DELETE /webhooks/{id}", g.unsubscribeWebhook)
+	g.http = &http.Server{Handler: mux, ReadHeaderTimeout: HTTPReadHeaderTimeout}
+	return g
+}
+
+func (g *httpGateway) start(addr string) error {
+	var err error
+	g.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen http: %w", err)
+	}
+	go func() {
+		if err := g.http.Serve(g.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP gateway stopped", "error", err)
+		}
+	}()
+	slog.Info("HTTP gateway started", "addr", g.listener.Addr().String())
+	return nil
+}
+
+// stop closes the listener and all the connections, ending the event streams.
+func (g *httpGateway) stop() {
+	g.http.Close()
+}
+
+// ScheduledResponse is the JSON body of a message scheduled with POST /tunnels/{name}/messages.
+type ScheduledResponse struct {
+	ID string `json:"id"`
+}
+
+// publish the request body to the Tunnel.
+//
+// Responds 202 once the message is queued, or 200 once confirmed by the listeners when publisher confirms are enabled.
+// The optional Idempotency-Key header is the id of the message, deduplicated by the Tunnels with deduplication enabled.
+// The optional traceparent header is the parent of the "receive" span.
+// The optional priority and key query parameters are the priority of the message and its partition key.
+// The optional delay or at query parameter schedules the message: responds 202 with a ScheduledResponse.
+func (g *httpGateway) publish(w http.ResponseWriter, r *http.Request) {
+	tunnelName := r.PathValue("name")
+	logger := slog.Default().With("remote_addr", r.RemoteAddr, "tunnel_name", tunnelName)
+
+	query := r.URL.Query()
+	var priority uint64
+	if raw := query.Get("priority"); raw != "" {
+		var err error
+		if priority, err = strconv.ParseUint(raw, 10, 8); err != nil || priority > tunnel.MaxPriority {
+			http.Error(w, fmt.Sprintf("invalid priority %q: must be from 0 to %d", raw, tunnel.MaxPriority), http.StatusBadRequest)
+			return
+		}
+	}
+	at, err := parseSchedule(query.Get("delay"), query.Get("at"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxHTTPBodyBytes))
+	if err != nil {
+		logger.Warn("Cannot read publication", "error", err)
+		http.Error(w, "cannot read body", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	parent, _ := tracing.ParseTraceParent(r.Header.Get("traceparent")) // Starts a new trace if invalid
+	pub := &publication{
+		remoteAddr: r.RemoteAddr,
+		identity:   remoteIP(r.RemoteAddr),
+		tunnelName: tunnelName,
+		message:    string(body),
+		id:         r.Header.Get("Idempotency-Key"),
+		key:        query.Get("key"),
+		priority:   uint8(priority),
+		trace:      parent,
+		logger:     logger,
+	}
+
+	if !at.IsZero() {
+		scheduledID, err := g.srv.schedule(pub, at)
+		if err != nil {
+			writePublishError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(ScheduledResponse{ID: scheduledID})
+		return
+	}
+
+	confirm, err := g.srv.publish(pub)
+	if err != nil {
+		writePublishError(w, err)
+		return
+	}
+	if g.srv.opts.PublishConfirm == tunnel.ConfirmNone {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	switch err = g.srv.confirmed(logger, confirm, r.Context().Done()); {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, errNotConfirmed):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case errors.Is(err, errConfirmTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	}
+}
+
+// parseSchedule returns the time a message is scheduled at: after the delay, or at the RFC 3339 time.
+// Zero if neither is set.
+func parseSchedule(delay, at string) (time.Time, error) {
+	switch {
+	case delay != "" && at != "":
+		return time.Time{}, errors.New("delay and at cannot be both set")
+	case delay != "":
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid delay %q", delay)
+		}
+		return time.Now().Add(d), nil
+	case at != "":
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid at %q: must be RFC 3339", at)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// writePublishError responds the status of the rejected publication.
+func writePublishError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errDraining), errors.Is(err, tunnel.ErrTunnelFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errRateLimited):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, errMessageTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, tunnel.ErrUnknownTunnel):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// cancelScheduled message of the given id. Responds 204, or 404 if already published.
+func (g *httpGateway) cancelScheduled(w http.ResponseWriter, r *http.Request) {
+	if err := tunnel.CancelScheduled(r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// subscribe streams the messages of the Tunnel as Server-Sent Events until the client disconnects.
+// The optional group query parameter joins a consumer group.
+//
+// Every message written to the stream is acknowledged: a message lost in the network isn't redelivered.
+func (g *httpGateway) subscribe(w http.ResponseWriter, r *http.Request) {
+	tunnelName := r.PathValue("name")
+	identity := remoteIP(r.RemoteAddr)
+	subscriberID := id.New()
+	subscriber := &eventSubscriber{
+		id:     subscriberID,
+		w:      w,
+		rc:     http.NewResponseController(w),
+		failed: make(chan struct{}),
+		logger: slog.Default().With("client", subscriberID, "remote_addr", r.RemoteAddr),
+	}
+	clientEvent := func(eventType audit.EventType, reason string) {
+		g.srv.audit(audit.Event{Type: eventType, Client: subscriber.id, RemoteAddr: r.RemoteAddr, Tunnel: tunnelName, Reason: reason})
+	}
+	evicted := make(chan struct{})
+	subscriber.backlog = newBacklogWatch(&g.srv.opts.SlowConsumer, func(pending int) {
+		subscriber.logger.Warn("Slow consumer. Evicting subscriber", "pending", pending, "max_pending", g.srv.opts.SlowConsumer.MaxPending)
+		metrics.SlowConsumersEvicted.Add(1)
+		clientEvent(audit.ForcedDisconnect, "slow consumer")
+		subscriber.rc.SetWriteDeadline(time.Now()) // Unblocks the event being written, if any.
+		close(evicted)
+	})
+
+	if g.srv.Draining() {
+		subscriber.logger.Info("Server draining. Rejecting subscriber")
+		clientEvent(audit.ConnectionRejected, "draining")
+		http.Error(w, "server draining", http.StatusServiceUnavailable)
+		return
+	}
+	if quota, allowed := g.srv.quotas.acquireConnection(identity); !allowed {
+		subscriber.logger.Warn("Too many connections. Rejecting subscriber", "quota", quota)
+		metrics.QuotaExceeded.Add(quota, 1)
+		clientEvent(audit.ConnectionRejected, "quota "+quota)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer g.srv.quotas.releaseConnection(identity)
+
+	if !tunnel.Exists(tunnelName) {
+		subscriber.logger.Warn("Cannot listen unknown Tunnel", "tunnel_name", tunnelName)
+		http.Error(w, fmt.Sprintf("%s %q", tunnel.ErrUnknownTunnel, tunnelName), http.StatusNotFound)
+		return
+	}
+
+	// Sends the headers before listening, so that they precede the first event.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := subscriber.rc.Flush(); err != nil {
+		subscriber.logger.Warn("Cannot send headers", "error", err)
+		return
+	}
+
+	// The status being sent, a subscription failure is an error event ending the stream.
+	if err := tunnel.ListenGroup(tunnelName, r.URL.Query().Get("group"), subscriber); err != nil {
+		subscriber.logger.Warn("Cannot listen Tunnel", "tunnel_name", tunnelName, "error", err)
+		if errors.Is(err, tunnel.ErrTooManyListeners) {
+			metrics.QuotaExceeded.Add(quotaListeners, 1)
+			clientEvent(audit.ListenDenied, "quota "+quotaListeners)
+		}
+		subscriber.sendEvent("error", err.Error())
+		return
+	}
+	clientEvent(audit.ConnectionAccepted, "")
+	subscriber.logger.Info("Listen Tunnel", "tunnel_name", tunnelName)
+
+	select {
+	case <-r.Context().Done():
+	case <-subscriber.failed:
+	case <-evicted:
+	}
+
+	// Stops listening before the handler returns, as the response cannot be written afterward.
+	tunnel.StopListen(subscriber.id)
+	subscriber.backlog.stop()
+	subscriber.close()
+	clientEvent(audit.ConnectionClosed, "")
+	subscriber.logger.Info("Disconnected")
+}
+
+// WebhookRequest is the JSON body subscribing a webhook with POST /tunnels/{name}/webhooks.
+type WebhookRequest struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	Group  string `json:"group,omitempty"`
+}
+
+// WebhookResponse is the JSON body of a subscribed webhook.
+type WebhookResponse struct {
+	ID     string `json:"id"`
+	Tunnel string `json:"tunnel"`
+}
+
+// subscribeWebhook to the Tunnel, with the default retry policy. Responds 201 with a WebhookResponse.
+func (g *httpGateway) subscribeWebhook(w http.ResponseWriter, r *http.Request) {
+	tunnelName := r.PathValue("name")
+	logger := slog.Default().With("remote_addr", r.RemoteAddr, "tunnel_name", tunnelName)
+
+	var req WebhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxHTTPBodyBytes)).Decode(&req); err != nil {
+		http.Error(w, "invalid webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !g.allowWebhook(req.URL) {
+		logger.Warn("Webhook host not allowed. Rejecting webhook", "url", req.URL)
+		g.srv.audit(audit.Event{Type: audit.ListenDenied, RemoteAddr: r.RemoteAddr, Tunnel: tunnelName, Reason: "webhook host not allowed"})
+		http.Error(w, "webhook host not allowed", http.StatusForbidden)
+		return
+	}
+
+	sub, err := webhook.Subscribe(tunnelName, &webhook.Option{URL: req.URL, Secret: req.Secret, Group: req.Group})
+	if err != nil {
+		logger.Warn("Cannot subscribe webhook", "error", err)
+		switch {
+		case errors.Is(err, tunnel.ErrUnknownTunnel):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, tunnel.ErrTooManyListeners):
+			metrics.QuotaExceeded.Add(quotaListeners, 1)
+			g.srv.audit(audit.Event{Type: audit.ListenDenied, RemoteAddr: r.RemoteAddr, Tunnel: tunnelName, Reason: "quota " + quotaListeners})
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(WebhookResponse{ID: sub.ID(), Tunnel: sub.TunnelName()})
+}
+
+// allowWebhook to the URL if its host is one of the ServerOption.WebhookAllowedHosts.
+// A host allowed without port is allowed on any port.
+func (g *httpGateway) allowWebhook(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(g.srv.opts.WebhookAllowedHosts, func(allowed string) bool {
+		return allowed == "*" || strings.EqualFold(allowed, u.Host) || strings.EqualFold(allowed, u.Hostname())
+	})
+}
+
+// unsubscribeWebhook of the given id. Responds 204.
+func (g *httpGateway) unsubscribeWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := webhook.Unsubscribe(r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventSubscriber is a Tunnel listener writing the messages to a Server-Sent Events stream.
+type eventSubscriber struct {
+	id string
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	// failed is closed when an event cannot be written, ending the stream.
+	failed chan struct{}
+	closed bool
+	mtx    sync.Mutex
+	// backlog evicts the subscriber if it's a slow consumer.
+	backlog *backlogWatch
+	logger  *slog.Logger
+}
+
+func (s *eventSubscriber) ID() string {
+	return s.id
+}
+
+func (s *eventSubscriber) Backlog(tunnelName string, pending int) {
+	s.backlog.update(s.id, tunnelName, pending)
+}
+
+// NotifyMessage writes the message as an event within WriteTimeout. Acknowledged once written.
+func (s *eventSubscriber) NotifyMessage(tunnelName, message string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return false
+	}
+
+	if err := s.sendEvent("message", message); err != nil {
+		s.logger.Warn("Cannot send event", "tunnel_name", tunnelName, "error", err)
+		s.closed = true
+		close(s.failed)
+		return false
+	}
+	s.logger.Info("Event sent", "tunnel_name", tunnelName)
+	return true
+}
+
+// sendEvent writes the event within WriteTimeout, each line of the data being a data line.
+func (s *eventSubscriber) sendEvent(eventType, data string) error {
+	var event strings.Builder
+	event.WriteString("event: " + eventType + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		event.WriteString("data: " + line + "\n")
+	}
+	event.WriteString("\n")
+
+	err := s.rc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err == nil {
+		_, err = io.WriteString(s.w, event.String())
+	}
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	return err
+}
+
+func (s *eventSubscriber) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+}
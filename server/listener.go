@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/tcp"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+)
+
+// DefaultUnixSocketMode is the default file permissions of the Unix domain sockets.
+const DefaultUnixSocketMode fs.FileMode = 0o660
+
+// defaultReadTimeout is the allowed idle duration before disconnecting a client, as for the TCP listener of Addr.
+const defaultReadTimeout = time.Minute
+
+// TLSHandshakeTimeout is the maximum duration of the TLS handshake of a new connection.
+var TLSHandshakeTimeout = 10 * time.Second
+
+// Networks of a ListenerOption.
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+)
+
+// ListenerOption configures a listener of the Tunnel protocol. Its clients share the Tunnels and the quotas of the
+// server with the clients of the other listeners.
+type ListenerOption struct {
+	// Name of the listener in the logs and the audit trail. Defaults to its network and address.
+	Name string
+	// Network of the listener: NetworkTCP (default) or NetworkUnix.
+	Network string
+	// Addr is the TCP address, or the path of the Unix domain socket. A stale socket file left by a previous process
+	// is replaced.
+	Addr string
+	// Mode is the file permissions of the Unix domain socket. Defaults to DefaultUnixSocketMode.
+	Mode fs.FileMode
+
+	// TLS serves the TCP listener over TLS. Mutual TLS is required by setting TLS.ClientAuth and TLS.ClientCAs.
+	// Only the certificates of a listener parsed by ParseListenerOption are reloaded by Server.ReloadCertificates.
+	TLS *tls.Config
+	// keyPair loaded from the files of a parsed listener, swapped on reload. Nil if not parsed.
+	keyPair *keyPair
+	// AllowedCIDRs are the networks allowed to connect to the TCP listener, as "10.0.0.0/8" or "::1/128".
+	// All allowed if empty.
+	AllowedCIDRs []string
+
+	// MaxConnections is the maximum number of simultaneous connections to the listener. Unlimited if 0.
+	MaxConnections int
+	// ReadTimeout is the allowed idle duration before disconnecting a client. Defaults to one minute.
+	ReadTimeout time.Duration
+}
+
+func (opts *ListenerOption) defaults() {
+	if opts.Network == "" {
+		opts.Network = NetworkTCP
+	}
+	if opts.Name == "" {
+		opts.Name = opts.Network + ":" + opts.Addr
+	}
+	if opts.Mode == 0 {
+		opts.Mode = DefaultUnixSocketMode
+	}
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = defaultReadTimeout
+	}
+}
+
+// ParseListenerOption parses a listener as an URL:
+//
+//	tcp://10.0.0.1:19917?allow=10.0.0.0/8,192.168.0.0/16&max-connections=100&read-timeout=30s
+//	tls://:19918?cert=server.pem&key=server-key.pem&client-ca=ca.pem
+//	unix:///run/tunnel.sock?mode=0600
+//
+// The certificate and key files of a tls listener are required. Its client-ca file, if any, requires mutual TLS
+// with a client certificate signed by one of its certificates. The files are read again by Server.ReloadCertificates.
+func ParseListenerOption(spec string) (ListenerOption, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return ListenerOption{}, fmt.Errorf("invalid listener %q: %w", spec, err)
+	}
+	query := u.Query()
+	opts := ListenerOption{Name: query.Get("name"), Addr: u.Host}
+
+	switch u.Scheme {
+	case "tcp":
+		opts.Network = NetworkTCP
+	case "tls":
+		opts.Network = NetworkTCP
+		opts.keyPair = &keyPair{certFile: query.Get("cert"), keyFile: query.Get("key"), clientCAFile: query.Get("client-ca")}
+		if err = opts.keyPair.load(); err != nil {
+			return ListenerOption{}, fmt.Errorf("invalid listener %q: %w", spec, err)
+		}
+		opts.TLS = opts.keyPair.config()
+	case "unix":
+		opts.Network = NetworkUnix
+		opts.Addr = u.Host + u.Path
+		if mode := query.Get("mode"); mode != "" {
+			parsed, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil {
+				return ListenerOption{}, fmt.Errorf("invalid listener %q: invalid mode %q", spec, mode)
+			}
+			opts.Mode = fs.FileMode(parsed)
+		}
+	default:
+		return ListenerOption{}, fmt.Errorf("invalid listener %q: unknown scheme %q, must be tcp, tls or unix", spec, u.Scheme)
+	}
+
+	if allow := query.Get("allow"); allow != "" {
+		opts.AllowedCIDRs = strings.Split(allow, ",")
+	}
+	if maxConnections := query.Get("max-connections"); maxConnections != "" {
+		if opts.MaxConnections, err = strconv.Atoi(maxConnections); err != nil {
+			return ListenerOption{}, fmt.Errorf("invalid listener %q: invalid max-connections %q", spec, maxConnections)
+		}
+	}
+	if readTimeout := query.Get("read-timeout"); readTimeout != "" {
+		if opts.ReadTimeout, err = time.ParseDuration(readTimeout); err != nil {
+			return ListenerOption{}, fmt.Errorf("invalid listener %q: invalid read-timeout %q", spec, readTimeout)
+		}
+	}
+	return opts, nil
+}
+
+// keyPair is the certificate of a TLS listener and its client CAs, loaded from their files.
+// Reloading it swaps them for the next handshakes, the established connections being kept.
+type keyPair struct {
+	certFile, keyFile, clientCAFile string
+
+	certificate atomic.Pointer[tls.Certificate]
+	// clientCAs requiring mutual TLS. Nil if there is no client-ca file.
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+// load the files, keeping the current certificate and client CAs if any of them cannot be loaded.
+func (k *keyPair) load() error {
+	if k.certFile == "" || k.keyFile == "" {
+		return errors.New("tls requires cert and key files")
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate: %w", err)
+	}
+	if k.clientCAFile == "" {
+		k.certificate.Store(&cert)
+		return nil
+	}
+
+	pem, err := os.ReadFile(k.clientCAFile)
+	if err != nil {
+		return fmt.Errorf("read client ca: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate in client ca %q", k.clientCAFile)
+	}
+	k.certificate.Store(&cert)
+	k.clientCAs.Store(clientCAs)
+	return nil
+}
+
+// config of the listener, reading the current certificate and client CAs at each handshake.
+func (k *keyPair) config() *tls.Config {
+	config := &tls.Config{GetCertificate: k.getCertificate, MinVersion: tls.VersionTLS12}
+	if k.clientCAFile != "" {
+		config.GetConfigForClient = k.getConfigForClient
+	}
+	return config
+}
+
+func (k *keyPair) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.certificate.Load(), nil
+}
+
+func (k *keyPair) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	return &tls.Config{
+		GetCertificate: k.getCertificate,
+		ClientCAs:      k.clientCAs.Load(),
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// protocolListener serves the Tunnel protocol besides the TCP listener of Addr, its clients being regular clients.
+type protocolListener struct {
+	srv          *Server
+	opts         *ListenerOption
+	allowedCIDRs []netip.Prefix
+	listener     net.Listener
+	conns        *connTracker
+	// connections to the listener, for its MaxConnections.
+	connections atomic.Int64
+}
+
+func newProtocolListener(srv *Server, opts ListenerOption) *protocolListener {
+	opts.defaults()
+	return &protocolListener{srv: srv, opts: &opts, conns: newConnTracker()}
+}
+
+// start listening. The address being the one of the options, addr is ignored.
+func (l *protocolListener) start(_ string) error {
+	for _, cidr := range l.opts.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("listener %s: invalid allowed cidr: %w", l.opts.Name, err)
+		}
+		l.allowedCIDRs = append(l.allowedCIDRs, prefix)
+	}
+
+	listener, err := l.listen()
+	if err != nil {
+		return fmt.Errorf("listener %s: %w", l.opts.Name, err)
+	}
+	l.listener = listener
+	go acceptLoop("Listener "+l.opts.Name, l.listener, l.conns, l.serve)
+	slog.Info("Listener started", "listener", l.opts.Name, "addr", l.listener.Addr().String(), "tls", l.opts.TLS != nil)
+	return nil
+}
+
+func (l *protocolListener) listen() (net.Listener, error) {
+	if l.opts.Network != NetworkUnix {
+		return net.Listen(l.opts.Network, l.opts.Addr)
+	}
+
+	path := l.opts.Addr
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen unix: %q exists and isn't a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale unix socket: %w", err)
+		}
+	}
+	listener, err := listenUnix(path, l.opts.Mode)
+	if err != nil {
+		return nil, fmt.Errorf("listen unix: %w", err)
+	}
+	return listener, nil
+}
+
+// reloadCertificates of the TLS listener, if parsed from its files.
+func (l *protocolListener) reloadCertificates() error {
+	if l.opts.keyPair == nil {
+		return nil
+	}
+	if err := l.opts.keyPair.load(); err != nil {
+		return fmt.Errorf("listener %s: %w", l.opts.Name, err)
+	}
+	slog.Info("TLS certificates reloaded", "listener", l.opts.Name)
+	return nil
+}
+
+// stop accepting connections, removing the socket file, closes the connected ones and waits for their release.
+func (l *protocolListener) stop() {
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	l.conns.stop()
+}
+
+// serve the connection as the TCP listener of Addr does, until closed.
+func (l *protocolListener) serve(conn net.Conn) {
+	defer conn.Close()
+	logger := slog.Default().With("listener", l.opts.Name, "remote_addr", conn.RemoteAddr().String())
+
+	if !l.allowed(conn.RemoteAddr()) {
+		l.reject(logger, conn, "address not allowed")
+		return
+	}
+	defer l.connections.Add(-1)
+	if connections := l.connections.Add(1); l.opts.MaxConnections > 0 && connections > int64(l.opts.MaxConnections) {
+		metrics.QuotaExceeded.Add(quotaListenerConnections, 1)
+		l.reject(logger, conn, "quota "+quotaListenerConnections)
+		return
+	}
+	if l.opts.TLS != nil {
+		tlsConn := tls.Server(conn, l.opts.TLS)
+		ctx, cancel := context.WithTimeout(context.Background(), TLSHandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			l.reject(logger, conn, "tls handshake: "+err.Error())
+			return
+		}
+		conn = tlsConn
+	}
+
+	connection := tcp.NewConnection(conn, &tcp.ConnectionOption{})
+	logger.Debug("Connection received", "client", connection.ID)
+	l.srv.connectionReceived(connection)
+
+	reader := bufio.NewReader(connection)
+	for {
+		err := connection.SetReadDeadline(time.Now().Add(l.opts.ReadTimeout))
+		if err == nil {
+			var payload []byte
+			if payload, err = reader.ReadBytes('\n'); err == nil {
+				l.srv.payloadReceived(connection, payload)
+				continue
+			}
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+			logger.Warn("Cannot read connection", "client", connection.ID, "error", err)
+		}
+		connection.Close()
+		l.srv.connectionClosed(connection, errors.Is(err, os.ErrDeadlineExceeded))
+		return
+	}
+}
+
+// allowed reports whether the remote address belongs to the allowed networks. Unix sockets are always allowed.
+func (l *protocolListener) allowed(remoteAddr net.Addr) bool {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if len(l.allowedCIDRs) == 0 || !ok {
+		return true
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range l.allowedCIDRs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *protocolListener) reject(logger *slog.Logger, conn net.Conn, reason string) {
+	logger.Warn("Rejecting connection", "reason", reason)
+	l.srv.audit(audit.Event{Type: audit.ConnectionRejected, RemoteAddr: conn.RemoteAddr().String(), Reason: "listener " + l.opts.Name + ": " + reason})
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/id"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/mqtt"
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// MQTTConnectTimeout is the maximum duration to receive the CONNECT packet of a new MQTT connection.
+var MQTTConnectTimeout = 10 * time.Second
+
+// mqttSharePrefix prefixes the shared subscriptions topic filters: $share/{group}/{topic}.
+const mqttSharePrefix = "$share/"
+
+// tunnelNameRegexp is the format of the Tunnel names of the Tunnel protocol.
+var tunnelNameRegexp = regexp.MustCompile(`^[a-zA-Z_.\-\d]+$`)
+
+// topicToTunnel maps an MQTT topic to a Tunnel name, its levels being separated by dots instead of slashes.
+// Topics with wildcards or characters not allowed in Tunnel names cannot be mapped.
+func topicToTunnel(topic string) (string, bool) {
+	tunnelName := strings.ReplaceAll(topic, "/", ".")
+	return tunnelName, tunnelNameRegexp.MatchString(tunnelName)
+}
+
+// filterToTunnel maps an MQTT topic filter to a Tunnel name and its consumer group.
+// Shared subscriptions ($share/{group}/{topic}) join the group of the Tunnel.
+func filterToTunnel(filter string) (tunnelName, group string, ok bool) {
+	if shared, isShared := strings.CutPrefix(filter, mqttSharePrefix); isShared {
+		group, filter, ok = strings.Cut(shared, "/")
+		if !ok || group == "" || strings.ContainsAny(group, "+#") {
+			return "", "", false
+		}
+	}
+	tunnelName, ok = topicToTunnel(filter)
+	return tunnelName, group, ok
+}
+
+// mqttGateway accepts the MQTT 3.1.1 clients.
+//
+// Topics are mapped onto Tunnels (see topicToTunnel), created when first subscribed.
+// Publications and subscriptions support QoS 0 and 1. Wildcards, retained messages, wills and persistent sessions
+// aren't supported: a QoS 2 publication closes the connection and a topic filter with wildcards is rejected.
+type mqttGateway struct {
+	*connGateway
+	srv *Server
+}
+
+func newMQTTGateway(srv *Server) *mqttGateway {
+	g := &mqttGateway{srv: srv}
+	g.connGateway = newConnGateway("MQTT", g.serve)
+	return g
+}
+
+// serve the connection until closed.
+func (g *mqttGateway) serve(conn net.Conn) {
+	defer conn.Close()
+	session := &mqttSession{
+		session:       newSession(id.New(), conn, g.srv),
+		reader:        bufio.NewReader(conn),
+		subscriptions: make(map[string]mqttSubscription),
+	}
+	session.ackWaiters = newAckWaiters[uint16](session.id, "packet_id", session.close)
+	session.liveness = newLiveness(&g.srv.opts.Heartbeat)
+	session.logger = session.logger.With("remote_addr", conn.RemoteAddr().String())
+
+	connect, ok := session.handshake()
+	if !ok {
+		return
+	}
+	defer g.srv.quotas.releaseConnection(session.identity)
+	enableHeartbeat(session.id, conn, &g.srv.opts.Heartbeat)
+	session.logger = session.logger.With("mqtt_client_id", connect.ClientID)
+	session.logger.Info("Connected")
+	session.audit(audit.ConnectionAccepted, "", "")
+	go session.liveness.watch(session.close, nil, session.evictFrozen)
+
+	err := session.readLoop(connect.KeepAlive)
+	session.disconnected(errors.Is(err, os.ErrDeadlineExceeded), session.id)
+}
+
+// mqttSubscription of a session to a Tunnel.
+type mqttSubscription struct {
+	topic string
+	group string
+	qos   byte
+}
+
+// mqttSession is an MQTT connection, listening to the Tunnels of its subscriptions.
+type mqttSession struct {
+	// session of the client, its id being the Tunnel listener. The MQTT client identifier is only logged.
+	*session[net.Conn]
+	reader *bufio.Reader
+
+	subscriptions map[string]mqttSubscription
+	subsMtx       sync.Mutex
+
+	// ackWaiters are the QoS 1 messages waiting for their PUBACK, by packet id.
+	ackWaiters   *ackWaiters[uint16]
+	lastPacketID atomic.Uint32
+	liveness     *liveness
+}
+
+// handshake reads the CONNECT packet and answers it. Returns false if the connection is refused.
+func (s *mqttSession) handshake() (*mqtt.Connect, bool) {
+	s.conn.SetReadDeadline(time.Now().Add(MQTTConnectTimeout))
+	packet, err := mqtt.Read(s.reader)
+	if err != nil {
+		s.logger.Warn("Cannot read MQTT CONNECT", "error", err)
+		return nil, false
+	}
+	connect, ok := packet.(*mqtt.Connect)
+	if !ok {
+		s.logger.Warn("First MQTT packet isn't CONNECT. Closing connection")
+		return nil, false
+	}
+
+	refuse := func(returnCode byte, reason string) (*mqtt.Connect, bool) {
+		s.logger.Warn("Refusing MQTT connection", "reason", reason)
+		s.audit(audit.ConnectionRejected, "", reason)
+		s.write(&mqtt.Connack{ReturnCode: returnCode})
+		return nil, false
+	}
+	switch {
+	case connect.ProtocolName != "MQTT" || connect.ProtocolLevel != mqtt.ProtocolLevel:
+		return refuse(mqtt.UnacceptableProtocol, "unsupported protocol")
+	case connect.ClientID == "" && !connect.CleanSession:
+		return refuse(mqtt.IdentifierRejected, "persistent session without client identifier")
+	case s.srv.Draining():
+		return refuse(mqtt.ServerUnavailable, "draining")
+	}
+	if quota, allowed := s.srv.quotas.acquireConnection(s.identity); !allowed {
+		metrics.QuotaExceeded.Add(quota, 1)
+		return refuse(mqtt.ServerUnavailable, "quota "+quota)
+	}
+
+	// Sessions aren't persisted: a persistent session is served as a clean one.
+	if err = s.write(&mqtt.Connack{ReturnCode: mqtt.ConnectionAccepted}); err != nil {
+		s.srv.quotas.releaseConnection(s.identity)
+		return nil, false
+	}
+	return connect, true
+}
+
+// readLoop handles the packets until the connection is closed, the client disconnects or its keep alive expires.
+func (s *mqttSession) readLoop(keepAlive uint16) error {
+	for {
+		deadline := time.Time{}
+		if keepAlive > 0 { // The client is disconnected after one and a half keep alive without packet
+			deadline = time.Now().Add(time.Duration(keepAlive) * 1500 * time.Millisecond)
+		}
+		s.conn.SetReadDeadline(deadline)
+
+		packet, err := mqtt.Read(s.reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Cannot read MQTT packet", "error", err)
+			}
+			return err
+		}
+		s.liveness.receive()
+
+		switch p := packet.(type) {
+		case *mqtt.Publish:
+			err = s.handlePublish(p)
+		case *mqtt.Puback:
+			s.handlePuback(p)
+		case *mqtt.Subscribe:
+			err = s.handleSubscribe(p)
+		case *mqtt.Unsubscribe:
+			err = s.handleUnsubscribe(p)
+		case *mqtt.Pingreq:
+			err = s.write(&mqtt.Pingresp{})
+		case *mqtt.Disconnect:
+			return nil
+		default:
+			err = fmt.Errorf("unexpected mqtt packet %T", p)
+		}
+		if err != nil {
+			s.logger.Warn("Closing MQTT connection", "error", err)
+			return err
+		}
+	}
+}
+
+// handlePublish publishes the message to the Tunnel of the topic.
+// MQTT 3.1.1 has no negative acknowledgement: a rejected QoS 1 publication is dropped without PUBACK.
+func (s *mqttSession) handlePublish(p *mqtt.Publish) error {
+	if p.QoS > 1 {
+		return errors.New("qos 2 not supported")
+	}
+	logger := s.logger.With("topic", p.Topic, "packet_id", p.PacketID)
+	tunnelName, ok := topicToTunnel(p.Topic)
+	if !ok {
+		logger.Warn("Invalid topic. Dropping publication")
+		return nil
+	}
+
+	confirm, err := s.srv.publish(&publication{
+		clientID:   s.id,
+		remoteAddr: s.conn.RemoteAddr().String(),
+		identity:   s.identity,
+		tunnelName: tunnelName,
+		message:    string(p.Payload),
+		logger:     logger,
+	})
+	switch {
+	case errors.Is(err, errUnsupportedMessage): // Closes the connection, as MQTT 3.1.1 has no negative acknowledgement
+		return err
+	case err != nil:
+		return nil // Dropped
+	}
+
+	if p.QoS == 0 {
+		return nil
+	}
+	if s.srv.opts.PublishConfirm == tunnel.ConfirmNone {
+		return s.write(&mqtt.Puback{PacketID: p.PacketID})
+	}
+	// Waits for the confirmation in its own goroutine to keep reading the client's packets (including its PUBACKs).
+	go s.confirmPublication(logger, p.PacketID, confirm)
+	return nil
+}
+
+// confirmPublication with a PUBACK once confirmed by the listeners. No PUBACK otherwise.
+func (s *mqttSession) confirmPublication(logger *slog.Logger, packetID uint16, confirm *tunnel.Confirmation) {
+	if s.srv.confirmed(logger, confirm, s.close) == nil {
+		s.write(&mqtt.Puback{PacketID: packetID})
+	}
+}
+
+func (s *mqttSession) handlePuback(p *mqtt.Puback) {
+	if !s.ackWaiters.resolve(p.PacketID, true) {
+		s.logger.Warn("No waiter for the given PUBACK. Ignoring it", "packet_id", p.PacketID)
+	}
+}
+
+// handleSubscribe listens to the Tunnels of the topic filters, creating the missing ones.
+func (s *mqttSession) handleSubscribe(p *mqtt.Subscribe) error {
+	returnCodes := make([]byte, len(p.Filters))
+	for i, filter := range p.Filters {
+		returnCodes[i] = s.subscribe(filter)
+	}
+	return s.write(&mqtt.Suback{PacketID: p.PacketID, ReturnCodes: returnCodes})
+}
+
+// subscribe to the filter. Returns the granted QoS or mqtt.SubscriptionFailure.
+func (s *mqttSession) subscribe(filter mqtt.TopicFilter) byte {
+	logger := s.logger.With("topic_filter", filter.Topic)
+	tunnelName, group, ok := filterToTunnel(filter.Topic)
+	if !ok {
+		logger.Warn("Unsupported topic filter. Rejecting subscription")
+		return mqtt.SubscriptionFailure
+	}
+	qos := min(filter.QoS, 1)
+	topic := filter.Topic
+	if group != "" {
+		topic = strings.TrimPrefix(topic, mqttSharePrefix+group+"/")
+	}
+
+	subscription := mqttSubscription{topic: topic, group: group, qos: qos}
+	if current, exists := s.subscription(tunnelName); exists {
+		if current.group == group { // Resubscribing only updates the QoS
+			s.setSubscription(tunnelName, &subscription)
+			return qos
+		}
+		s.unsubscribe(tunnelName)
+	}
+
+	// Registered before listening so the first notifications find it.
+	s.setSubscription(tunnelName, &subscription)
+	created, err := s.srv.listenCreating(s.identity, tunnelName, group, s)
+	if created {
+		logger.Info("Broadcast Tunnel created", "tunnel_name", tunnelName)
+		s.audit(audit.TunnelCreated, tunnelName, "")
+	}
+	if err != nil {
+		s.setSubscription(tunnelName, nil)
+		logger.Warn("Cannot listen Tunnel. Rejecting subscription", "tunnel_name", tunnelName, "error", err)
+		switch {
+		case errors.Is(err, errTunnelsQuota):
+			s.audit(audit.TunnelCreationDenied, tunnelName, "quota "+quotaTunnelsPerOwner)
+		case errors.Is(err, tunnel.ErrTooManyListeners):
+			metrics.QuotaExceeded.Add(quotaListeners, 1)
+			s.audit(audit.ListenDenied, tunnelName, "quota "+quotaListeners)
+		}
+		return mqtt.SubscriptionFailure
+	}
+	logger.Info("Listen Tunnel", "tunnel_name", tunnelName, "group", group, "qos", qos)
+	return qos
+}
+
+func (s *mqttSession) unsubscribe(tunnelName string) {
+	tunnel.StopListenTunnel(tunnelName, s.id)
+	s.setSubscription(tunnelName, nil)
+	s.logger.Info("Stop listening Tunnel", "tunnel_name", tunnelName)
+}
+
+func (s *mqttSession) subscription(tunnelName string) (mqttSubscription, bool) {
+	s.subsMtx.Lock()
+	defer s.subsMtx.Unlock()
+	subscription, exists := s.subscriptions[tunnelName]
+	return subscription, exists
+}
+
+// setSubscription to the Tunnel, deleting it if nil.
+func (s *mqttSession) setSubscription(tunnelName string, subscription *mqttSubscription) {
+	s.subsMtx.Lock()
+	defer s.subsMtx.Unlock()
+	if subscription == nil {
+		delete(s.subscriptions, tunnelName)
+		return
+	}
+	s.subscriptions[tunnelName] = *subscription
+}
+
+func (s *mqttSession) handleUnsubscribe(p *mqtt.Unsubscribe) error {
+	for _, filter := range p.Topics {
+		if tunnelName, _, ok := filterToTunnel(filter); ok {
+			s.unsubscribe(tunnelName)
+		}
+	}
+	return s.write(&mqtt.Unsuback{PacketID: p.PacketID})
+}
+
+func (s *mqttSession) ID() string {
+	return s.id
+}
+
+// Backlog of the session in the Tunnel, watched to evict the client if it's a slow consumer.
+func (s *mqttSession) Backlog(tunnelName string, pending int) {
+	s.backlog.update(s.id, tunnelName, pending)
+}
+
+func (s *mqttSession) NotifyMessage(tunnelName, msg string) bool {
+	return s.NotifyTracedMessage(tracing.SpanContext{}, tunnelName, msg)
+}
+
+// NotifyTracedMessage publishes the message with the QoS of the subscription.
+// A QoS 0 message is acknowledged once written, a QoS 1 one once its PUBACK is received.
+func (s *mqttSession) NotifyTracedMessage(trace tracing.SpanContext, tunnelName, msg string) bool {
+	subscription, exists := s.subscription(tunnelName)
+	if !exists { // Unsubscribed in the meantime
+		return false
+	}
+
+	publish := &mqtt.Publish{QoS: subscription.qos, Topic: subscription.topic, Payload: []byte(msg)}
+	if publish.QoS == 0 {
+		if err := s.write(publish); err != nil {
+			<-s.close
+			return false
+		}
+		return true
+	}
+
+	publish.PacketID = s.nextPacketID()
+	logger := s.logger.With("packet_id", publish.PacketID)
+	return s.ackWaiters.deliver(logger, trace, publish.PacketID, func() error {
+		if err := s.write(publish); err != nil {
+			return err
+		}
+		s.liveness.expectResponse()
+		return nil
+	})
+}
+
+// nextPacketID returns a packet id, never zero.
+func (s *mqttSession) nextPacketID() uint16 {
+	for {
+		if packetID := uint16(s.lastPacketID.Add(1)); packetID != 0 {
+			return packetID
+		}
+	}
+}
+
+// write the packet within WriteTimeout. The connection is closed on failure.
+func (s *mqttSession) write(packet mqtt.Packet) error {
+	return s.session.write(mqtt.Marshal(packet))
+}
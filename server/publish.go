@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// Errors of a rejected publication, besides the ones of tunnel.Publish.
+var (
+	errDraining        = errors.New("server draining")
+	errRateLimited     = errors.New("rate limit exceeded")
+	errMessageTooLarge = errors.New("message too large")
+	// errUnsupportedMessage is returned for a message the Tunnel protocol cannot carry to its clients.
+	errUnsupportedMessage = errors.New("message unsupported by the Tunnel protocol: letters, digits, spaces and underscores only")
+	errNotConfirmed       = errors.New("message not confirmed by listeners")
+	errConfirmTimeout     = errors.New("timeout waiting for listeners confirmation")
+	// errPublisherGone is returned when the publisher disconnects while waiting for the confirmation.
+	errPublisherGone = errors.New("publisher disconnected")
+)
+
+// messageRegexp matches the messages the Tunnel protocol can carry, whatever the protocol of the publisher.
+var messageRegexp = regexp.MustCompile(`^[a-zA-Z0-9 _]+$`)
+
+// publication of a message by a client, whatever its protocol.
+type publication struct {
+	// clientID of the publisher. Empty for the one-shot HTTP publishers.
+	clientID   string
+	remoteAddr string
+	// identity of the publisher, used for rate limiting: its remote IP.
+	identity string
+
+	tunnelName string
+	message    string
+	// id of the message, deduplicated by the Tunnels with deduplication enabled. Optional.
+	id string
+	// key routing the message to a partition of a partitioned Tunnel. Optional.
+	key string
+	// priority of the message, taken into account by the Tunnels with priority enabled.
+	priority uint8
+	// trace continued by the "receive" span. A new trace is started if invalid.
+	trace tracing.SpanContext
+
+	logger *slog.Logger
+}
+
+// publish the message unless the server is draining, the publisher is rate limited or the message above the quota.
+// The returned Confirmation is notified of the listeners acknowledgements (see confirmed).
+func (s *Server) publish(pub *publication) (*tunnel.Confirmation, error) {
+	if err := s.admit(pub); err != nil {
+		return nil, err
+	}
+	span := pub.startSpan()
+	defer span.End()
+
+	confirm := tunnel.NewConfirmation(s.opts.PublishConfirm)
+	err := tunnel.Publish(pub.tunnelName, pub.tunnelMessage(confirm, span))
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		pub.logger.Warn("Cannot publish message", "error", err)
+		return nil, err
+	}
+	pub.logger.Info("Message published to Tunnel", "tunnel_name", pub.tunnelName, "trace_id", span.Context().TraceID.String())
+	return confirm, nil
+}
+
+// schedule the publication of the message at the given time, as publish does. Returns the id of the scheduled message.
+// The publisher isn't notified of the listeners acknowledgements of a scheduled message.
+func (s *Server) schedule(pub *publication, at time.Time) (string, error) {
+	if err := s.admit(pub); err != nil {
+		return "", err
+	}
+	span := pub.startSpan()
+	defer span.End()
+
+	scheduledID, err := tunnel.PublishMessageAt(pub.tunnelName, pub.tunnelMessage(nil, span), at)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		pub.logger.Warn("Cannot schedule message", "error", err)
+		return "", err
+	}
+	pub.logger.Info("Message scheduled", "tunnel_name", pub.tunnelName, "scheduled_id", scheduledID, "at", at)
+	return scheduledID, nil
+}
+
+// admit the publication unless the server is draining, the message unsupported by the Tunnel protocol, the publisher
+// rate limited or the message above the quota.
+func (s *Server) admit(pub *publication) error {
+	deny := func(reason string) {
+		s.audit(audit.Event{
+			Type:       audit.PublicationDenied,
+			Client:     pub.clientID,
+			RemoteAddr: pub.remoteAddr,
+			Tunnel:     pub.tunnelName,
+			Reason:     reason,
+		})
+	}
+
+	if s.Draining() {
+		pub.logger.Info("Server draining. Rejecting publication")
+		return errDraining
+	}
+	if !messageRegexp.MatchString(pub.message) {
+		pub.logger.Warn("Message unsupported by the Tunnel protocol. Rejecting publication")
+		return errUnsupportedMessage
+	}
+	if scope, allowed := s.limiters.Load().allowPublish(pub.identity, pub.tunnelName); !allowed {
+		pub.logger.Warn("Rate limit exceeded. Rejecting publication", "limit", scope)
+		metrics.RateLimited.Add(scope, 1)
+		deny("rate limit " + scope)
+		return errRateLimited
+	}
+	if !s.quotas.allowMessage(pub.message) {
+		pub.logger.Warn("Message too large. Rejecting publication", "quota", quotaMessageBytes)
+		metrics.QuotaExceeded.Add(quotaMessageBytes, 1)
+		deny("quota " + quotaMessageBytes)
+		return errMessageTooLarge
+	}
+	return nil
+}
+
+// startSpan of the reception of the publication.
+func (pub *publication) startSpan() *tracing.ActiveSpan {
+	span := tracing.Start(pub.trace, "receive")
+	span.SetAttribute("tunnel", pub.tunnelName)
+	span.SetAttribute("remote_addr", pub.remoteAddr)
+	if pub.clientID != "" {
+		span.SetAttribute("client", pub.clientID)
+	}
+	if pub.id != "" {
+		span.SetAttribute("message_id", pub.id)
+	}
+	return span
+}
+
+func (pub *publication) tunnelMessage(confirm *tunnel.Confirmation, span *tracing.ActiveSpan) tunnel.Message {
+	return tunnel.Message{
+		ID:       pub.id,
+		SenderID: pub.clientID,
+		Msg:      pub.message,
+		Key:      pub.key,
+		Priority: pub.priority,
+		Confirm:  confirm,
+		Trace:    span.Context(),
+	}
+}
+
+// confirmed waits for the confirmation of the publication by the listeners, within PublishConfirmTimeout.
+// Returns nil right away when publisher confirms are disabled, errPublisherGone once gone is closed.
+func (s *Server) confirmed(logger *slog.Logger, confirm *tunnel.Confirmation, gone <-chan struct{}) error {
+	if s.opts.PublishConfirm == tunnel.ConfirmNone {
+		return nil
+	}
+	select {
+	case <-confirm.Done():
+		if !confirm.Confirmed() {
+			logger.Warn("Message not confirmed by listeners")
+			return errNotConfirmed
+		}
+		return nil
+	case <-time.After(PublishConfirmTimeout):
+		logger.Warn("Timeout waiting for listeners confirmation")
+		return errConfirmTimeout
+	case <-gone:
+		return errPublisherGone
+	}
+}
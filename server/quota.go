@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sync"
+)
+
+// Names of the quotas.
+const (
+	quotaConnections      = "connections"
+	quotaConnectionsPerIP = "connections_per_ip"
+	quotaTunnelsPerOwner  = "tunnels_per_owner"
+	quotaListeners        = "listeners_per_tunnel"
+	quotaMessageBytes     = "message_bytes"
+	// quotaListenerConnections is the MaxConnections of a ListenerOption.
+	quotaListenerConnections = "listener_connections"
+)
+
+// QuotaOption configures the resource quotas of the server. Zero quotas are unlimited.
+type QuotaOption struct {
+	// MaxConnections is the maximum number of simultaneous connections. Exceeding connections are closed.
+	MaxConnections int `json:"max_connections"`
+	// MaxConnectionsPerIP is the maximum number of simultaneous connections from the same IP. Exceeding connections are closed.
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// MaxTunnelsPerOwner is the maximum number of Tunnels created by the same client IP.
+	MaxTunnelsPerOwner int `json:"max_tunnels_per_owner"`
+	// MaxListenersPerTunnel is the maximum number of listeners of a Tunnel created by a client.
+	MaxListenersPerTunnel int `json:"max_listeners_per_tunnel"`
+	// MaxMessageBytes is the maximum size of a published message.
+	MaxMessageBytes int `json:"max_message_bytes"`
+}
+
+type quotas struct {
+	opts QuotaOption
+
+	connections      int
+	connectionsPerIP map[string]int
+	tunnelsPerOwner  map[string]int
+	mtx              sync.Mutex
+}
+
+func newQuotas(opts QuotaOption) *quotas {
+	return &quotas{
+		opts:             opts,
+		connectionsPerIP: make(map[string]int),
+		tunnelsPerOwner:  make(map[string]int),
+	}
+}
+
+// acquireConnection counts a new connection from the IP.
+// Returns the name of the exceeded quota if not allowed.
+func (q *quotas) acquireConnection(ip string) (string, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	switch {
+	case exceeded(q.opts.MaxConnections, q.connections):
+		return quotaConnections, false
+	case exceeded(q.opts.MaxConnectionsPerIP, q.connectionsPerIP[ip]):
+		return quotaConnectionsPerIP, false
+	}
+	q.connections++
+	q.connectionsPerIP[ip]++
+	return "", true
+}
+
+func (q *quotas) releaseConnection(ip string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.connections--
+	q.connectionsPerIP[ip]--
+	if q.connectionsPerIP[ip] <= 0 {
+		delete(q.connectionsPerIP, ip)
+	}
+}
+
+// acquireTunnel counts a new Tunnel for the owner. Returns false if the quota is exceeded.
+func (q *quotas) acquireTunnel(owner string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if exceeded(q.opts.MaxTunnelsPerOwner, q.tunnelsPerOwner[owner]) {
+		return false
+	}
+	q.tunnelsPerOwner[owner]++
+	return true
+}
+
+// releaseTunnel uncounts a Tunnel that couldn't be created.
+func (q *quotas) releaseTunnel(owner string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.tunnelsPerOwner[owner]--
+}
+
+func (q *quotas) allowMessage(msg string) bool {
+	maxBytes := q.options().MaxMessageBytes
+	return maxBytes <= 0 || len(msg) <= maxBytes
+}
+
+func (q *quotas) options() QuotaOption {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.opts
+}
+
+// setOptions replaces the quotas. The resources already acquired are kept, even above the new quotas.
+func (q *quotas) setOptions(opts QuotaOption) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.opts = opts
+}
+
+// exceeded indicates whether adding one to the current value exceeds the quota.
+func exceeded(quota, current int) bool {
+	return quota > 0 && current >= quota
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"github.com/codingLayce/tunnel-server/ratelimit"
+)
+
+// Scopes of the rate limits.
+const (
+	rateLimitGlobal = "global"
+	rateLimitClient = "client"
+	rateLimitTunnel = "tunnel"
+)
+
+// RateLimitOption configures the rate of publications. Zero limits are unlimited.
+type RateLimitOption struct {
+	// Global applies to every publication of the server.
+	Global ratelimit.Limit `json:"global"`
+	// PerClient applies to the publications of each client identity (its remote IP).
+	PerClient ratelimit.Limit `json:"per_client"`
+	// Clients overrides PerClient for the given identities.
+	Clients map[string]ratelimit.Limit `json:"clients"`
+	// PerTunnel applies to the publications to each Tunnel.
+	PerTunnel ratelimit.Limit `json:"per_tunnel"`
+	// Tunnels overrides PerTunnel for the given Tunnels.
+	Tunnels map[string]ratelimit.Limit `json:"tunnels"`
+}
+
+type rateLimiters struct {
+	global  *ratelimit.Bucket
+	clients *ratelimit.Limiter
+	tunnels *ratelimit.Limiter
+}
+
+func newRateLimiters(opts *RateLimitOption) *rateLimiters {
+	return &rateLimiters{
+		global:  ratelimit.NewBucket(opts.Global),
+		clients: ratelimit.NewLimiter(opts.PerClient, opts.Clients),
+		tunnels: ratelimit.NewLimiter(opts.PerTunnel, opts.Tunnels),
+	}
+}
+
+// allowPublish takes a token from each limit applying to the publication.
+// Returns the scope of the exceeded limit if not allowed.
+func (r *rateLimiters) allowPublish(identity, tunnelName string) (string, bool) {
+	switch {
+	case !r.clients.Allow(identity):
+		return rateLimitClient, false
+	case !r.tunnels.Allow(tunnelName):
+		return rateLimitTunnel, false
+	case !r.global.Allow():
+		return rateLimitGlobal, false
+	}
+	return "", true
+}
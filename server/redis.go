@@ -0,0 +1,430 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/codingLayce/tunnel.go/id"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/resp"
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// channelToTunnel maps a Redis channel to a Tunnel name, its segments being separated by dots instead of colons.
+// Channels with characters not allowed in Tunnel names cannot be mapped.
+func channelToTunnel(channel string) (string, bool) {
+	tunnelName := strings.ReplaceAll(channel, ":", ".")
+	return tunnelName, tunnelNameRegexp.MatchString(tunnelName)
+}
+
+// tunnelToChannel maps a Tunnel name back to a Redis channel, its segments being separated by colons instead of dots.
+func tunnelToChannel(tunnelName string) string {
+	return strings.ReplaceAll(tunnelName, ".", ":")
+}
+
+// checkPattern checks the syntax of the Redis glob-style pattern.
+func checkPattern(pattern string) error {
+	_, err := path.Match(strings.ReplaceAll(pattern, ":", "."), "")
+	return err
+}
+
+// matchPattern reports whether the Tunnel name matches the valid Redis glob-style pattern, colons matching dots.
+func matchPattern(pattern, tunnelName string) bool {
+	matched, _ := path.Match(strings.ReplaceAll(pattern, ":", "."), tunnelName)
+	return matched
+}
+
+// patternTunnels returns the names of the existing Tunnels matching the valid Redis glob-style pattern.
+func patternTunnels(pattern string) []string {
+	var names []string
+	for name := range tunnel.AllStats() {
+		if matchPattern(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// redisGateway accepts the Redis clients, serving the pub/sub commands of RESP2:
+// PUBLISH, SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE, PUNSUBSCRIBE, PING and QUIT.
+//
+// Channels are mapped onto Tunnels (see channelToTunnel), created when first subscribed.
+// As with Redis, messages are delivered at most once: a message is acknowledged as soon as it's written.
+type redisGateway struct {
+	*connGateway
+	srv *Server
+}
+
+func newRedisGateway(srv *Server) *redisGateway {
+	g := &redisGateway{srv: srv}
+	g.connGateway = newConnGateway("Redis", g.serve)
+	return g
+}
+
+// serve the connection until closed.
+func (g *redisGateway) serve(conn net.Conn) {
+	defer conn.Close()
+	session := &redisSession{
+		session:  newSession(id.New(), conn, g.srv),
+		reader:   bufio.NewReader(conn),
+		channels: make(map[string]*redisSubscription),
+		patterns: make(map[string]*redisSubscription),
+	}
+	session.logger = session.logger.With("remote_addr", conn.RemoteAddr().String())
+
+	if !session.accept() {
+		return
+	}
+	defer g.srv.quotas.releaseConnection(session.identity)
+	enableHeartbeat(session.id, conn, &g.srv.opts.Heartbeat)
+	session.logger.Info("Connected")
+	session.audit(audit.ConnectionAccepted, "", "")
+
+	err := session.readLoop()
+	for _, subscription := range session.subscriptions() {
+		subscription.stop()
+	}
+	session.disconnected(errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+// redisSession is a Redis connection. Its channels and patterns are only accessed by its read loop.
+type redisSession struct {
+	*session[net.Conn]
+	reader *bufio.Reader
+
+	// channels subscribed by channel name, patterns by pattern.
+	channels map[string]*redisSubscription
+	patterns map[string]*redisSubscription
+}
+
+// accept the connection unless the server is draining or a connection quota is exceeded.
+// A rejected client receives an error reply before being closed.
+func (s *redisSession) accept() bool {
+	reject := func(message, reason string) bool {
+		s.logger.Warn("Rejecting Redis connection", "reason", reason)
+		s.audit(audit.ConnectionRejected, "", reason)
+		s.write(resp.AppendError(nil, message))
+		return false
+	}
+	if s.srv.Draining() {
+		return reject("ERR server draining", "draining")
+	}
+	if quota, allowed := s.srv.quotas.acquireConnection(s.identity); !allowed {
+		metrics.QuotaExceeded.Add(quota, 1)
+		return reject("ERR max number of clients reached", "quota "+quota)
+	}
+	return true
+}
+
+// readLoop handles the commands until the connection is closed or the client quits.
+func (s *redisSession) readLoop() error {
+	for {
+		args, err := resp.ReadCommand(s.reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Cannot read Redis command", "error", err)
+				s.write(resp.AppendError(nil, "ERR Protocol error: "+err.Error()))
+			}
+			return err
+		}
+
+		name := strings.ToLower(args[0])
+		if name == "quit" {
+			s.write(resp.AppendSimpleString(nil, "OK"))
+			return nil
+		}
+		if err = s.handle(name, args[1:]); err != nil {
+			return err
+		}
+	}
+}
+
+// handle the command. Returns an error only when the connection must be closed.
+func (s *redisSession) handle(name string, args []string) error {
+	subscribed := len(s.channels)+len(s.patterns) > 0
+	switch {
+	case name == "ping" && len(args) <= 1:
+		return s.handlePing(subscribed, args)
+	case name == "subscribe" && len(args) >= 1:
+		return s.handleSubscribe(args)
+	case name == "unsubscribe":
+		return s.handleUnsubscribe(args)
+	case name == "psubscribe" && len(args) >= 1:
+		return s.handlePSubscribe(args)
+	case name == "punsubscribe":
+		return s.handlePUnsubscribe(args)
+	case name == "publish" && len(args) == 2 && !subscribed:
+		return s.handlePublish(args[0], args[1])
+	case name == "publish" && subscribed:
+		return s.write(resp.AppendError(nil, "ERR Can't execute 'publish': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+	case name == "ping" || name == "subscribe" || name == "psubscribe" || name == "publish":
+		return s.write(resp.AppendError(nil, fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)))
+	default:
+		return s.write(resp.AppendError(nil, fmt.Sprintf("ERR unknown command '%s'", name)))
+	}
+}
+
+// handlePing replies PONG, or the pong push of the subscribed clients.
+func (s *redisSession) handlePing(subscribed bool, args []string) error {
+	message := ""
+	if len(args) == 1 {
+		message = args[0]
+	}
+	switch {
+	case subscribed:
+		return s.write(resp.AppendCommand(nil, "pong", message))
+	case len(args) == 1:
+		return s.write(resp.AppendBulkString(nil, message))
+	default:
+		return s.write(resp.AppendSimpleString(nil, "PONG"))
+	}
+}
+
+// handlePublish publishes the message to the Tunnel of the channel, replying 1 once published
+// (or confirmed when publisher confirms are enabled), 0 if the channel has no Tunnel and an error if rejected.
+// Messages being queued, the number of receivers isn't known when replying.
+func (s *redisSession) handlePublish(channel, message string) error {
+	logger := s.logger.With("channel", channel)
+	tunnelName, ok := channelToTunnel(channel)
+	if !ok {
+		logger.Warn("Invalid channel. Rejecting publication")
+		return s.write(resp.AppendError(nil, "ERR invalid channel name"))
+	}
+
+	confirm, err := s.srv.publish(&publication{
+		clientID:   s.id,
+		remoteAddr: s.conn.RemoteAddr().String(),
+		identity:   s.identity,
+		tunnelName: tunnelName,
+		message:    message,
+		logger:     logger,
+	})
+	switch {
+	case errors.Is(err, tunnel.ErrUnknownTunnel): // Nobody subscribed to the channel
+		return s.write(resp.AppendInteger(nil, 0))
+	case errors.Is(err, errDraining), errors.Is(err, errRateLimited), errors.Is(err, errMessageTooLarge),
+		errors.Is(err, errUnsupportedMessage):
+		return s.write(resp.AppendError(nil, "ERR "+err.Error()))
+	case err != nil:
+		return s.write(resp.AppendError(nil, "ERR cannot publish: "+err.Error()))
+	}
+
+	// Replies are sent in order: the following commands wait for the confirmation.
+	if err = s.srv.confirmed(logger, confirm, s.close); err != nil {
+		return s.write(resp.AppendError(nil, "ERR "+err.Error()))
+	}
+	return s.write(resp.AppendInteger(nil, 1))
+}
+
+// handleSubscribe listens to the Tunnels of the channels, creating the missing ones.
+// A channel that cannot be subscribed is replied an error in place of its confirmation.
+func (s *redisSession) handleSubscribe(channels []string) error {
+	for _, channel := range channels {
+		if err := s.subscribe(channel); err != nil {
+			if err = s.write(resp.AppendError(nil, fmt.Sprintf("ERR cannot subscribe to '%s': %s", channel, err))); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.writeConfirmation("subscribe", channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisSession) subscribe(channel string) error {
+	if _, exists := s.channels[channel]; exists {
+		return nil
+	}
+	logger := s.logger.With("channel", channel)
+	tunnelName, ok := channelToTunnel(channel)
+	if !ok {
+		logger.Warn("Invalid channel. Rejecting subscription")
+		return errors.New("invalid channel name")
+	}
+
+	subscription := &redisSubscription{id: id.New(), session: s, channel: channel}
+	created, err := s.srv.listenCreating(s.identity, tunnelName, "", subscription)
+	if created {
+		logger.Info("Broadcast Tunnel created", "tunnel_name", tunnelName)
+		s.audit(audit.TunnelCreated, tunnelName, "")
+	}
+	if err != nil {
+		logger.Warn("Cannot listen Tunnel. Rejecting subscription", "tunnel_name", tunnelName, "error", err)
+		switch {
+		case errors.Is(err, errTunnelsQuota):
+			s.audit(audit.TunnelCreationDenied, tunnelName, "quota "+quotaTunnelsPerOwner)
+		case errors.Is(err, tunnel.ErrTooManyListeners):
+			metrics.QuotaExceeded.Add(quotaListeners, 1)
+			s.audit(audit.ListenDenied, tunnelName, "quota "+quotaListeners)
+		}
+		return err
+	}
+	s.channels[channel] = subscription
+	logger.Info("Listen Tunnel", "tunnel_name", tunnelName)
+	return nil
+}
+
+// handleUnsubscribe stops listening to the Tunnels of the channels, or of every channel if none is given.
+func (s *redisSession) handleUnsubscribe(channels []string) error {
+	if len(channels) == 0 {
+		channels = slices.Sorted(maps.Keys(s.channels))
+	}
+	if len(channels) == 0 {
+		return s.writeConfirmation("unsubscribe", "")
+	}
+	for _, channel := range channels {
+		if subscription, exists := s.channels[channel]; exists {
+			subscription.stop()
+			delete(s.channels, channel)
+			s.logger.Info("Stop listening Tunnel", "channel", channel)
+		}
+		if err := s.writeConfirmation("unsubscribe", channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePSubscribe listens to the Tunnels matching the patterns, including the ones created afterward.
+func (s *redisSession) handlePSubscribe(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, exists := s.patterns[pattern]; !exists {
+			if err := checkPattern(pattern); err != nil {
+				if err = s.write(resp.AppendError(nil, fmt.Sprintf("ERR invalid pattern '%s'", pattern))); err != nil {
+					return err
+				}
+				continue
+			}
+
+			subscription := &redisSubscription{id: id.New(), session: s, pattern: pattern}
+			// Watches before listing the existing Tunnels not to miss the ones created meanwhile
+			tunnel.WatchCreations(subscription.id, func(tunnelName string) {
+				if matchPattern(pattern, tunnelName) {
+					subscription.listen(tunnelName)
+				}
+			})
+			tunnelNames := patternTunnels(pattern)
+			for _, tunnelName := range tunnelNames {
+				subscription.listen(tunnelName)
+			}
+			s.patterns[pattern] = subscription
+			s.logger.Info("Listen Tunnels matching pattern", "pattern", pattern, "tunnels", tunnelNames)
+		}
+		if err := s.writeConfirmation("psubscribe", pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePUnsubscribe stops listening to the Tunnels of the patterns, or of every pattern if none is given.
+func (s *redisSession) handlePUnsubscribe(patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = slices.Sorted(maps.Keys(s.patterns))
+	}
+	if len(patterns) == 0 {
+		return s.writeConfirmation("punsubscribe", "")
+	}
+	for _, pattern := range patterns {
+		if subscription, exists := s.patterns[pattern]; exists {
+			subscription.stop()
+			delete(s.patterns, pattern)
+			s.logger.Info("Stop listening Tunnels matching pattern", "pattern", pattern)
+		}
+		if err := s.writeConfirmation("punsubscribe", pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeConfirmation of a (un)subscription: its kind, its channel or pattern (null if empty)
+// and the number of subscriptions of the session.
+func (s *redisSession) writeConfirmation(kind, channel string) error {
+	reply := resp.AppendArray(nil, 3)
+	reply = resp.AppendBulkString(reply, kind)
+	if channel == "" {
+		reply = resp.AppendNull(reply)
+	} else {
+		reply = resp.AppendBulkString(reply, channel)
+	}
+	return s.write(resp.AppendInteger(reply, int64(len(s.channels)+len(s.patterns))))
+}
+
+func (s *redisSession) subscriptions() []*redisSubscription {
+	subscriptions := make([]*redisSubscription, 0, len(s.channels)+len(s.patterns))
+	for _, subscription := range s.channels {
+		subscriptions = append(subscriptions, subscription)
+	}
+	for _, subscription := range s.patterns {
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// redisSubscription of a session to a channel or a pattern, listening to its Tunnels.
+type redisSubscription struct {
+	id      string
+	session *redisSession
+	// channel subscribed, empty for a pattern subscription.
+	channel string
+	pattern string
+}
+
+// listen to the Tunnel matching the pattern of the subscription.
+func (s *redisSubscription) listen(tunnelName string) {
+	if err := tunnel.Listen(tunnelName, s); err != nil {
+		s.session.logger.Warn("Cannot listen Tunnel matching pattern", "pattern", s.pattern, "tunnel_name", tunnelName, "error", err)
+		if errors.Is(err, tunnel.ErrTooManyListeners) {
+			metrics.QuotaExceeded.Add(quotaListeners, 1)
+			s.session.audit(audit.ListenDenied, tunnelName, "quota "+quotaListeners)
+		}
+	}
+}
+
+// stop listening to the Tunnels of the subscription, and to the ones created afterward for a pattern.
+func (s *redisSubscription) stop() {
+	if s.pattern != "" {
+		tunnel.UnwatchCreations(s.id)
+	}
+	tunnel.StopListen(s.id)
+}
+
+func (s *redisSubscription) ID() string {
+	return s.id
+}
+
+// Backlog of the subscription in the Tunnel, summed with the other ones of the session to evict slow consumers.
+func (s *redisSubscription) Backlog(tunnelName string, pending int) {
+	s.session.backlog.update(s.id, tunnelName, pending)
+}
+
+func (s *redisSubscription) NotifyMessage(tunnelName, msg string) bool {
+	return s.NotifyTracedMessage(tracing.SpanContext{}, tunnelName, msg)
+}
+
+// NotifyTracedMessage pushes the message, acknowledged once written.
+// Pattern subscriptions receive the channel of the Tunnel (see tunnelToChannel).
+func (s *redisSubscription) NotifyTracedMessage(_ tracing.SpanContext, tunnelName, msg string) bool {
+	var push []byte
+	if s.pattern != "" {
+		push = resp.AppendCommand(nil, "pmessage", s.pattern, tunnelToChannel(tunnelName), msg)
+	} else {
+		push = resp.AppendCommand(nil, "message", s.channel, msg)
+	}
+	return s.session.write(push) == nil
+}
@@ -1,45 +1,246 @@
 package server
 
 import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
 	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel-server/webhook"
 	"github.com/codingLayce/tunnel.go/common/maps"
 	"github.com/codingLayce/tunnel.go/tcp"
 )
 
+type ServerOption struct {
+	// Addr is the TCP address of the Tunnel protocol. Disabled if empty while UnixSocketPath or Listeners are set.
+	Addr string
+	// Listeners are additional listeners of the Tunnel protocol, each with its own TLS, allowed networks and limits.
+	// Their clients share the Tunnels of the server with the clients of Addr and of the gateways.
+	Listeners []ListenerOption
+	// UnixSocketPath is the path of a Unix domain socket serving the Tunnel protocol, besides or instead of Addr.
+	// Disabled if empty. A stale socket file left by a previous process is replaced.
+	UnixSocketPath string
+	// UnixSocketMode is the file permissions of the Unix domain socket. Defaults to DefaultUnixSocketMode.
+	UnixSocketMode fs.FileMode
+	// WebSocketAddr is the address of the WebSocket gateway, serving the browser clients with JSON frames.
+	// See WebSocketFrame. Disabled if empty.
+	WebSocketAddr string
+	// WebSocketAllowedOrigins are the origins (as https://example.com) of the web pages allowed to open a WebSocket
+	// connection, besides the pages of the gateway host. "*" allows any origin. Requests without Origin header,
+	// not sent by a browser, are always allowed.
+	WebSocketAllowedOrigins []string
+	// HTTPAddr is the address of the HTTP gateway, publishing with POST /tunnels/{name}/messages
+	// and subscribing with Server-Sent Events on GET /tunnels/{name}/events. Disabled if empty.
+	HTTPAddr string
+	// WebhookAllowedHosts are the hosts (as example.com, or example.com:8443 for a single port) webhooks can be
+	// subscribed to through the HTTP gateway. "*" allows any host. Webhooks cannot be subscribed over HTTP if empty,
+	// so that clients cannot make the server request its internal network.
+	WebhookAllowedHosts []string
+	// MQTTAddr is the address of the MQTT 3.1.1 gateway, mapping the topics onto Tunnels. Disabled if empty.
+	MQTTAddr string
+	// RedisAddr is the address of the Redis gateway, serving the pub/sub commands of RESP2
+	// and mapping the channels onto Tunnels. Disabled if empty.
+	RedisAddr string
+	// STOMPAddr is the address of the STOMP 1.2 gateway, mapping the destinations onto Tunnels. Disabled if empty.
+	STOMPAddr string
+
+	// PublishConfirm defines when a published message is acknowledged to its publisher.
+	// Defaults to tunnel.ConfirmNone: acknowledged as soon as it's queued by the Tunnel.
+	PublishConfirm tunnel.ConfirmMode
+
+	// TunnelBufferSize is the maximum number of in-flight messages of the Tunnels created by clients.
+	// Defaults to tunnel.DefaultBufferSize.
+	TunnelBufferSize int
+	// TunnelOverflow is the policy applied to a publication when the buffer of a Tunnel is full.
+	// Defaults to tunnel.OverflowReject: the publication is nacked.
+	// With tunnel.OverflowBlock, the server stops reading the publishing connection until there is room in the buffer.
+	TunnelOverflow tunnel.OverflowPolicy
+	// TunnelPriority enables the priority of the messages in the Tunnels created by clients (see tunnel.BroadcastOption).
+	TunnelPriority bool
+	// TunnelDedupWindow enables the deduplication of the messages published to the Tunnels created by clients:
+	// a message whose id has already been published during the window is dropped but still acknowledged.
+	// The id is the transaction id of the publish command (the Idempotency-Key header over HTTP), so a publisher
+	// retrying a message must resend it with the same one. Disabled if zero.
+	TunnelDedupWindow time.Duration
+
+	// RateLimits of the publications. Unlimited by default.
+	RateLimits RateLimitOption
+	// Quotas of the server resources. Unlimited by default.
+	Quotas QuotaOption
+
+	// Heartbeat configures the detection of dead connections.
+	Heartbeat HeartbeatOption
+	// SlowConsumer configures the eviction of the clients not keeping up with their messages. Disabled by default.
+	SlowConsumer SlowConsumerOption
+
+	// Audit receives the audit trail. Disabled if nil.
+	Audit AuditSink
+}
+
 type Server struct {
-	internal *tcp.Server
+	opts *ServerOption
+	// internal is the TCP listener of the Tunnel protocol, nil if disabled.
+	internal  *tcp.Server
+	unix      *protocolListener
+	listeners []*protocolListener
+	webSocket *webSocketGateway
+	http      *httpGateway
+	mqtt      *mqttGateway
+	redis     *redisGateway
+	stomp     *stompGateway
+	gateways  []enabledGateway
+
+	limiters atomic.Pointer[rateLimiters]
+	quotas   *quotas
+
+	// draining is set when the server is shutting down: new connections and publications are rejected.
+	draining atomic.Bool
+	// stopped is closed once stopped, when the TCP listener is disabled.
+	stopped chan struct{}
 
 	// TODO: Migrate to maps.SyncMap
 	clients *maps.SyncMap[string, *serverClient]
 }
 
 func NewServer(addr string) *Server {
+	return NewServerWithOption(&ServerOption{Addr: addr})
+}
+
+func NewServerWithOption(opts *ServerOption) *Server {
+	opts.Heartbeat.defaults()
 	srv := &Server{
+		opts:    opts,
+		quotas:  newQuotas(opts.Quotas),
 		clients: maps.NewSyncMap[string, *serverClient](),
+		stopped: make(chan struct{}),
+	}
+	srv.limiters.Store(newRateLimiters(&opts.RateLimits))
+	if opts.Addr != "" || (opts.UnixSocketPath == "" && len(opts.Listeners) == 0) {
+		srv.internal = tcp.NewServer(&tcp.ServerOption{
+			Addr:                 opts.Addr,
+			OnConnectionReceived: srv.connectionReceived,
+			OnConnectionClosed:   srv.connectionClosed,
+			OnPayload:            srv.payloadReceived,
+		})
+	}
+	if opts.UnixSocketPath != "" {
+		srv.unix = newProtocolListener(srv, ListenerOption{Network: NetworkUnix, Addr: opts.UnixSocketPath, Mode: opts.UnixSocketMode})
+		srv.gateways = append(srv.gateways, enabledGateway{srv.unix, opts.UnixSocketPath})
+	}
+	for _, listenerOpts := range opts.Listeners {
+		listener := newProtocolListener(srv, listenerOpts)
+		srv.listeners = append(srv.listeners, listener)
+		srv.gateways = append(srv.gateways, enabledGateway{listener, listenerOpts.Addr})
+	}
+	if opts.WebSocketAddr != "" {
+		srv.webSocket = newWebSocketGateway(srv)
+		srv.gateways = append(srv.gateways, enabledGateway{srv.webSocket, opts.WebSocketAddr})
+	}
+	if opts.HTTPAddr != "" {
+		srv.http = newHTTPGateway(srv)
+		srv.gateways = append(srv.gateways, enabledGateway{srv.http, opts.HTTPAddr})
+	}
+	if opts.MQTTAddr != "" {
+		srv.mqtt = newMQTTGateway(srv)
+		srv.gateways = append(srv.gateways, enabledGateway{srv.mqtt, opts.MQTTAddr})
+	}
+	if opts.RedisAddr != "" {
+		srv.redis = newRedisGateway(srv)
+		srv.gateways = append(srv.gateways, enabledGateway{srv.redis, opts.RedisAddr})
+	}
+	if opts.STOMPAddr != "" {
+		srv.stomp = newSTOMPGateway(srv)
+		srv.gateways = append(srv.gateways, enabledGateway{srv.stomp, opts.STOMPAddr})
 	}
-	srv.internal = tcp.NewServer(&tcp.ServerOption{
-		Addr:                 addr,
-		OnConnectionReceived: srv.connectionReceived,
-		OnConnectionClosed:   srv.connectionClosed,
-		OnPayload:            srv.payloadReceived,
-	})
 
 	return srv
 }
 
 func (s *Server) connectionReceived(conn *tcp.Connection) {
-	srvClient := newServerClient(conn)
-	s.clients.Put(conn.ID, srvClient)
-	srvClient.connected()
+	enableHeartbeat(conn.ID, conn.Conn, &s.opts.Heartbeat)
+	s.accept(conn.ID, tcpClientConn{conn})
 }
 
 func (s *Server) connectionClosed(conn *tcp.Connection, timeout bool) {
-	srvClient, exists := s.clients.Get(conn.ID)
+	s.release(conn.ID, timeout)
+}
+
+// accept the client connection unless the server is draining or a connection quota is exceeded.
+// Returns nil when the connection is rejected, in which case it's closed.
+func (s *Server) accept(id string, conn clientConn) *serverClient {
+	if s.draining.Load() {
+		slog.Info("Server draining. Rejecting connection", "remote_addr", conn.RemoteAddr().String())
+		s.audit(audit.Event{Type: audit.ConnectionRejected, Client: id, RemoteAddr: conn.RemoteAddr().String(), Reason: "draining"})
+		conn.Close()
+		return nil
+	}
+	if quota, allowed := s.quotas.acquireConnection(clientIdentity(id, conn.RemoteAddr())); !allowed {
+		slog.Warn("Too many connections. Rejecting connection", "remote_addr", conn.RemoteAddr().String(), "quota", quota)
+		metrics.QuotaExceeded.Add(quota, 1)
+		s.audit(audit.Event{Type: audit.ConnectionRejected, Client: id, RemoteAddr: conn.RemoteAddr().String(), Reason: "quota " + quota})
+		conn.Close()
+		return nil
+	}
+
+	srvClient := newServerClient(id, conn, s)
+	s.clients.Put(id, srvClient)
+	srvClient.connected()
+	srvClient.audit(audit.ConnectionAccepted, "", "")
+	return srvClient
+}
+
+// release the resources of a closed client connection.
+func (s *Server) release(id string, timeout bool) {
+	srvClient, exists := s.clients.Get(id)
 	if !exists {
 		return
 	}
+	s.clients.Delete(id)
 	srvClient.disconnected(timeout)
-	s.clients.Delete(conn.ID)
+	s.quotas.releaseConnection(srvClient.identity)
+}
+
+// errTunnelsQuota is returned when creating a Tunnel above the MaxTunnelsPerOwner quota.
+var errTunnelsQuota = errors.New("too many tunnels")
+
+// createBroadcast creates a broadcast Tunnel owned by the identity, within its quota.
+func (s *Server) createBroadcast(identity, tunnelName string) error {
+	if !s.quotas.acquireTunnel(identity) {
+		metrics.QuotaExceeded.Add(quotaTunnelsPerOwner, 1)
+		return errTunnelsQuota
+	}
+	err := tunnel.CreateBroadcastWithOption(tunnelName, &tunnel.BroadcastOption{
+		Priority:     s.opts.TunnelPriority,
+		BufferSize:   s.opts.TunnelBufferSize,
+		Overflow:     s.opts.TunnelOverflow,
+		DedupWindow:  s.opts.TunnelDedupWindow,
+		MaxListeners: s.quotas.options().MaxListenersPerTunnel,
+	})
+	if err != nil {
+		s.quotas.releaseTunnel(identity)
+		return err
+	}
+	return nil
+}
+
+// listenCreating listens to the Tunnel, first creating it as a broadcast Tunnel owned by the identity if it doesn't exist.
+// Returns whether the Tunnel has been created.
+func (s *Server) listenCreating(identity, tunnelName, group string, listener tunnel.Listener) (bool, error) {
+	err := tunnel.ListenGroup(tunnelName, group, listener)
+	if !errors.Is(err, tunnel.ErrUnknownTunnel) {
+		return false, err
+	}
+	err = s.createBroadcast(identity, tunnelName)
+	if errors.Is(err, errTunnelsQuota) {
+		return false, err
+	}
+	created := err == nil // Otherwise created concurrently
+	return created, tunnel.ListenGroup(tunnelName, group, listener)
 }
 
 func (s *Server) payloadReceived(conn *tcp.Connection, payload []byte) {
@@ -51,18 +252,169 @@ func (s *Server) payloadReceived(conn *tcp.Connection, payload []byte) {
 }
 
 func (s *Server) Start() error {
-	return s.internal.Start()
+	if s.internal != nil {
+		if err := s.internal.Start(); err != nil {
+			return err
+		}
+	}
+	for i, enabled := range s.gateways {
+		if err := enabled.gateway.start(enabled.addr); err != nil {
+			if s.internal != nil {
+				s.internal.Stop()
+			}
+			for _, started := range s.gateways[:i] {
+				started.gateway.stop()
+			}
+			return err
+		}
+	}
+	return nil
 }
 
+// SetRateLimits replaces the rate limits of the publications, without dropping any connection.
+// The tokens consumed under the previous limits are forgotten.
+func (s *Server) SetRateLimits(limits RateLimitOption) {
+	s.limiters.Store(newRateLimiters(&limits))
+}
+
+// SetQuotas replaces the resource quotas, without dropping any connection.
+// The resources already acquired are kept, even above the new quotas.
+// MaxListenersPerTunnel only applies to the Tunnels created afterward.
+func (s *Server) SetQuotas(quotas QuotaOption) {
+	s.quotas.setOptions(quotas)
+}
+
+// ReloadCertificates reads again the certificate, key and client CA files of the TLS listeners parsed by
+// ParseListenerOption, without dropping any connection: the next handshakes use the new certificates.
+// A listener whose files cannot be loaded keeps its current certificates.
+func (s *Server) ReloadCertificates() error {
+	var errs []error
+	for _, listener := range s.listeners {
+		if err := listener.reloadCertificates(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Snapshot of the server state.
+type Snapshot struct {
+	Clients  int                     `json:"clients"`
+	Draining bool                    `json:"draining"`
+	Tunnels  map[string]tunnel.Stats `json:"tunnels"`
+}
+
+func (s *Server) Snapshot() Snapshot {
+	return Snapshot{
+		Clients:  s.clients.Len(),
+		Draining: s.Draining(),
+		Tunnels:  tunnel.AllStats(),
+	}
+}
+
+// Stop the server immediately, abandoning the in-flight messages. See Shutdown to stop gracefully.
 func (s *Server) Stop() {
-	s.internal.Stop()
+	if s.internal != nil {
+		s.internal.Stop()
+	}
+	for _, enabled := range s.gateways {
+		enabled.gateway.stop()
+	}
+	webhook.UnsubscribeAll()
 	tunnel.StopTunnels()
+	select { // prevent closing a closed chan
+	case <-s.stopped:
+	default:
+		close(s.stopped)
+	}
 }
 
+// Addr is the TCP address of the Tunnel protocol. Empty if disabled.
 func (s *Server) Addr() string {
+	if s.internal == nil {
+		return ""
+	}
 	return s.internal.Addr()
 }
 
+// UnixSocketPath is the path of the Unix domain socket of the Tunnel protocol. Empty if disabled.
+func (s *Server) UnixSocketPath() string {
+	if s.unix == nil {
+		return ""
+	}
+	return listenerAddr(s.unix.listener)
+}
+
+// ListenerAddrs are the addresses of the Listeners, in the same order. Empty until started.
+func (s *Server) ListenerAddrs() []string {
+	addrs := make([]string, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		addrs = append(addrs, listenerAddr(listener.listener))
+	}
+	return addrs
+}
+
+// WebSocketAddr is the address of the WebSocket gateway. Empty if disabled.
+func (s *Server) WebSocketAddr() string {
+	if s.webSocket == nil {
+		return ""
+	}
+	return listenerAddr(s.webSocket.listener)
+}
+
+// HTTPAddr is the address of the HTTP gateway. Empty if disabled.
+func (s *Server) HTTPAddr() string {
+	if s.http == nil {
+		return ""
+	}
+	return listenerAddr(s.http.listener)
+}
+
+// MQTTAddr is the address of the MQTT gateway. Empty if disabled.
+func (s *Server) MQTTAddr() string {
+	if s.mqtt == nil {
+		return ""
+	}
+	return listenerAddr(s.mqtt.listener)
+}
+
+// RedisAddr is the address of the Redis gateway. Empty if disabled.
+func (s *Server) RedisAddr() string {
+	if s.redis == nil {
+		return ""
+	}
+	return listenerAddr(s.redis.listener)
+}
+
+// STOMPAddr is the address of the STOMP gateway. Empty if disabled.
+func (s *Server) STOMPAddr() string {
+	if s.stomp == nil {
+		return ""
+	}
+	return listenerAddr(s.stomp.listener)
+}
+
 func (s *Server) Done() <-chan struct{} {
+	if s.internal == nil {
+		return s.stopped
+	}
 	return s.internal.Done()
 }
+
+// clientIdentity of the connection, used for rate limiting and quotas: its remote IP.
+// The clients of a Unix domain socket having no address to tell them apart, each connection is its own identity.
+func clientIdentity(connID string, addr net.Addr) string {
+	if addr.Network() == NetworkUnix {
+		return NetworkUnix + ":" + connID
+	}
+	return remoteIP(addr.String())
+}
+
+// remoteIP of the connection, identifying the client.
+func remoteIP(addr string) string {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
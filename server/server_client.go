@@ -1,83 +1,86 @@
 package server
 
 import (
+	"errors"
 	"log/slog"
 	"time"
 
-	"github.com/codingLayce/tunnel.go/common/maps"
-	"github.com/codingLayce/tunnel.go/pdu"
 	"github.com/codingLayce/tunnel.go/pdu/command"
-	"github.com/codingLayce/tunnel.go/tcp"
 
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/tracing"
 	"github.com/codingLayce/tunnel-server/tunnel"
 )
 
-var MessageAckTimeout = 10 * time.Second
+var (
+	MessageAckTimeout = 10 * time.Second
+	// PublishConfirmTimeout is the maximum duration to wait for the listeners acknowledgements before nacking a publication.
+	PublishConfirmTimeout = 30 * time.Second
+	// WriteTimeout is the maximum duration to write a payload (ack, nack or message) to a client before closing its connection.
+	WriteTimeout = 10 * time.Second
+)
 
 type serverClient struct {
-	conn *tcp.Connection
+	*session[clientConn]
 
-	// ackWaiters stores channels waiting for an acknowledgement.
-	// Writes true when ack, false otherwise.
-	ackWaiters *maps.SyncMap[string, chan bool]
+	// ackWaiters are the messages waiting for an acknowledgement, by transaction id.
+	ackWaiters *ackWaiters[string]
+	liveness   *liveness
+}
 
-	close chan struct{}
+func newServerClient(id string, conn clientConn, srv *Server) *serverClient {
+	s := &serverClient{session: newSession(id, conn, srv)}
+	s.ackWaiters = newAckWaiters[string](id, "transaction_id", s.close)
+	s.liveness = newLiveness(&srv.opts.Heartbeat)
+	return s
+}
 
-	logger *slog.Logger
+// Backlog of the client in the Tunnel, watched to evict the client if it's a slow consumer.
+func (s *serverClient) Backlog(tunnelName string, pending int) {
+	s.backlog.update(s.id, tunnelName, pending)
 }
 
-func newServerClient(conn *tcp.Connection) *serverClient {
-	return &serverClient{
-		conn:       conn,
-		ackWaiters: maps.NewSyncMap[string, chan bool](),
-		close:      make(chan struct{}),
-		logger:     slog.Default().With("client", conn.ID),
-	}
+func (s *serverClient) NotifyMessage(tunnelName, msg string) bool {
+	return s.NotifyTracedMessage(tracing.SpanContext{}, tunnelName, msg)
 }
 
-func (s *serverClient) NotifyMessage(tunnelName, msg string) {
+// NotifyTracedMessage sends the message and waits for its acknowledgement, recorded as an "ack" span.
+// The protocol has no header to propagate the trace context to the client.
+func (s *serverClient) NotifyTracedMessage(trace tracing.SpanContext, tunnelName, msg string) bool {
 	cmd := command.NewReceiveMessage(tunnelName, msg)
 	logger := s.logger.With("transaction_id", cmd.TransactionID())
 
 	if err := cmd.Validate(); err != nil {
 		logger.Error("Cannot validate receive message command", "error", err)
-		return
+		return false
 	}
 
-	payload := pdu.Marshal(cmd)
-	logger.Debug("Sending payload", "payload", payload)
-
-	ackCh := make(chan bool)
-	s.ackWaiters.Put(cmd.TransactionID(), ackCh)
-	defer s.ackWaiters.Delete(cmd.TransactionID())
-
-	// TODO: Configure Write timeout
-	if _, err := s.conn.Write(payload); err != nil {
-		return
+	payload, err := s.conn.encode(cmd)
+	if err != nil {
+		logger.Error("Cannot encode receive message command", "error", err)
+		return false
 	}
 
-	logger.Info("Message sent")
-
-	select {
-	case isAck := <-ackCh:
-		if isAck {
-			logger.Info("Message acked by client")
-		} else {
-			logger.Info("Message nacked by client")
+	return s.ackWaiters.deliver(logger, trace, cmd.TransactionID(), func() error {
+		logger.Debug("Sending payload", "payload", payload)
+		if err := s.write(payload); err != nil {
+			return err
 		}
-	case <-time.After(MessageAckTimeout):
-		logger.Warn("Timeout waiting for client ack. Discard message")
-	}
+		s.liveness.expectResponse()
+		return nil
+	})
 }
 
 func (s *serverClient) ID() string {
-	return s.conn.ID
+	return s.id
 }
 
 func (s *serverClient) payloadReceived(payload []byte) {
 	s.logger.Debug("Received payload", "payload", string(payload))
+	s.liveness.receive()
 
-	cmd, err := pdu.Unmarshal(payload)
+	cmd, err := s.conn.decode(payload)
 	if err != nil {
 		s.logger.Warn("Unparsable payload. Ignoring it", "error", err)
 		return
@@ -104,30 +107,53 @@ func (s *serverClient) payloadReceived(payload []byte) {
 }
 
 func (s *serverClient) handleAcknowledgement(logger *slog.Logger, transactionID string, isAck bool) {
-	waiter, exists := s.ackWaiters.Get(transactionID)
-	if !exists {
+	if !s.ackWaiters.resolve(transactionID, isAck) {
 		logger.Warn("No waiter for the given acknowledgement. Ignoring it.")
-		return
-	}
-	select { // Try to push to waiter while connection isn't closed.
-	case waiter <- isAck:
-	case <-s.close:
 	}
 }
 
+// handlePublishMessage publishes the message. The protocol has no header to receive the trace context of the publisher:
+// a new trace is started.
 func (s *serverClient) handlePublishMessage(logger *slog.Logger, cmd *command.PublishMessage) {
-	if err := tunnel.PublishMessage(s.ID(), cmd.TunnelName, cmd.Message); err != nil {
-		logger.Warn("Cannot publish message", "error", err)
+	confirm, err := s.srv.publish(&publication{
+		clientID:   s.ID(),
+		remoteAddr: s.conn.RemoteAddr().String(),
+		identity:   s.identity,
+		tunnelName: cmd.TunnelName,
+		message:    cmd.Message,
+		// A publisher retrying a message reuses the transaction id of its first attempt.
+		id:     cmd.TransactionID(),
+		logger: logger,
+	})
+	if err != nil {
 		s.nack(logger, cmd.TransactionID()) // TODO: Add reason to nack
 		return
 	}
-	s.ack(logger, cmd.TransactionID())
-	logger.Info("Message published to Tunnel", "tunnel_name", cmd.TunnelName)
+
+	if s.srv.opts.PublishConfirm == tunnel.ConfirmNone {
+		s.ack(logger, cmd.TransactionID())
+		return
+	}
+	// Waits for the confirmation in its own goroutine to keep reading the client's payloads (including its acks).
+	go s.confirmPublication(logger, cmd.TransactionID(), confirm)
+}
+
+func (s *serverClient) confirmPublication(logger *slog.Logger, transactionID string, confirm *tunnel.Confirmation) {
+	switch err := s.srv.confirmed(logger, confirm, s.close); {
+	case err == nil:
+		s.ack(logger, transactionID)
+	case !errors.Is(err, errPublisherGone):
+		s.nack(logger, transactionID)
+	}
 }
 
 func (s *serverClient) handleListenTunnel(logger *slog.Logger, cmd *command.ListenTunnel) {
 	if err := tunnel.Listen(cmd.Name, s); err != nil {
 		logger.Warn("Cannot listen Tunnel", "error", err)
+		if errors.Is(err, tunnel.ErrTooManyListeners) {
+			metrics.QuotaExceeded.Add(quotaListeners, 1)
+			s.audit(audit.ListenDenied, cmd.Name, "quota "+quotaListeners)
+		}
 		s.nack(logger, cmd.TransactionID()) // TODO: Add reason to nack
 		return
 	}
@@ -136,21 +162,30 @@ func (s *serverClient) handleListenTunnel(logger *slog.Logger, cmd *command.List
 }
 
 func (s *serverClient) handleCreateTunnel(logger *slog.Logger, cmd *command.CreateTunnel) {
-	if err := tunnel.CreateBroadcast(cmd.Name); err != nil {
-		logger.Warn("Cannot create broadcast Tunnel", "error", err)
+	if err := s.srv.createBroadcast(s.identity, cmd.Name); err != nil {
+		if errors.Is(err, errTunnelsQuota) {
+			logger.Warn("Too many Tunnels. Rejecting creation", "quota", quotaTunnelsPerOwner)
+			s.audit(audit.TunnelCreationDenied, cmd.Name, "quota "+quotaTunnelsPerOwner)
+		} else {
+			logger.Warn("Cannot create broadcast Tunnel", "error", err)
+		}
 		s.nack(logger, cmd.TransactionID()) // TODO: Add reason to nack
 		return
 	}
 	s.ack(logger, cmd.TransactionID())
 	logger.Info("Broadcast Tunnel created")
+	s.audit(audit.TunnelCreated, cmd.Name, "")
 }
 
 func (s *serverClient) ack(logger *slog.Logger, transactionID string) {
-	payload := pdu.Marshal(command.NewAckWithTransactionID(transactionID))
+	payload, err := s.conn.encode(command.NewAckWithTransactionID(transactionID))
+	if err != nil {
+		logger.Error("Cannot encode ack", "error", err)
+		return
+	}
 	logger.Debug("Sending payload", "payload", payload)
 
-	// TODO: Configure Write timeout
-	if _, err := s.conn.Write(payload); err != nil {
+	if err = s.write(payload); err != nil {
 		logger.Error("Cannot send ack", "error", err)
 		return
 	}
@@ -158,27 +193,41 @@ func (s *serverClient) ack(logger *slog.Logger, transactionID string) {
 }
 
 func (s *serverClient) nack(logger *slog.Logger, transactionID string) {
-	payload := pdu.Marshal(command.NewNackWithTransactionID(transactionID))
+	payload, err := s.conn.encode(command.NewNackWithTransactionID(transactionID))
+	if err != nil {
+		logger.Error("Cannot encode nack", "error", err)
+		return
+	}
 	logger.Debug("Sending payload", "payload", payload)
 
-	// TODO: Configure Write timeout
-	if _, err := s.conn.Write(payload); err != nil {
+	if err = s.write(payload); err != nil {
 		logger.Error("Cannot send nack", "error", err)
 		return
 	}
 	logger.Info("Nack sent")
 }
 
+// ping the client within WriteTimeout, its connection being a pinger.
+func (s *serverClient) ping() error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	err := s.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err == nil {
+		err = s.conn.(pinger).ping()
+	}
+	return err
+}
+
 func (s *serverClient) connected() {
 	s.logger.Info("Connected")
+	var ping func() error
+	if _, ok := s.conn.(pinger); ok {
+		ping = s.ping
+	}
+	go s.liveness.watch(s.close, ping, s.evictFrozen)
 }
 
 func (s *serverClient) disconnected(timeout bool) {
-	close(s.close)
-	tunnel.StopListen(s.ID())
-	if timeout {
-		s.logger.Info("Timeout. Disconnected")
-	} else {
-		s.logger.Info("Disconnected")
-	}
+	s.session.disconnected(timeout, s.id)
 }
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// sessionConn is the connection of a session, whatever its protocol.
+type sessionConn interface {
+	RemoteAddr() net.Addr
+	SetWriteDeadline(t time.Time) error
+	Write(payload []byte) (int, error)
+	Close() error
+}
+
+// session is the state shared by the client connections of every protocol, embedded in the client of each one:
+// its writes, evictions and audit trail.
+type session[C sessionConn] struct {
+	// id of the session, as a Tunnel listener.
+	id   string
+	conn C
+	srv  *Server
+
+	// identity of the client, used for rate limiting and quotas (see clientIdentity).
+	identity string
+
+	backlog *backlogWatch
+
+	// writeMtx serializes the writes, each one having its own deadline.
+	writeMtx sync.Mutex
+
+	close chan struct{}
+
+	logger *slog.Logger
+}
+
+func newSession[C sessionConn](id string, conn C, srv *Server) *session[C] {
+	s := &session[C]{
+		id:       id,
+		conn:     conn,
+		srv:      srv,
+		identity: clientIdentity(id, conn.RemoteAddr()),
+		close:    make(chan struct{}),
+		logger:   slog.Default().With("client", id),
+	}
+	s.backlog = newBacklogWatch(&srv.opts.SlowConsumer, s.evictSlow)
+	return s
+}
+
+// write the payload within WriteTimeout.
+// A client not reading its payloads in time is considered dead: its connection is closed on failure.
+func (s *session[C]) write(payload []byte) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	err := s.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err == nil {
+		_, err = s.conn.Write(payload)
+	}
+	if err != nil && s.conn.Close() == nil { // Audits the first failure only
+		s.logger.Warn("Cannot write to client. Closing connection", "error", err)
+		s.audit(audit.ForcedDisconnect, "", "write failure: "+err.Error())
+	}
+	return err
+}
+
+// evictFrozen disconnects the client once it missed its heartbeats.
+func (s *session[C]) evictFrozen() {
+	s.logger.Warn("Frozen client. Evicting client", "missed_beats", s.srv.opts.Heartbeat.MissedBeats)
+	metrics.FrozenClientsEvicted.Add(1)
+	s.audit(audit.ForcedDisconnect, "", "missed heartbeats")
+	s.conn.Close()
+}
+
+// evictSlow disconnects the client once it's slow for longer than the grace period.
+func (s *session[C]) evictSlow(pending int) {
+	s.logger.Warn("Slow consumer. Evicting client", "pending", pending, "max_pending", s.srv.opts.SlowConsumer.MaxPending)
+	metrics.SlowConsumersEvicted.Add(1)
+	s.audit(audit.ForcedDisconnect, "", "slow consumer")
+	s.conn.Close()
+}
+
+// disconnected releases the session once its connection is closed, stopping its listeners first so that their
+// unacknowledged messages are redelivered. The closing is audited.
+func (s *session[C]) disconnected(timeout bool, listenerIDs ...string) {
+	for _, listenerID := range listenerIDs {
+		tunnel.StopListen(listenerID)
+	}
+	s.backlog.stop()
+	close(s.close)
+
+	reason := ""
+	if timeout {
+		reason = "timeout"
+		s.logger.Info("Timeout. Disconnected")
+	} else {
+		s.logger.Info("Disconnected")
+	}
+	s.audit(audit.ConnectionClosed, "", reason)
+}
+
+// audit an event performed or undergone by the client.
+func (s *session[C]) audit(eventType audit.EventType, tunnelName, reason string) {
+	s.srv.audit(audit.Event{
+		Type:       eventType,
+		Client:     s.id,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Tunnel:     tunnelName,
+		Reason:     reason,
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// drainPollInterval is the interval between two checks of the in-flight messages while draining.
+const drainPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully stops the server.
+//
+// It first drains the server: new connections are closed and new publications are nacked,
+// while the in-flight messages keep being delivered to (and acknowledged by) their listeners.
+// Once every in-flight message is delivered or ctx is done, the server is stopped.
+// Returns ctx.Err() when the drain didn't complete in time, abandoning the remaining in-flight messages.
+//
+// The protocol has no command to announce the server is going away:
+// clients are notified through the nack of their publications and the closing of their connection.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	slog.Info("Draining server", "in_flight", inFlightMessages())
+
+	err := waitDrained(ctx)
+	if err != nil {
+		slog.Warn("Drain incomplete. Abandoning in-flight messages", "in_flight", inFlightMessages(), "error", err)
+	} else {
+		slog.Info("Server drained")
+	}
+
+	s.Stop()
+	return err
+}
+
+// Draining reports whether the server is shutting down.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+func waitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for inFlightMessages() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// inFlightMessages counts the messages published but not yet delivered to all of their listeners, in all Tunnels.
+func inFlightMessages() int {
+	count := 0
+	for _, stats := range tunnel.AllStats() {
+		count += stats.BufferDepth
+	}
+	return count
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// SlowConsumerOption configures the eviction of slow consumers:
+// clients whose messages waiting to be notified stay above MaxPending for longer than Grace.
+type SlowConsumerOption struct {
+	// MaxPending is the number of messages waiting to be notified to a client above which it's slow.
+	// Disabled if zero.
+	MaxPending int
+	// Grace is the duration a client can stay slow before being disconnected. Evicted as soon as detected if zero.
+	Grace time.Duration
+}
+
+// backlogKey identifies the backlog of a listener of the client in a Tunnel.
+type backlogKey struct {
+	listenerID string
+	tunnelName string
+}
+
+// backlogWatch sums the backlogs reported by the Tunnels to the listeners of a client (see tunnel.BacklogListener),
+// and evicts the client once the total stays above MaxPending for longer than the grace period.
+// A nil backlogWatch, when the eviction is disabled, ignores the backlogs.
+type backlogWatch struct {
+	opts  *SlowConsumerOption
+	evict func(pending int)
+
+	backlogs map[backlogKey]int
+	total    int
+	// timer evicts the client at the end of the grace period. Nil while the client keeps up.
+	timer *time.Timer
+	// generation of the timer, so that a timer stopped too late doesn't evict the client.
+	generation int
+	stopped    bool
+	mtx        sync.Mutex
+}
+
+// newBacklogWatch returns nil if the eviction of slow consumers is disabled.
+func newBacklogWatch(opts *SlowConsumerOption, evict func(pending int)) *backlogWatch {
+	if opts.MaxPending <= 0 {
+		return nil
+	}
+	return &backlogWatch{
+		opts:     opts,
+		evict:    evict,
+		backlogs: make(map[backlogKey]int),
+	}
+}
+
+// update the backlog of the listener in the Tunnel. Doesn't block, as called by the Tunnels with their locks held.
+func (w *backlogWatch) update(listenerID, tunnelName string, pending int) {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	key := backlogKey{listenerID: listenerID, tunnelName: tunnelName}
+	w.total += pending - w.backlogs[key]
+	if pending == 0 {
+		delete(w.backlogs, key)
+	} else {
+		w.backlogs[key] = pending
+	}
+
+	switch {
+	case w.stopped:
+	case w.total > w.opts.MaxPending && w.timer == nil:
+		w.generation++
+		generation := w.generation
+		w.timer = time.AfterFunc(w.opts.Grace, func() { w.expire(generation) })
+	case w.total <= w.opts.MaxPending && w.timer != nil:
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// expire the grace period of the timer of the given generation, evicting the client unless it caught up in the meantime.
+func (w *backlogWatch) expire(generation int) {
+	w.mtx.Lock()
+	if w.stopped || w.timer == nil || w.generation != generation {
+		w.mtx.Unlock()
+		return
+	}
+	w.stopped = true
+	pending := w.total
+	w.mtx.Unlock()
+
+	w.evict(pending)
+}
+
+// stop watching, the client being disconnected.
+func (w *backlogWatch) stop() {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
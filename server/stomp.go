@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/id"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/stomp"
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// STOMPConnectTimeout is the maximum duration to receive the CONNECT frame of a new STOMP connection.
+var STOMPConnectTimeout = 10 * time.Second
+
+// stompVersion is the only supported version of STOMP.
+const stompVersion = "1.2"
+
+// STOMP acknowledgement modes of a subscription.
+const (
+	stompAckAuto             = "auto"
+	stompAckClient           = "client"
+	stompAckClientIndividual = "client-individual"
+)
+
+// destinationToTunnel maps a STOMP destination to a Tunnel name, its segments being separated by dots instead of
+// slashes, without leading slash: /topic/orders is the topic.orders Tunnel.
+// Destinations with characters not allowed in Tunnel names cannot be mapped.
+func destinationToTunnel(destination string) (string, bool) {
+	tunnelName := strings.ReplaceAll(strings.TrimPrefix(destination, "/"), "/", ".")
+	return tunnelName, tunnelNameRegexp.MatchString(tunnelName)
+}
+
+// stompGateway accepts the STOMP 1.2 clients.
+//
+// Destinations are mapped onto Tunnels (see destinationToTunnel), created when first subscribed.
+// SEND publishes, SUBSCRIBE listens and the messages of the subscriptions in client acknowledgement modes are
+// acknowledged with ACK and NACK. Any frame can request a RECEIPT. Transactions aren't supported.
+type stompGateway struct {
+	*connGateway
+	srv *Server
+}
+
+func newSTOMPGateway(srv *Server) *stompGateway {
+	g := &stompGateway{srv: srv}
+	g.connGateway = newConnGateway("STOMP", g.serve)
+	return g
+}
+
+// serve the connection until closed.
+func (g *stompGateway) serve(conn net.Conn) {
+	defer conn.Close()
+	session := &stompSession{
+		session:       newSession(id.New(), conn, g.srv),
+		reader:        bufio.NewReader(conn),
+		subscriptions: make(map[string]*stompSubscription),
+	}
+	session.ackWaiters = newAckWaiters[string](session.id, "ack", session.close)
+	session.liveness = newLiveness(&g.srv.opts.Heartbeat)
+	session.logger = session.logger.With("remote_addr", conn.RemoteAddr().String())
+
+	if !session.handshake() {
+		return
+	}
+	defer g.srv.quotas.releaseConnection(session.identity)
+	enableHeartbeat(session.id, conn, &g.srv.opts.Heartbeat)
+	session.logger.Info("Connected")
+	session.audit(audit.ConnectionAccepted, "", "")
+	go session.liveness.watch(session.close, nil, session.evictFrozen)
+
+	err := session.readLoop()
+	var listenerIDs []string
+	for _, subscription := range session.subscriptions {
+		listenerIDs = append(listenerIDs, subscription.id)
+	}
+	session.disconnected(errors.Is(err, os.ErrDeadlineExceeded), listenerIDs...)
+}
+
+// errSTOMPClosing is returned by the frame handlers once the connection must be closed.
+var errSTOMPClosing = errors.New("closing stomp connection")
+
+// stompSession is a STOMP connection. Its subscriptions are only accessed by its read loop.
+type stompSession struct {
+	*session[net.Conn]
+	reader *bufio.Reader
+
+	// subscriptions by id, as chosen by the client.
+	subscriptions map[string]*stompSubscription
+
+	// ackWaiters are the messages of the subscriptions in client acknowledgement modes waiting for their ACK or NACK,
+	// by ack header.
+	ackWaiters *ackWaiters[string]
+	liveness   *liveness
+}
+
+// handshake reads the CONNECT (or STOMP) frame and answers it. Returns false if the connection is refused.
+func (s *stompSession) handshake() bool {
+	s.conn.SetReadDeadline(time.Now().Add(STOMPConnectTimeout))
+	frame, err := stomp.Read(s.reader)
+	if err != nil {
+		s.logger.Warn("Cannot read STOMP CONNECT", "error", err)
+		return false
+	}
+	s.conn.SetReadDeadline(time.Time{})
+
+	refuse := func(message, reason string) bool {
+		s.logger.Warn("Refusing STOMP connection", "reason", reason)
+		s.audit(audit.ConnectionRejected, "", reason)
+		s.writeError(nil, message)
+		return false
+	}
+	switch {
+	case frame.Command != stomp.CommandConnect && frame.Command != stomp.CommandStomp:
+		return refuse("CONNECT frame expected", "unexpected frame "+frame.Command)
+	case !slices.Contains(strings.Split(frame.Header("accept-version"), ","), stompVersion):
+		return refuse("Supported protocol versions are "+stompVersion, "unsupported protocol")
+	case s.srv.Draining():
+		return refuse("Server draining", "draining")
+	}
+	if quota, allowed := s.srv.quotas.acquireConnection(s.identity); !allowed {
+		metrics.QuotaExceeded.Add(quota, 1)
+		return refuse("Too many connections", "quota "+quota)
+	}
+
+	// Heart-beats aren't supported: dead connections are detected by the TCP keep-alive probes,
+	// and frozen clients by their missing acknowledgements.
+	connected := stomp.NewFrame(stomp.CommandConnected,
+		"version", stompVersion,
+		"session", s.id,
+		"server", "tunnel-server",
+		"heart-beat", "0,0")
+	if err = s.write(connected); err != nil {
+		s.srv.quotas.releaseConnection(s.identity)
+		return false
+	}
+	return true
+}
+
+// readLoop handles the frames until the connection is closed, the client disconnects or an ERROR is sent.
+func (s *stompSession) readLoop() error {
+	for {
+		frame, err := stomp.Read(s.reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Cannot read STOMP frame", "error", err)
+				s.writeError(nil, "Malformed frame: "+err.Error())
+			}
+			return err
+		}
+		s.liveness.receive()
+
+		switch frame.Command {
+		case stomp.CommandSend:
+			err = s.handleSend(frame)
+		case stomp.CommandSubscribe:
+			err = s.handleSubscribe(frame)
+		case stomp.CommandUnsubscribe:
+			err = s.handleUnsubscribe(frame)
+		case stomp.CommandAck:
+			err = s.handleAcknowledgement(frame, true)
+		case stomp.CommandNack:
+			err = s.handleAcknowledgement(frame, false)
+		case stomp.CommandDisconnect:
+			s.writeReceipt(frame)
+			return nil
+		case stomp.CommandBegin, stomp.CommandCommit, stomp.CommandAbort:
+			err = s.writeError(frame, "Transactions not supported")
+		default:
+			err = s.writeError(frame, "Unsupported frame "+frame.Command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleSend publishes the body to the Tunnel of the destination.
+// The RECEIPT, if requested, is sent once published, or once confirmed when publisher confirms are enabled.
+// A rejected publication is an ERROR.
+func (s *stompSession) handleSend(frame *stomp.Frame) error {
+	if frame.Header("transaction") != "" {
+		return s.writeError(frame, "Transactions not supported")
+	}
+	destination := frame.Header("destination")
+	logger := s.logger.With("destination", destination, "receipt", frame.Header("receipt"))
+	tunnelName, ok := destinationToTunnel(destination)
+	if !ok {
+		logger.Warn("Invalid destination. Rejecting publication")
+		return s.writeError(frame, "Invalid destination")
+	}
+
+	confirm, err := s.srv.publish(&publication{
+		clientID:   s.id,
+		remoteAddr: s.conn.RemoteAddr().String(),
+		identity:   s.identity,
+		tunnelName: tunnelName,
+		message:    string(frame.Body),
+		logger:     logger,
+	})
+	switch {
+	case errors.Is(err, errDraining), errors.Is(err, errRateLimited), errors.Is(err, errMessageTooLarge),
+		errors.Is(err, errUnsupportedMessage):
+		return s.writeError(frame, errorMessage(err))
+	case err != nil:
+		return s.writeError(frame, "Cannot publish: "+err.Error())
+	}
+
+	if s.srv.opts.PublishConfirm == tunnel.ConfirmNone || frame.Header("receipt") == "" {
+		return s.writeReceipt(frame)
+	}
+	// Waits for the confirmation in its own goroutine to keep reading the client's frames (including its ACKs).
+	go s.confirmPublication(logger, frame, confirm)
+	return nil
+}
+
+func (s *stompSession) confirmPublication(logger *slog.Logger, frame *stomp.Frame, confirm *tunnel.Confirmation) {
+	switch err := s.srv.confirmed(logger, confirm, s.close); {
+	case err == nil:
+		s.writeReceipt(frame)
+	case !errors.Is(err, errPublisherGone):
+		s.writeError(frame, errorMessage(err))
+	}
+}
+
+// handleSubscribe listens to the Tunnel of the destination, creating it if needed.
+func (s *stompSession) handleSubscribe(frame *stomp.Frame) error {
+	subscriptionID, destination := frame.Header("id"), frame.Header("destination")
+	logger := s.logger.With("subscription", subscriptionID, "destination", destination)
+	ackMode := frame.Header("ack")
+	if ackMode == "" {
+		ackMode = stompAckAuto
+	}
+
+	tunnelName, ok := destinationToTunnel(destination)
+	switch {
+	case subscriptionID == "":
+		return s.writeError(frame, "Missing subscription id")
+	case s.subscriptions[subscriptionID] != nil:
+		return s.writeError(frame, "Subscription id already used")
+	case !ok:
+		logger.Warn("Invalid destination. Rejecting subscription")
+		return s.writeError(frame, "Invalid destination")
+	case ackMode != stompAckAuto && ackMode != stompAckClient && ackMode != stompAckClientIndividual:
+		return s.writeError(frame, "Unsupported ack mode "+ackMode)
+	}
+
+	subscription := &stompSubscription{
+		id:             id.New(),
+		session:        s,
+		subscriptionID: subscriptionID,
+		destination:    destination,
+		ackMode:        ackMode,
+	}
+	created, err := s.srv.listenCreating(s.identity, tunnelName, "", subscription)
+	if created {
+		logger.Info("Broadcast Tunnel created", "tunnel_name", tunnelName)
+		s.audit(audit.TunnelCreated, tunnelName, "")
+	}
+	if err != nil {
+		logger.Warn("Cannot listen Tunnel. Rejecting subscription", "tunnel_name", tunnelName, "error", err)
+		switch {
+		case errors.Is(err, errTunnelsQuota):
+			s.audit(audit.TunnelCreationDenied, tunnelName, "quota "+quotaTunnelsPerOwner)
+		case errors.Is(err, tunnel.ErrTooManyListeners):
+			metrics.QuotaExceeded.Add(quotaListeners, 1)
+			s.audit(audit.ListenDenied, tunnelName, "quota "+quotaListeners)
+		}
+		return s.writeError(frame, "Cannot subscribe: "+err.Error())
+	}
+	s.subscriptions[subscriptionID] = subscription
+	logger.Info("Listen Tunnel", "tunnel_name", tunnelName, "ack", ackMode)
+	return s.writeReceipt(frame)
+}
+
+func (s *stompSession) handleUnsubscribe(frame *stomp.Frame) error {
+	subscriptionID := frame.Header("id")
+	subscription, exists := s.subscriptions[subscriptionID]
+	if !exists {
+		return s.writeError(frame, "Unknown subscription id")
+	}
+	tunnel.StopListen(subscription.id)
+	delete(s.subscriptions, subscriptionID)
+	s.logger.Info("Stop listening Tunnel", "subscription", subscriptionID, "destination", subscription.destination)
+	return s.writeReceipt(frame)
+}
+
+// handleAcknowledgement of a message. The messages of a subscription being delivered one at a time, the cumulative
+// ACK of the client mode only acknowledges its message.
+func (s *stompSession) handleAcknowledgement(frame *stomp.Frame, isAck bool) error {
+	ackID := frame.Header("id")
+	if frame.Header("transaction") != "" {
+		return s.writeError(frame, "Transactions not supported")
+	}
+	if !s.ackWaiters.resolve(ackID, isAck) {
+		s.logger.Warn("No waiter for the given acknowledgement. Ignoring it", "ack", ackID)
+	}
+	return s.writeReceipt(frame)
+}
+
+// writeReceipt of the frame, if requested.
+func (s *stompSession) writeReceipt(frame *stomp.Frame) error {
+	receipt := frame.Header("receipt")
+	if receipt == "" {
+		return nil
+	}
+	return s.write(stomp.NewFrame(stomp.CommandReceipt, "receipt-id", receipt))
+}
+
+// errorMessage of the ERROR frame of a rejected publication: the error, capitalized.
+func errorMessage(err error) string {
+	message := err.Error()
+	return strings.ToUpper(message[:1]) + message[1:]
+}
+
+// writeError sends an ERROR frame about the frame, if any, then closes the connection as required by STOMP.
+// Always returns errSTOMPClosing.
+func (s *stompSession) writeError(frame *stomp.Frame, message string) error {
+	errFrame := stomp.NewFrame(stomp.CommandError, "message", message)
+	if frame != nil {
+		if receipt := frame.Header("receipt"); receipt != "" {
+			errFrame.Headers["receipt-id"] = receipt
+		}
+	}
+	s.write(errFrame)
+	s.conn.Close()
+	return errSTOMPClosing
+}
+
+// write the frame within WriteTimeout. The connection is closed on failure.
+func (s *stompSession) write(frame *stomp.Frame) error {
+	return s.session.write(stomp.Marshal(frame))
+}
+
+// stompSubscription of a session to a destination, listening to its Tunnel.
+type stompSubscription struct {
+	// id of the subscription as a Tunnel listener, subscriptionID being the one chosen by the client.
+	id             string
+	session        *stompSession
+	subscriptionID string
+	destination    string
+	ackMode        string
+}
+
+func (s *stompSubscription) ID() string {
+	return s.id
+}
+
+// Backlog of the subscription in the Tunnel, summed with the other ones of the session to evict slow consumers.
+func (s *stompSubscription) Backlog(tunnelName string, pending int) {
+	s.session.backlog.update(s.id, tunnelName, pending)
+}
+
+func (s *stompSubscription) NotifyMessage(tunnelName, msg string) bool {
+	return s.NotifyTracedMessage(tracing.SpanContext{}, tunnelName, msg)
+}
+
+// NotifyTracedMessage sends the message as a MESSAGE frame. It's acknowledged once written in auto acknowledgement
+// mode, otherwise by the ACK or NACK of the client.
+func (s *stompSubscription) NotifyTracedMessage(trace tracing.SpanContext, _, msg string) bool {
+	messageID := id.New()
+	frame := stomp.NewFrame(stomp.CommandMessage,
+		"subscription", s.subscriptionID,
+		"message-id", messageID,
+		"destination", s.destination,
+		"content-type", "text/plain;charset=utf-8",
+		"content-length", strconv.Itoa(len(msg)))
+	frame.Body = []byte(msg)
+
+	if s.ackMode == stompAckAuto {
+		if err := s.session.write(frame); err != nil {
+			<-s.session.close
+			return false
+		}
+		return true
+	}
+
+	frame.Headers["ack"] = messageID
+	logger := s.session.logger.With("subscription", s.subscriptionID, "ack", messageID)
+	return s.session.ackWaiters.deliver(logger, trace, messageID, func() error {
+		if err := s.session.write(frame); err != nil {
+			return err
+		}
+		s.session.liveness.expectResponse()
+		return nil
+	})
+}
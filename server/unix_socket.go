@@ -0,0 +1,24 @@
+//go:build unix
+
+package server
+
+import (
+	"io/fs"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskMtx serializes the changes of the process umask.
+var umaskMtx sync.Mutex
+
+// listenUnix creates the Unix domain socket with the file permissions.
+// The socket is created under the umask of the permissions, never being reachable with broader ones.
+// The umask being the one of the process, the files created meanwhile by other goroutines are restricted the same way.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	umaskMtx.Lock()
+	defer umaskMtx.Unlock()
+	umask := syscall.Umask(int(^mode.Perm() & fs.ModePerm))
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
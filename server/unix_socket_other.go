@@ -0,0 +1,22 @@
+//go:build !unix
+
+package server
+
+import (
+	"io/fs"
+	"net"
+	"os"
+)
+
+// listenUnix creates the Unix domain socket, then sets its file permissions, the platform having no umask.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/id"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/websocket"
+)
+
+// WebSocketFrame is the JSON frame exchanged with the WebSocket clients, one per WebSocket message.
+//
+// Clients send "create", "listen" and "publish" frames, each acknowledged by an "ack" or "nack" frame of the same
+// transaction id. They receive the messages of the Tunnels they listen as "message" frames, to acknowledge with an
+// "ack" or "nack" frame of the same transaction id.
+// Transaction ids are 8 lowercase alphanumeric characters, as in the Tunnel protocol.
+type WebSocketFrame struct {
+	Type          string `json:"type"`
+	TransactionID string `json:"transaction_id"`
+	Tunnel        string `json:"tunnel,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+const (
+	FrameCreate  = "create"
+	FrameListen  = "listen"
+	FramePublish = "publish"
+	FrameMessage = "message"
+	FrameAck     = "ack"
+	FrameNack    = "nack"
+)
+
+var (
+	// WebSocketHandshakeTimeout is the maximum duration to read the handshake request of a new WebSocket connection.
+	WebSocketHandshakeTimeout = 10 * time.Second
+	// WebSocketReadTimeout is the allowed idle duration before disconnecting a WebSocket client.
+	// The pongs answering the heartbeats keep the idle browsers connected.
+	WebSocketReadTimeout = time.Minute
+)
+
+// webSocketClientConn is the connection of a client speaking JSON frames over WebSocket.
+type webSocketClientConn struct {
+	*websocket.Conn
+}
+
+// ping the client with a WebSocket ping, answered by the browsers on their own.
+func (c webSocketClientConn) ping() error {
+	return c.Ping()
+}
+
+func (c webSocketClientConn) encode(cmd command.Command) ([]byte, error) {
+	frame := WebSocketFrame{TransactionID: cmd.TransactionID()}
+	switch castedCMD := cmd.(type) {
+	case *command.Ack:
+		frame.Type = FrameAck
+	case *command.Nack:
+		frame.Type = FrameNack
+	case *command.ReceiveMessage:
+		frame.Type = FrameMessage
+		frame.Tunnel = castedCMD.TunnelName
+		frame.Message = castedCMD.Message
+	default:
+		return nil, fmt.Errorf("unsupported command %q", cmd.Info())
+	}
+	return json.Marshal(frame)
+}
+
+func (c webSocketClientConn) decode(payload []byte) (command.Command, error) {
+	var frame WebSocketFrame
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		return nil, fmt.Errorf("unmarshal frame: %w", err)
+	}
+
+	if !id.IsValid(frame.TransactionID) {
+		return nil, fmt.Errorf("invalid transaction id %q", frame.TransactionID)
+	}
+
+	var cmd command.Command
+	switch frame.Type {
+	case FrameCreate:
+		cmd = command.NewCreateTunnelWithTransactionID(frame.TransactionID, frame.Tunnel)
+	case FrameListen:
+		cmd = command.NewListenTunnelWithTransactionID(frame.TransactionID, frame.Tunnel)
+	case FramePublish:
+		cmd = command.NewPublishMessageWithTransactionID(frame.TransactionID, frame.Tunnel, frame.Message)
+	case FrameAck:
+		cmd = command.NewAckWithTransactionID(frame.TransactionID)
+	case FrameNack:
+		cmd = command.NewNackWithTransactionID(frame.TransactionID)
+	default:
+		return nil, fmt.Errorf("unknown frame type %q", frame.Type)
+	}
+	if err := cmd.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s frame: %w", frame.Type, err)
+	}
+	return cmd, nil
+}
+
+// webSocketGateway accepts the WebSocket clients and serves them as regular clients.
+type webSocketGateway struct {
+	srv      *Server
+	http     *http.Server
+	listener net.Listener
+	// conns are the upgraded connections, no longer tracked by the HTTP server.
+	conns *connTracker
+}
+
+func newWebSocketGateway(srv *Server) *webSocketGateway {
+	g := &webSocketGateway{
+		srv:   srv,
+		conns: newConnTracker(),
+	}
+	g.http = &http.Server{
+		Handler:           http.HandlerFunc(g.serve),
+		ReadHeaderTimeout: WebSocketHandshakeTimeout,
+		ReadTimeout:       WebSocketHandshakeTimeout,
+	}
+	return g
+}
+
+func (g *webSocketGateway) start(addr string) error {
+	var err error
+	g.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen websocket: %w", err)
+	}
+	go func() {
+		if err := g.http.Serve(g.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("WebSocket gateway stopped", "error", err)
+		}
+	}()
+	slog.Info("WebSocket gateway started", "addr", g.listener.Addr().String())
+	return nil
+}
+
+// stop closes the HTTP server, then the upgraded connections it no longer tracks, waiting for their release.
+func (g *webSocketGateway) stop() {
+	g.http.Close()
+	g.conns.stop()
+}
+
+// serve upgrades the request, whatever its path, and reads the client frames until the connection is closed.
+// Requests from the web pages of a not allowed origin are forbidden (see ServerOption.WebSocketAllowedOrigins).
+func (g *webSocketGateway) serve(w http.ResponseWriter, r *http.Request) {
+	if !g.allowOrigin(r) {
+		slog.Warn("Origin not allowed. Rejecting WebSocket connection", "remote_addr", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+		g.srv.audit(audit.Event{Type: audit.ConnectionRejected, RemoteAddr: r.RemoteAddr, Reason: "origin not allowed"})
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		slog.Debug("Cannot upgrade to WebSocket", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+	if !g.conns.track(conn) {
+		conn.Close()
+		return
+	}
+	defer g.conns.untrack(conn)
+
+	clientID := id.New()
+	enableHeartbeat(clientID, conn.NetConn(), &g.srv.opts.Heartbeat)
+	srvClient := g.srv.accept(clientID, webSocketClientConn{conn})
+	if srvClient == nil {
+		return
+	}
+	conn.SetPongHandler(srvClient.liveness.receive)
+	conn.SetIdleTimeout(WebSocketReadTimeout)
+
+	for {
+		payload, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				srvClient.logger.Warn("Cannot read WebSocket message", "error", err)
+			}
+			conn.Close()
+			g.srv.release(clientID, errors.Is(err, os.ErrDeadlineExceeded))
+			return
+		}
+		srvClient.payloadReceived(payload)
+	}
+}
+
+// allowOrigin of the request: no Origin header, the gateway host or an allowed origin.
+// Browsers always send the Origin header of the page, which cannot be forged by its scripts.
+func (g *webSocketGateway) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.ContainsFunc(g.srv.opts.WebSocketAllowedOrigins, func(allowed string) bool {
+		return allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin)
+	})
+}
@@ -0,0 +1,188 @@
+// Package stomp encodes and decodes the STOMP 1.2 frames.
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MaxFrameBytes is the maximum size of the headers and of the body of a received frame. A bigger frame is an error.
+var MaxFrameBytes = 1 << 20
+
+const (
+	// Client frames.
+	CommandConnect     = "CONNECT"
+	CommandStomp       = "STOMP"
+	CommandSend        = "SEND"
+	CommandSubscribe   = "SUBSCRIBE"
+	CommandUnsubscribe = "UNSUBSCRIBE"
+	CommandAck         = "ACK"
+	CommandNack        = "NACK"
+	CommandBegin       = "BEGIN"
+	CommandCommit      = "COMMIT"
+	CommandAbort       = "ABORT"
+	CommandDisconnect  = "DISCONNECT"
+
+	// Server frames.
+	CommandConnected = "CONNECTED"
+	CommandMessage   = "MESSAGE"
+	CommandReceipt   = "RECEIPT"
+	CommandError     = "ERROR"
+)
+
+var (
+	ErrFrameTooLarge = errors.New("stomp frame too large")
+	ErrMalformed     = errors.New("malformed stomp frame")
+)
+
+// Frame of STOMP.
+type Frame struct {
+	Command string
+	// Headers of the frame. Only the first occurrence of a repeated header is kept.
+	Headers map[string]string
+	Body    []byte
+}
+
+// NewFrame with the given headers, as name and value pairs.
+func NewFrame(command string, headers ...string) *Frame {
+	f := &Frame{Command: command, Headers: make(map[string]string, len(headers)/2)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.Headers[headers[i]] = headers[i+1]
+	}
+	return f
+}
+
+// Header value, empty if absent.
+func (f *Frame) Header(name string) string {
+	return f.Headers[name]
+}
+
+// escapesHeaders reports whether the headers of the frame are escaped: all but CONNECT and CONNECTED ones.
+func (f *Frame) escapesHeaders() bool {
+	return f.Command != CommandConnect && f.Command != CommandConnected
+}
+
+var (
+	headerEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	headerUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+)
+
+// Marshal the frame, its headers being sorted by name.
+func Marshal(f *Frame) []byte {
+	var b bytes.Buffer
+	b.WriteString(f.Command)
+	b.WriteByte('\n')
+	for _, name := range slices.Sorted(maps.Keys(f.Headers)) {
+		value := f.Headers[name]
+		if f.escapesHeaders() {
+			name, value = headerEscaper.Replace(name), headerEscaper.Replace(value)
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.Write(f.Body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+// Read the next frame, skipping the heart-beats (end of lines) preceding it.
+func Read(r *bufio.Reader) (*Frame, error) {
+	var command string
+	for command == "" {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		command = line
+	}
+
+	f := &Frame{Command: command, Headers: make(map[string]string)}
+	headersBytes := 0
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		if headersBytes += len(line); headersBytes > MaxFrameBytes {
+			return nil, ErrFrameTooLarge
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: header %q without colon", ErrMalformed, line)
+		}
+		if f.escapesHeaders() {
+			name, value = headerUnescaper.Replace(name), headerUnescaper.Replace(value)
+		}
+		if _, exists := f.Headers[name]; !exists {
+			f.Headers[name] = value
+		}
+	}
+
+	body, err := readBody(r, f.Header("content-length"))
+	if err != nil {
+		return nil, err
+	}
+	f.Body = body
+	return f, nil
+}
+
+// readLine reads a line without its end of line (LF or CRLF).
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: line too long", ErrFrameTooLarge)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+}
+
+// readBody up to the NUL terminating the frame, or of the given length if any.
+func readBody(r *bufio.Reader, contentLength string) ([]byte, error) {
+	if contentLength == "" {
+		var body []byte
+		for {
+			chunk, err := r.ReadSlice(0)
+			if len(body)+len(chunk) > MaxFrameBytes+1 {
+				return nil, ErrFrameTooLarge
+			}
+			body = append(body, chunk...)
+			if err == nil {
+				return body[:len(body)-1], nil
+			}
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				return nil, err
+			}
+		}
+	}
+
+	length, err := strconv.Atoi(contentLength)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: invalid content-length %q", ErrMalformed, contentLength)
+	}
+	if length > MaxFrameBytes {
+		return nil, ErrFrameTooLarge
+	}
+	body := make([]byte, length+1)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if body[length] != 0 {
+		return nil, fmt.Errorf("%w: body not terminated by NUL", ErrMalformed)
+	}
+	return body[:length], nil
+}
@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupAuditedServer(t *testing.T, quotas server.QuotaOption) (*server.Server, *helpers.AuditSpy) {
+	spy := &helpers.AuditSpy{}
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", Quotas: quotas, Audit: spy})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv, spy
+}
+
+func shouldAuditBefore(t *testing.T, spy *helpers.AuditSpy, eventType audit.EventType, timeout time.Duration) audit.Event {
+	require.Eventually(t, func() bool { return len(spy.Events(eventType)) > 0 }, timeout, time.Millisecond, "Event %q should have been audited", eventType)
+	return spy.Events(eventType)[0]
+}
+
+func TestAudit_ConnectionsAndTunnelCreation(t *testing.T) {
+	tunnelName := "BTunnel_audit_created"
+	srv, spy := setupAuditedServer(t, server.QuotaOption{})
+	cli := setupClient(t, srv.Addr())
+
+	accepted := shouldAuditBefore(t, spy, audit.ConnectionAccepted, 100*time.Millisecond)
+	assert.NotEmpty(t, accepted.Client)
+	assert.NotEmpty(t, accepted.RemoteAddr)
+	assert.False(t, accepted.Time.IsZero())
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	created := shouldAuditBefore(t, spy, audit.TunnelCreated, 100*time.Millisecond)
+	assert.Equal(t, tunnelName, created.Tunnel)
+	assert.Equal(t, accepted.Client, created.Client)
+	assert.Equal(t, accepted.RemoteAddr, created.RemoteAddr)
+
+	cli.Stop()
+	closed := shouldAuditBefore(t, spy, audit.ConnectionClosed, 100*time.Millisecond)
+	assert.Equal(t, accepted.Client, closed.Client)
+}
+
+func TestAudit_Denials(t *testing.T) {
+	srv, spy := setupAuditedServer(t, server.QuotaOption{MaxConnections: 1, MaxTunnelsPerOwner: 1})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_audit_denied_1"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_audit_denied_2"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+	denied := shouldAuditBefore(t, spy, audit.TunnelCreationDenied, 100*time.Millisecond)
+	assert.Equal(t, "BTunnel_audit_denied_2", denied.Tunnel)
+	assert.Equal(t, "quota tunnels_per_owner", denied.Reason)
+
+	rejected := setupClient(t, srv.Addr())
+	t.Cleanup(rejected.Stop)
+	event := shouldAuditBefore(t, spy, audit.ConnectionRejected, 100*time.Millisecond)
+	assert.Equal(t, "quota connections", event.Reason)
+}
+
+func TestAudit_FileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := audit.NewFileSink(&audit.FileSinkOption{Path: path, MaxBytes: 200, MaxBackups: 2})
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	for i := range 20 {
+		sink.Audit(audit.Event{Time: time.Now(), Type: audit.TunnelCreated, Tunnel: fmt.Sprintf("tunnel_%d", i)})
+	}
+	require.NoError(t, sink.Close())
+
+	for _, file := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(file)
+		require.NoError(t, err, file)
+		assert.LessOrEqual(t, info.Size(), int64(200), file)
+	}
+	assert.NoFileExists(t, path+".3")
+
+	// The current file holds the last events
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var last audit.Event
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &last))
+	}
+	assert.Equal(t, "tunnel_19", last.Tunnel)
+}
+
+func TestAudit_FileSinkRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := audit.NewFileSink(&audit.FileSinkOption{Path: path, MaxBytes: 200, MaxBackups: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	// The oldest generation cannot be removed, so the rotation fails
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0o700))
+	for i := range 10 {
+		sink.Audit(audit.Event{Time: time.Now(), Type: audit.TunnelCreated, Tunnel: fmt.Sprintf("tunnel_%d", i)})
+	}
+
+	// Once the rotation succeeds again, no event is lost
+	require.NoError(t, os.RemoveAll(path+".1"))
+	sink.Audit(audit.Event{Time: time.Now(), Type: audit.TunnelCreated, Tunnel: "tunnel_10"})
+	require.NoError(t, sink.Close())
+	assert.NoFileExists(t, path+".next")
+
+	var tunnels []string
+	for _, file := range []string{path + ".1", path} {
+		content, err := os.Open(file)
+		require.NoError(t, err, file)
+		for scanner := bufio.NewScanner(content); scanner.Scan(); {
+			var event audit.Event
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			tunnels = append(tunnels, event.Tunnel)
+		}
+		content.Close()
+	}
+	require.Len(t, tunnels, 11)
+	for i, tunnelName := range tunnels {
+		assert.Equal(t, fmt.Sprintf("tunnel_%d", i), tunnelName)
+	}
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+// setupSlowConsumerTunnel creates a Tunnel whose only listener doesn't read its messages.
+func setupSlowConsumerTunnel(t *testing.T, tunnelName string, overflow tunnel.OverflowPolicy) *helpers.ListenerSpy {
+	require.NoError(t, tunnel.CreateBroadcastWithOption(tunnelName, &tunnel.BroadcastOption{BufferSize: 2, Overflow: overflow}))
+	listener := helpers.NewListenerSpyWithCapacity(tunnelName+"_listener", 0)
+	require.NoError(t, tunnel.Listen(tunnelName, listener))
+	t.Cleanup(func() { tunnel.StopListen(listener.ID()); listener.Close() })
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "first"))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "second"))
+	return listener
+}
+
+func TestBackpressure_Reject(t *testing.T) {
+	tunnelName := "BTunnel_backpressure_reject"
+	listener := setupSlowConsumerTunnel(t, tunnelName, tunnel.OverflowReject)
+
+	err := tunnel.PublishMessage("sender", tunnelName, "third")
+	assert.ErrorIs(t, err, tunnel.ErrTunnelFull)
+	assert.Equal(t, tunnel.Stats{BufferDepth: 2, BufferSize: 2, Rejected: 1}, tunnel.AllStats()[tunnelName])
+
+	// Room is made once the listener is notified
+	assert.Equal(t, "first", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Eventually(t, func() bool { return tunnel.AllStats()[tunnelName].BufferDepth < 2 }, 100*time.Millisecond, time.Millisecond)
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "third"))
+}
+
+func TestBackpressure_Drop(t *testing.T) {
+	tunnelName := "BTunnel_backpressure_drop"
+	listener := setupSlowConsumerTunnel(t, tunnelName, tunnel.OverflowDrop)
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "third"))
+	assert.Equal(t, 1, tunnel.AllStats()[tunnelName].Dropped)
+
+	assert.Equal(t, "first", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Equal(t, "second", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+}
+
+func TestBackpressure_DropNotConfirmed(t *testing.T) {
+	tunnelName := "BTunnel_backpressure_drop_confirm"
+	setupSlowConsumerTunnel(t, tunnelName, tunnel.OverflowDrop)
+
+	confirm := tunnel.NewConfirmation(tunnel.ConfirmOne)
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: "dropped", Confirm: confirm}))
+
+	select {
+	case <-confirm.Done():
+		assert.False(t, confirm.Confirmed(), "A dropped message shouldn't be confirmed")
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "The confirmation of a dropped message should be resolved")
+	}
+}
+
+func TestBackpressure_DropNotConfirmedThroughServer(t *testing.T) {
+	tunnelName := "BTunnel_backpressure_drop_confirm_server"
+	publisher, _ := setupConfirmServerAndClients(t, tunnel.ConfirmAll)
+	setupSlowConsumerTunnel(t, tunnelName, tunnel.OverflowDrop) // Its listener is closed before the server is stopped
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "dropped"))))
+	shouldReceiveNackBefore(t, publisher, 100*time.Millisecond)
+}
+
+func TestBackpressure_Block(t *testing.T) {
+	tunnelName := "BTunnel_backpressure_block"
+	listener := setupSlowConsumerTunnel(t, tunnelName, tunnel.OverflowBlock)
+
+	published := make(chan struct{})
+	go func() {
+		assert.NoError(t, tunnel.PublishMessage("sender", tunnelName, "third"))
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		assert.FailNow(t, "Publisher should be blocked while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, "first", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	select {
+	case <-published:
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Publisher should be unblocked once there is room in the buffer")
+	}
+	assert.Equal(t, "second", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Equal(t, "third", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestBackpressure_ServerNackWhenTunnelFull(t *testing.T) {
+	tunnelName := "BTunnel_backpressure_server"
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", TunnelBufferSize: 1})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	publisher := setupClient(t, srv.Addr())
+	t.Cleanup(publisher.Stop)
+	listener := setupClient(t, srv.Addr())
+	t.Cleanup(listener.Stop)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewCreateTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	// The listener doesn't ack the first message: it stays in-flight
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "first"))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	select {
+	case <-listener.Commands():
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "ReceiveMessage command should have been received")
+	}
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "second"))))
+	shouldReceiveNackBefore(t, publisher, 100*time.Millisecond)
+}
+
+func TestBackpressure_Metrics(t *testing.T) {
+	tunnelName := "BTunnel_backpressure_metrics"
+	setupSlowConsumerTunnel(t, tunnelName, tunnel.OverflowReject)
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+
+	var vars struct {
+		Goroutines int                     `json:"goroutines"`
+		Tunnels    map[string]tunnel.Stats `json:"tunnels"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &vars))
+	assert.Positive(t, vars.Goroutines)
+	assert.Equal(t, tunnel.Stats{BufferDepth: 2, BufferSize: 2}, vars.Tunnels[tunnelName])
+}
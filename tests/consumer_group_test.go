@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func TestConsumerGroup_SharesLoadBetweenMembers(t *testing.T) {
+	tunnelName := "BTunnel_group_shares_load"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+
+	m1 := helpers.NewListenerSpy("group_member_1")
+	m2 := helpers.NewListenerSpy("group_member_2")
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", m1))
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", m2))
+	t.Cleanup(func() { tunnel.StopListen(m1.ID()); tunnel.StopListen(m2.ID()) })
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "first"))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "second"))
+
+	// Each member receives one of the two messages
+	received := []string{
+		shouldNotifyBefore(t, m1, 100*time.Millisecond),
+		shouldNotifyBefore(t, m2, 100*time.Millisecond),
+	}
+	assert.ElementsMatch(t, []string{"first", "second"}, received)
+	shouldNotNotifyBefore(t, m1, 50*time.Millisecond)
+	shouldNotNotifyBefore(t, m2, 50*time.Millisecond)
+}
+
+func TestConsumerGroup_EachGroupAndUngroupedListenerReceivesMessage(t *testing.T) {
+	tunnelName := "BTunnel_group_each_group"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+
+	billing := helpers.NewListenerSpy("group_billing")
+	shipping := helpers.NewListenerSpy("group_shipping")
+	solo := helpers.NewListenerSpy("group_solo")
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "billing", billing))
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "shipping", shipping))
+	require.NoError(t, tunnel.Listen(tunnelName, solo))
+	t.Cleanup(func() {
+		tunnel.StopListen(billing.ID())
+		tunnel.StopListen(shipping.ID())
+		tunnel.StopListen(solo.ID())
+	})
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "order created"))
+
+	assert.Equal(t, "order created", shouldNotifyBefore(t, billing, 100*time.Millisecond))
+	assert.Equal(t, "order created", shouldNotifyBefore(t, shipping, 100*time.Millisecond))
+	assert.Equal(t, "order created", shouldNotifyBefore(t, solo, 100*time.Millisecond))
+}
+
+func TestConsumerGroup_RebalanceOnLeave(t *testing.T) {
+	tunnelName := "BTunnel_group_rebalance"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+
+	m1 := helpers.NewListenerSpy("group_rebalance_1")
+	m2 := helpers.NewListenerSpy("group_rebalance_2")
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", m1))
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", m2))
+	t.Cleanup(func() { tunnel.StopListen(m1.ID()) })
+
+	tunnel.StopListen(m2.ID())
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "first"))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "second"))
+
+	received := []string{
+		shouldNotifyBefore(t, m1, 100*time.Millisecond),
+		shouldNotifyBefore(t, m1, 100*time.Millisecond),
+	}
+	assert.ElementsMatch(t, []string{"first", "second"}, received)
+	shouldNotNotifyBefore(t, m2, 50*time.Millisecond)
+}
+
+func TestConsumerGroup_SkipSender(t *testing.T) {
+	tunnelName := "BTunnel_group_skip_sender"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+
+	sender := helpers.NewListenerSpy("group_sender")
+	other := helpers.NewListenerSpy("group_other")
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", sender))
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", other))
+	t.Cleanup(func() { tunnel.StopListen(sender.ID()); tunnel.StopListen(other.ID()) })
+
+	require.NoError(t, tunnel.PublishMessage(sender.ID(), tunnelName, "first"))
+	require.NoError(t, tunnel.PublishMessage(sender.ID(), tunnelName, "second"))
+
+	shouldNotifyBefore(t, other, 100*time.Millisecond)
+	shouldNotifyBefore(t, other, 100*time.Millisecond)
+	shouldNotNotifyBefore(t, sender, 50*time.Millisecond)
+}
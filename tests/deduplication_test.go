@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func TestDeduplication_DropDuplicateWithinWindow(t *testing.T) {
+	tunnelName := "BTunnel_dedup_window"
+	listener := setupListenedTunnelWithOption(t, tunnelName, &tunnel.BroadcastOption{DedupWindow: 100 * time.Millisecond})
+
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id1", SenderID: "sender", Msg: "first"}))
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id1", SenderID: "sender", Msg: "first retry"}))
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id2", SenderID: "sender", Msg: "second"}))
+
+	assert.Equal(t, "first", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+	assert.Equal(t, "second", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+
+	// Once the window is elapsed, the id is forgotten
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id1", SenderID: "sender", Msg: "first late retry"}))
+	assert.Equal(t, "first late retry", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+}
+
+func TestDeduplication_BoundedCapacity(t *testing.T) {
+	tunnelName := "BTunnel_dedup_capacity"
+	listener := setupListenedTunnelWithOption(t, tunnelName, &tunnel.BroadcastOption{DedupWindow: time.Minute, DedupCapacity: 2})
+
+	for _, id := range []string{"id1", "id2", "id3", "id1"} { // id1 is forgotten when id3 is seen
+		require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: id, SenderID: "sender", Msg: id}))
+	}
+
+	for _, expected := range []string{"id1", "id2", "id3", "id1"} {
+		assert.Equal(t, expected, shouldNotifyBefore(t, listener, 50*time.Millisecond))
+	}
+}
+
+func TestDeduplication_DisabledByDefault(t *testing.T) {
+	tunnelName := "BTunnel_dedup_disabled"
+	listener := setupListenedTunnel(t, tunnelName)
+
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id1", SenderID: "sender", Msg: "first"}))
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id1", SenderID: "sender", Msg: "first retry"}))
+
+	assert.Equal(t, "first", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+	assert.Equal(t, "first retry", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+}
+
+func TestDeduplication_RetryIsAcked(t *testing.T) {
+	tunnelName := "BTunnel_dedup_retry_acked"
+	listener := setupListenedTunnelWithOption(t, tunnelName, &tunnel.BroadcastOption{DedupWindow: time.Minute})
+
+	srv, cli := setupServerAndClient(t)
+	t.Cleanup(srv.Stop)
+	t.Cleanup(cli.Stop)
+
+	publish := command.NewPublishMessage(tunnelName, "retried message")
+	require.NoError(t, cli.Send(pdu.Marshal(publish)))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+
+	// Retry with the same transaction id
+	require.NoError(t, cli.Send(pdu.Marshal(publish)))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+
+	assert.Equal(t, "retried message", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+}
+
+func TestDeduplication_RejectedMessageRetryIsDelivered(t *testing.T) {
+	tunnelName := "BTunnel_dedup_rejected"
+	require.NoError(t, tunnel.CreateBroadcastWithOption(tunnelName, &tunnel.BroadcastOption{
+		BufferSize: 1, Overflow: tunnel.OverflowReject, DedupWindow: time.Minute,
+	}))
+	listener := helpers.NewListenerSpyWithCapacity(tunnelName+"_listener", 0)
+	require.NoError(t, tunnel.Listen(tunnelName, listener))
+	t.Cleanup(func() { tunnel.StopListen(listener.ID()); listener.Close() })
+
+	// Fill the Tunnel, so that the message is rejected
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id1", SenderID: "sender", Msg: "first"}))
+	err := tunnel.Publish(tunnelName, tunnel.Message{ID: "id2", SenderID: "sender", Msg: "second"})
+	require.ErrorIs(t, err, tunnel.ErrTunnelFull)
+
+	// Its retry, once room is made, isn't a duplicate
+	assert.Equal(t, "first", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Eventually(t, func() bool { return tunnel.AllStats()[tunnelName].BufferDepth == 0 }, 100*time.Millisecond, time.Millisecond)
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{ID: "id2", SenderID: "sender", Msg: "second retry"}))
+	assert.Equal(t, "second retry", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestDeduplication_ServerOption(t *testing.T) {
+	tunnelName := "BTunnel_dedup_server_option"
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", TunnelDedupWindow: time.Minute})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	publisher := setupClient(t, srv.Addr())
+	t.Cleanup(publisher.Stop)
+	listener := setupClient(t, srv.Addr())
+	t.Cleanup(listener.Stop)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewCreateTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	// The publisher resends the message with the same transaction id, as its ack was lost
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessageWithTransactionID("publish1", tunnelName, "message"))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessageWithTransactionID("publish1", tunnelName, "message"))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+
+	_, message := shouldReceiveMessageAndAckBefore(t, listener, 100*time.Millisecond)
+	assert.Equal(t, "message", message)
+	shouldNotReceiveCommandsBefore(t, listener, 100*time.Millisecond)
+
+	// Another transaction id is another message
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessageWithTransactionID("publish2", tunnelName, "message"))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	_, message = shouldReceiveMessageAndAckBefore(t, listener, 100*time.Millisecond)
+	assert.Equal(t, "message", message)
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+// setupFrozenGroupMember creates a group whose first member never reads its messages.
+func setupFrozenGroupMember(t *testing.T, tunnelName string) (frozen, alive *helpers.ListenerSpy) {
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	frozen = helpers.NewListenerSpyWithCapacity(tunnelName+"_frozen", 0)
+	alive = helpers.NewListenerSpy(tunnelName + "_alive")
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", frozen))
+	require.NoError(t, tunnel.ListenGroup(tunnelName, "workers", alive))
+	t.Cleanup(func() { tunnel.StopListen(alive.ID()) })
+	return frozen, alive
+}
+
+func TestHeartbeat_RedeliversInFlightMessageOfDeadMember(t *testing.T) {
+	tunnelName := "BTunnel_heartbeat_in_flight"
+	frozen, alive := setupFrozenGroupMember(t, tunnelName)
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "first"))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "second"))
+	assert.Equal(t, "second", shouldNotifyBefore(t, alive, 100*time.Millisecond))
+
+	// The dead connection is detected: its listener leaves, then its notification fails
+	tunnel.StopListen(frozen.ID())
+	frozen.Close()
+	assert.Equal(t, "first", shouldNotifyBefore(t, alive, 100*time.Millisecond))
+	assert.Eventually(t, func() bool { return tunnel.AllStats()[tunnelName].BufferDepth == 0 }, 100*time.Millisecond, time.Millisecond)
+}
+
+func TestHeartbeat_RedeliversPendingMessagesOfDeadMember(t *testing.T) {
+	tunnelName := "BTunnel_heartbeat_pending"
+	frozen, alive := setupFrozenGroupMember(t, tunnelName)
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "first"))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "second"))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "third"))
+	assert.Equal(t, "second", shouldNotifyBefore(t, alive, 100*time.Millisecond))
+
+	tunnel.StopListen(frozen.ID())
+	frozen.Close()
+	received := []string{
+		shouldNotifyBefore(t, alive, 100*time.Millisecond),
+		shouldNotifyBefore(t, alive, 100*time.Millisecond),
+	}
+	assert.ElementsMatch(t, []string{"first", "third"}, received)
+	shouldNotNotifyBefore(t, alive, 50*time.Millisecond)
+}
+
+func TestHeartbeat_LastMemberLeaving(t *testing.T) {
+	tunnelName := "BTunnel_heartbeat_last_member"
+	frozen, alive := setupFrozenGroupMember(t, tunnelName)
+	tunnel.StopListen(alive.ID())
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "first"))
+	tunnel.StopListen(frozen.ID())
+	frozen.Close()
+
+	// Nobody can take the message over: it leaves the buffer
+	assert.Eventually(t, func() bool { return tunnel.AllStats()[tunnelName].BufferDepth == 0 }, 100*time.Millisecond, time.Millisecond)
+}
+
+func setupHeartbeatServer(t *testing.T, opts *server.ServerOption) *server.Server {
+	opts.Heartbeat = server.HeartbeatOption{Interval: 50 * time.Millisecond, MissedBeats: 2}
+	srv := server.NewServerWithOption(opts)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func setupHeartbeatClient(t *testing.T, tunnelName string) *helpers.ClientSpy {
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupHeartbeatServer(t, &server.ServerOption{Addr: ":0"})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	return cli
+}
+
+func TestHeartbeat_FrozenClientEvicted(t *testing.T) {
+	tunnelName := "BTunnel_heartbeat_frozen_client"
+	cli := setupHeartbeatClient(t, tunnelName)
+	evictedBefore := metrics.FrozenClientsEvicted.Value()
+
+	// Reads the message but never acknowledges it
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "msg"))
+	select {
+	case cmd := <-cli.Commands():
+		require.IsType(t, &command.ReceiveMessage{}, cmd)
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Message should have been received")
+	}
+
+	// Evicted within Interval x MissedBeats, plus the heartbeat in progress
+	shouldBeDisconnectedBefore(t, cli, 200*time.Millisecond)
+	assert.Equal(t, evictedBefore+1, metrics.FrozenClientsEvicted.Value())
+}
+
+func TestHeartbeat_IdleClientKept(t *testing.T) {
+	tunnelName := "BTunnel_heartbeat_idle_client"
+	cli := setupHeartbeatClient(t, tunnelName)
+
+	// Owes nothing once its message acknowledged
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "msg"))
+	shouldReceiveMessageAndAckBefore(t, cli, 100*time.Millisecond)
+
+	select {
+	case <-cli.Done():
+		assert.FailNow(t, "Client should not have been evicted")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestHeartbeat_WebSocketClientAnsweringPings(t *testing.T) {
+	srv := setupHeartbeatServer(t, &server.ServerOption{Addr: ":0", WebSocketAddr: "127.0.0.1:0"})
+	cli, err := helpers.NewWebSocketClientSpy(srv.WebSocketAddr())
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+
+	// Idle for more than Interval x MissedBeats, answering the pings
+	time.Sleep(300 * time.Millisecond)
+
+	require.NoError(t, cli.Send(server.WebSocketFrame{Type: server.FrameCreate, TransactionID: "hbwsping", Tunnel: "BTunnel_heartbeat_ws"}))
+	select {
+	case frame, ok := <-cli.Frames():
+		require.True(t, ok, "Client should not have been evicted")
+		assert.Equal(t, server.FrameAck, frame.Type)
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Ack should have been received")
+	}
+}
@@ -0,0 +1,32 @@
+package helpers
+
+import (
+	"sync"
+
+	"github.com/codingLayce/tunnel-server/audit"
+)
+
+// AuditSpy is a server.AuditSink keeping every audited event.
+type AuditSpy struct {
+	events []audit.Event
+	mtx    sync.Mutex
+}
+
+func (a *AuditSpy) Audit(event audit.Event) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.events = append(a.events, event)
+}
+
+// Events returns the audited events with the given type.
+func (a *AuditSpy) Events(eventType audit.EventType) []audit.Event {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	var events []audit.Event
+	for _, event := range a.events {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
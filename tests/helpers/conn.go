@@ -0,0 +1,65 @@
+package helpers
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// Client of the Tunnel protocol, over TCP, TLS or a Unix domain socket.
+type Client interface {
+	Send(payload []byte) error
+	Commands() <-chan command.Command
+}
+
+// ConnClientSpy is a Tunnel protocol client over any connection, as a Unix domain socket or TLS.
+type ConnClientSpy struct {
+	conn     net.Conn
+	commands chan command.Command
+}
+
+func NewUnixClientSpy(path string) (*ConnClientSpy, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return NewConnClientSpy(conn), nil
+}
+
+func NewConnClientSpy(conn net.Conn) *ConnClientSpy {
+	client := &ConnClientSpy{
+		conn:     conn,
+		commands: make(chan command.Command, 100),
+	}
+	go client.readLoop()
+	return client
+}
+
+func (c *ConnClientSpy) readLoop() {
+	defer close(c.commands)
+	reader := bufio.NewReader(c.conn)
+	for {
+		payload, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		cmd, _ := pdu.Unmarshal(payload) // Used only in tests and the server shouldn't send unparsable payloads
+		c.commands <- cmd
+	}
+}
+
+func (c *ConnClientSpy) Send(payload []byte) error {
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// Commands received from the server. Closed once the connection is closed.
+func (c *ConnClientSpy) Commands() <-chan command.Command {
+	return c.commands
+}
+
+func (c *ConnClientSpy) Close() error {
+	return c.conn.Close()
+}
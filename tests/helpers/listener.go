@@ -0,0 +1,42 @@
+package helpers
+
+// ListenerSpy is a tunnel.Listener pushing every notified message to a channel.
+type ListenerSpy struct {
+	id       string
+	messages chan string
+	closed   chan struct{}
+}
+
+func NewListenerSpy(id string) *ListenerSpy {
+	return NewListenerSpyWithCapacity(id, 100)
+}
+
+// NewListenerSpyWithCapacity creates a ListenerSpy blocking the notification once capacity messages are unread.
+func NewListenerSpyWithCapacity(id string, capacity int) *ListenerSpy {
+	return &ListenerSpy{
+		id:       id,
+		messages: make(chan string, capacity),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *ListenerSpy) ID() string { return l.id }
+
+// NotifyMessage acks the message once pushed. Nacks it if the spy is closed.
+func (l *ListenerSpy) NotifyMessage(_, message string) bool {
+	select {
+	case l.messages <- message:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *ListenerSpy) Messages() <-chan string {
+	return l.messages
+}
+
+// Close unblocks the pending and future notifications.
+func (l *ListenerSpy) Close() {
+	close(l.closed)
+}
@@ -0,0 +1,68 @@
+package helpers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+
+	"github.com/codingLayce/tunnel-server/mqtt"
+)
+
+// MQTTClientSpy is a minimal MQTT 3.1.1 client pushing every received packet to a channel.
+type MQTTClientSpy struct {
+	conn    net.Conn
+	packets chan mqtt.Packet
+}
+
+func NewMQTTClientSpy(addr string) (*MQTTClientSpy, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	client := &MQTTClientSpy{
+		conn:    conn,
+		packets: make(chan mqtt.Packet, 100),
+	}
+	go client.readLoop()
+	return client, nil
+}
+
+func (c *MQTTClientSpy) readLoop() {
+	defer close(c.packets)
+	reader := bufio.NewReader(c.conn)
+	for {
+		packet, err := mqtt.Read(reader)
+		if err != nil {
+			return
+		}
+		c.packets <- packet
+	}
+}
+
+// Connect sends a clean session CONNECT and returns the CONNACK return code.
+func (c *MQTTClientSpy) Connect(clientID string) (byte, error) {
+	err := c.Send(&mqtt.Connect{ProtocolName: "MQTT", ProtocolLevel: mqtt.ProtocolLevel, CleanSession: true, ClientID: clientID})
+	if err != nil {
+		return 0, err
+	}
+	packet, open := <-c.packets
+	connack, ok := packet.(*mqtt.Connack)
+	if !open || !ok {
+		return 0, errors.New("CONNACK expected")
+	}
+	return connack.ReturnCode, nil
+}
+
+func (c *MQTTClientSpy) Send(packet mqtt.Packet) error {
+	_, err := c.conn.Write(mqtt.Marshal(packet))
+	return err
+}
+
+// Packets received from the server. Closed once the connection is closed.
+func (c *MQTTClientSpy) Packets() <-chan mqtt.Packet {
+	return c.packets
+}
+
+func (c *MQTTClientSpy) Close() error {
+	return c.conn.Close()
+}
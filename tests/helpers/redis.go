@@ -0,0 +1,60 @@
+package helpers
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/codingLayce/tunnel-server/resp"
+)
+
+// RedisClientSpy is a minimal Redis client pushing every received reply to a channel.
+type RedisClientSpy struct {
+	conn    net.Conn
+	replies chan any
+}
+
+func NewRedisClientSpy(addr string) (*RedisClientSpy, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	client := &RedisClientSpy{
+		conn:    conn,
+		replies: make(chan any, 100),
+	}
+	go client.readLoop()
+	return client, nil
+}
+
+func (c *RedisClientSpy) readLoop() {
+	defer close(c.replies)
+	reader := bufio.NewReader(c.conn)
+	for {
+		reply, err := resp.Read(reader)
+		if err != nil {
+			return
+		}
+		c.replies <- reply
+	}
+}
+
+// Send the command as an array of bulk strings.
+func (c *RedisClientSpy) Send(args ...string) error {
+	_, err := c.conn.Write(resp.AppendCommand(nil, args...))
+	return err
+}
+
+// SendRaw sends the bytes as is, such as inline commands.
+func (c *RedisClientSpy) SendRaw(raw []byte) error {
+	_, err := c.conn.Write(raw)
+	return err
+}
+
+// Replies received from the server, as decoded by resp.Read. Closed once the connection is closed.
+func (c *RedisClientSpy) Replies() <-chan any {
+	return c.replies
+}
+
+func (c *RedisClientSpy) Close() error {
+	return c.conn.Close()
+}
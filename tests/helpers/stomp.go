@@ -0,0 +1,73 @@
+package helpers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+
+	"github.com/codingLayce/tunnel-server/stomp"
+)
+
+// STOMPClientSpy is a minimal STOMP 1.2 client pushing every received frame to a channel.
+type STOMPClientSpy struct {
+	conn   net.Conn
+	frames chan *stomp.Frame
+}
+
+func NewSTOMPClientSpy(addr string) (*STOMPClientSpy, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	client := &STOMPClientSpy{
+		conn:   conn,
+		frames: make(chan *stomp.Frame, 100),
+	}
+	go client.readLoop()
+	return client, nil
+}
+
+func (c *STOMPClientSpy) readLoop() {
+	defer close(c.frames)
+	reader := bufio.NewReader(c.conn)
+	for {
+		frame, err := stomp.Read(reader)
+		if err != nil {
+			return
+		}
+		c.frames <- frame
+	}
+}
+
+// Connect sends a STOMP 1.2 CONNECT frame and returns the answer: a CONNECTED or an ERROR frame.
+func (c *STOMPClientSpy) Connect() (*stomp.Frame, error) {
+	err := c.Send(stomp.NewFrame(stomp.CommandConnect, "accept-version", "1.2", "host", "localhost"))
+	if err != nil {
+		return nil, err
+	}
+	frame, open := <-c.frames
+	if !open {
+		return nil, errors.New("CONNECTED expected")
+	}
+	return frame, nil
+}
+
+func (c *STOMPClientSpy) Send(frame *stomp.Frame) error {
+	_, err := c.conn.Write(stomp.Marshal(frame))
+	return err
+}
+
+// SendRaw sends the bytes as is.
+func (c *STOMPClientSpy) SendRaw(raw []byte) error {
+	_, err := c.conn.Write(raw)
+	return err
+}
+
+// Frames received from the server. Closed once the connection is closed.
+func (c *STOMPClientSpy) Frames() <-chan *stomp.Frame {
+	return c.frames
+}
+
+func (c *STOMPClientSpy) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,64 @@
+package helpers
+
+import (
+	"encoding/json"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/websocket"
+)
+
+// WebSocketClientSpy is a browser-like client of the WebSocket gateway.
+type WebSocketClientSpy struct {
+	conn   *websocket.Conn
+	frames chan server.WebSocketFrame
+}
+
+func NewWebSocketClientSpy(addr string) (*WebSocketClientSpy, error) {
+	conn, err := websocket.Dial(addr, "/")
+	if err != nil {
+		return nil, err
+	}
+	client := &WebSocketClientSpy{
+		conn:   conn,
+		frames: make(chan server.WebSocketFrame),
+	}
+	go client.readLoop()
+	return client, nil
+}
+
+func (c *WebSocketClientSpy) readLoop() {
+	defer close(c.frames)
+	for {
+		payload, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var frame server.WebSocketFrame
+		_ = json.Unmarshal(payload, &frame) // Used only in tests and the server shouldn't send invalid frames
+		c.frames <- frame
+	}
+}
+
+func (c *WebSocketClientSpy) Send(frame server.WebSocketFrame) error {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(payload)
+	return err
+}
+
+// SendRaw sends the payload as is, to send invalid frames.
+func (c *WebSocketClientSpy) SendRaw(payload []byte) error {
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// Frames received from the server. Closed once the connection is closed.
+func (c *WebSocketClientSpy) Frames() <-chan server.WebSocketFrame {
+	return c.frames
+}
+
+func (c *WebSocketClientSpy) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,351 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+	"github.com/codingLayce/tunnel.go/test-helper/mock"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupHTTPServer(t *testing.T, opts *server.ServerOption) *server.Server {
+	opts.Addr = ":0"
+	opts.HTTPAddr = "127.0.0.1:0"
+	srv := server.NewServerWithOption(opts)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func httpPublish(t *testing.T, srv *server.Server, tunnelName, message string) int {
+	resp, err := http.Post("http://"+srv.HTTPAddr()+"/tunnels/"+tunnelName+"/messages", "text/plain", strings.NewReader(message))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// subscribeEvents streams the events of the Tunnel, pushing the data of each one to the returned channel.
+func subscribeEvents(t *testing.T, srv *server.Server, path string) (events <-chan string, stop func()) {
+	resp, err := http.Get("http://" + srv.HTTPAddr() + path)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	ch := make(chan string, 100)
+	go func() {
+		defer close(ch)
+		var data []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			case line == "":
+				ch <- strings.Join(data, "\n")
+				data = nil
+			}
+		}
+	}()
+	return ch, func() { resp.Body.Close() }
+}
+
+func shouldReceiveEventBefore(t *testing.T, events <-chan string, timeout time.Duration) string {
+	select {
+	case data := <-events:
+		return data
+	case <-time.After(timeout):
+		assert.FailNow(t, "Event should have been received")
+	}
+	return ""
+}
+
+func TestHTTP_Publish(t *testing.T) {
+	tunnelName := "BTunnel_http_publish"
+	listener := setupListenedTunnel(t, tunnelName)
+	srv := setupHTTPServer(t, &server.ServerOption{})
+
+	assert.Equal(t, http.StatusAccepted, httpPublish(t, srv, tunnelName, "Hello from curl"))
+	assert.Equal(t, "Hello from curl", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestHTTP_ReadHeaderTimeout(t *testing.T) {
+	mock.Do(t, &server.HTTPReadHeaderTimeout, 50*time.Millisecond)
+	srv := setupHTTPServer(t, &server.ServerOption{})
+
+	// A client never ending its request headers is disconnected
+	conn, err := net.Dial("tcp", srv.HTTPAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /tunnels/BTunnel_http_slow/messages HTTP/1.1\r\nHost: localhost\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "Connection should have been closed")
+}
+
+func TestHTTP_PublishUnknownTunnel(t *testing.T) {
+	srv := setupHTTPServer(t, &server.ServerOption{})
+	assert.Equal(t, http.StatusNotFound, httpPublish(t, srv, "BTunnel_http_unknown", "lost"))
+}
+
+func TestHTTP_PublishTooLarge(t *testing.T) {
+	tunnelName := "BTunnel_http_too_large"
+	listener := setupListenedTunnel(t, tunnelName)
+	srv := setupHTTPServer(t, &server.ServerOption{Quotas: server.QuotaOption{MaxMessageBytes: 4}})
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, httpPublish(t, srv, tunnelName, "too large"))
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+}
+
+func TestHTTP_PublishUnsupportedMessage(t *testing.T) {
+	tunnelName := "BTunnel_http_unsupported"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupHTTPServer(t, &server.ServerOption{})
+	listener := setupClient(t, srv.Addr())
+	defer listener.Stop()
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	// A JSON body cannot be carried to the Tunnel protocol listener
+	assert.Equal(t, http.StatusBadRequest, httpPublish(t, srv, tunnelName, `{"temperature": 21.5}`))
+	shouldNotReceiveCommandsBefore(t, listener, 50*time.Millisecond)
+
+	assert.Equal(t, http.StatusAccepted, httpPublish(t, srv, tunnelName, "temperature 21"))
+	_, message := shouldReceiveMessageAndAckBefore(t, listener, 100*time.Millisecond)
+	assert.Equal(t, "temperature 21", message)
+}
+
+// httpPublishWithQuery publishes the message with the query parameters. Returns the status code and the body.
+func httpPublishWithQuery(t *testing.T, srv *server.Server, tunnelName, message, query string) (int, string) {
+	resp, err := http.Post("http://"+srv.HTTPAddr()+"/tunnels/"+tunnelName+"/messages?"+query, "text/plain", strings.NewReader(message))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestHTTP_PublishPriority(t *testing.T) {
+	tunnelName := "BTunnel_http_priority"
+	listener := setupBlockedPriorityTunnel(t, tunnelName)
+	srv := setupHTTPServer(t, &server.ServerOption{})
+
+	status, _ := httpPublishWithQuery(t, srv, tunnelName, "low", "")
+	assert.Equal(t, http.StatusAccepted, status)
+	status, _ = httpPublishWithQuery(t, srv, tunnelName, "high", "priority=9")
+	assert.Equal(t, http.StatusAccepted, status)
+
+	assert.Equal(t, "blocker", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Equal(t, "high", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Equal(t, "low", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestHTTP_PublishKey(t *testing.T) {
+	tunnelName := "BTunnel_http_key"
+	require.NoError(t, tunnel.CreatePartitioned(tunnelName, 4))
+	listeners := []*helpers.ListenerSpy{helpers.NewListenerSpy(tunnelName + "_l1"), helpers.NewListenerSpy(tunnelName + "_l2")}
+	for _, listener := range listeners {
+		require.NoError(t, tunnel.Listen(tunnelName, listener))
+		t.Cleanup(func() { tunnel.StopListen(listener.ID()) })
+	}
+	srv := setupHTTPServer(t, &server.ServerOption{})
+
+	for i := range 10 {
+		status, _ := httpPublishWithQuery(t, srv, tunnelName, fmt.Sprintf("seq %d", i), "key=order42")
+		require.Equal(t, http.StatusAccepted, status)
+	}
+
+	// Every message of the key is delivered in order to the owner of its partition
+	var received []string
+	for _, listener := range listeners {
+		for len(received) < 10 {
+			select {
+			case msg := <-listener.Messages():
+				received = append(received, msg)
+				continue
+			case <-time.After(50 * time.Millisecond):
+			}
+			break
+		}
+	}
+	require.Len(t, received, 10)
+	for i, msg := range received {
+		assert.Equal(t, fmt.Sprintf("seq %d", i), msg)
+	}
+}
+
+func TestHTTP_PublishScheduled(t *testing.T) {
+	tunnelName := "BTunnel_http_scheduled"
+	listener := setupListenedTunnel(t, tunnelName)
+	srv := setupHTTPServer(t, &server.ServerOption{})
+
+	status, body := httpPublishWithQuery(t, srv, tunnelName, "later", "delay=100ms")
+	assert.Equal(t, http.StatusAccepted, status)
+	var scheduled server.ScheduledResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &scheduled))
+	assert.NotEmpty(t, scheduled.ID)
+
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+	assert.Equal(t, "later", shouldNotifyBefore(t, listener, 150*time.Millisecond))
+
+	status, _ = httpPublishWithQuery(t, srv, tunnelName, "past", "at="+time.Now().Add(-time.Minute).Format(time.RFC3339))
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "past", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+}
+
+func TestHTTP_CancelScheduled(t *testing.T) {
+	tunnelName := "BTunnel_http_cancel_scheduled"
+	listener := setupListenedTunnel(t, tunnelName)
+	srv := setupHTTPServer(t, &server.ServerOption{})
+
+	status, body := httpPublishWithQuery(t, srv, tunnelName, "cancelled", "delay=50ms")
+	require.Equal(t, http.StatusAccepted, status)
+	var scheduled server.ScheduledResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &scheduled))
+
+	cancel := func() int {
+		req, err := http.NewRequest(http.MethodDelete, "http://"+srv.HTTPAddr()+"/scheduled/"+scheduled.ID, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, cancel())
+	shouldNotNotifyBefore(t, listener, 100*time.Millisecond)
+	assert.Equal(t, http.StatusNotFound, cancel())
+}
+
+func TestHTTP_PublishInvalidParameters(t *testing.T) {
+	tunnelName := "BTunnel_http_invalid_parameters"
+	listener := setupListenedTunnel(t, tunnelName)
+	srv := setupHTTPServer(t, &server.ServerOption{})
+
+	for query, expected := range map[string]string{
+		"priority=10":          "invalid priority \"10\": must be from 0 to 9",
+		"priority=high":        "invalid priority \"high\": must be from 0 to 9",
+		"delay=soon":           "invalid delay \"soon\"",
+		"at=tomorrow":          "invalid at \"tomorrow\": must be RFC 3339",
+		"delay=1s&at=tomorrow": "delay and at cannot be both set",
+	} {
+		status, body := httpPublishWithQuery(t, srv, tunnelName, "invalid", query)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+		assert.Equal(t, expected, strings.TrimSpace(body), query)
+	}
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+}
+
+func TestHTTP_PublishConfirmed(t *testing.T) {
+	tunnelName := "BTunnel_http_confirmed"
+	listener := setupListenedTunnel(t, tunnelName)
+	srv := setupHTTPServer(t, &server.ServerOption{PublishConfirm: tunnel.ConfirmAll})
+
+	assert.Equal(t, http.StatusOK, httpPublish(t, srv, tunnelName, "confirmed"))
+	assert.Equal(t, "confirmed", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestHTTP_Events(t *testing.T) {
+	tunnelName := "BTunnel_http_events"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupHTTPServer(t, &server.ServerOption{})
+	events, closeEvents := subscribeEvents(t, srv, "/tunnels/"+tunnelName+"/events")
+	defer closeEvents()
+	publisher := setupClient(t, srv.Addr())
+	defer publisher.Stop()
+
+	// From a Tunnel protocol client
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "from sdk"))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	assert.Equal(t, "from sdk", shouldReceiveEventBefore(t, events, 100*time.Millisecond))
+
+	// From HTTP
+	assert.Equal(t, http.StatusAccepted, httpPublish(t, srv, tunnelName, "from http"))
+	assert.Equal(t, "from http", shouldReceiveEventBefore(t, events, 100*time.Millisecond))
+}
+
+func TestHTTP_EventsAutoAck(t *testing.T) {
+	tunnelName := "BTunnel_http_events_ack"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupHTTPServer(t, &server.ServerOption{PublishConfirm: tunnel.ConfirmAll})
+	events, closeEvents := subscribeEvents(t, srv, "/tunnels/"+tunnelName+"/events")
+	defer closeEvents()
+
+	assert.Equal(t, http.StatusOK, httpPublish(t, srv, tunnelName, "acked"))
+	assert.Equal(t, "acked", shouldReceiveEventBefore(t, events, 100*time.Millisecond))
+}
+
+func TestHTTP_EventsGroup(t *testing.T) {
+	tunnelName := "BTunnel_http_events_group"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupHTTPServer(t, &server.ServerOption{})
+	first, closeFirst := subscribeEvents(t, srv, "/tunnels/"+tunnelName+"/events?group=workers")
+	defer closeFirst()
+	second, closeSecond := subscribeEvents(t, srv, "/tunnels/"+tunnelName+"/events?group=workers")
+	defer closeSecond()
+
+	assert.Equal(t, http.StatusAccepted, httpPublish(t, srv, tunnelName, "shared"))
+	select {
+	case data := <-first:
+		assert.Equal(t, "shared", data)
+	case data := <-second:
+		assert.Equal(t, "shared", data)
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Event should have been received")
+	}
+	select {
+	case <-first:
+		assert.FailNow(t, "Group should receive the message once")
+	case <-second:
+		assert.FailNow(t, "Group should receive the message once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHTTP_EventsUnknownTunnel(t *testing.T) {
+	srv := setupHTTPServer(t, &server.ServerOption{})
+	resp, err := http.Get("http://" + srv.HTTPAddr() + "/tunnels/BTunnel_http_events_unknown/events")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestHTTP_EventsStopListeningOnDisconnect(t *testing.T) {
+	tunnelName := "BTunnel_http_events_disconnect"
+	require.NoError(t, tunnel.CreateBroadcastWithOption(tunnelName, &tunnel.BroadcastOption{MaxListeners: 1}))
+	srv := setupHTTPServer(t, &server.ServerOption{})
+	_, closeEvents := subscribeEvents(t, srv, "/tunnels/"+tunnelName+"/events")
+
+	// The status being sent before listening, the rejection is an error event ending the stream
+	resp, err := http.Get("http://" + srv.HTTPAddr() + "/tunnels/" + tunnelName + "/events")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "event: error\ndata: too many listeners\n\n", string(body))
+
+	// The subscriber leaves the Tunnel, making room for another listener
+	closeEvents()
+	spy := helpers.NewListenerSpy(tunnelName + "_listener")
+	require.Eventually(t, func() bool { return tunnel.Listen(tunnelName, spy) == nil }, 100*time.Millisecond, time.Millisecond)
+	t.Cleanup(func() { tunnel.StopListen(spy.ID()) })
+	assert.Equal(t, http.StatusAccepted, httpPublish(t, srv, tunnelName, "after disconnect"))
+	assert.Equal(t, "after disconnect", shouldNotifyBefore(t, spy, 100*time.Millisecond))
+}
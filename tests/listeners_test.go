@@ -0,0 +1,329 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+	"github.com/codingLayce/tunnel.go/test-helper/mock"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupListenersServer(t *testing.T, opts *server.ServerOption) *server.Server {
+	srv := server.NewServerWithOption(opts)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func setupConnClient(t *testing.T, conn net.Conn) *helpers.ConnClientSpy {
+	cli := helpers.NewConnClientSpy(conn)
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func dialListener(t *testing.T, addr string) *helpers.ConnClientSpy {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	return setupConnClient(t, conn)
+}
+
+func shouldBeClosedBefore(t *testing.T, cli helpers.Client, timeout time.Duration) {
+	select {
+	case cmd, open := <-cli.Commands():
+		assert.False(t, open, "Connection should have been closed, received %v", cmd)
+	case <-time.After(timeout):
+		assert.FailNow(t, "Connection should have been closed")
+	}
+}
+
+// certificates of a test CA, written as PEM files in the directory.
+type certificates struct {
+	caFile, serverCertFile, serverKeyFile string
+	clientCert                            tls.Certificate
+	pool                                  *x509.CertPool
+}
+
+func generateCertificates(t *testing.T, dir string) *certificates {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Tunnel test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return der, key
+	}
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+		return path
+	}
+	marshalKey := func(key *ecdsa.PrivateKey) []byte {
+		der, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		return der
+	}
+
+	serverDER, serverKey := issue(2, "tunnel-server", x509.ExtKeyUsageServerAuth)
+	clientDER, clientKey := issue(3, "tunnel-client", x509.ExtKeyUsageClientAuth)
+	certs := &certificates{
+		caFile:         writePEM("ca.pem", "CERTIFICATE", caDER),
+		serverCertFile: writePEM("server.pem", "CERTIFICATE", serverDER),
+		serverKeyFile:  writePEM("server-key.pem", "EC PRIVATE KEY", marshalKey(serverKey)),
+		clientCert:     tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey},
+		pool:           x509.NewCertPool(),
+	}
+	certs.pool.AddCert(ca)
+	return certs
+}
+
+func TestListeners_ShareTunnels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	srv := setupListenersServer(t, &server.ServerOption{Listeners: []server.ListenerOption{
+		{Name: "internal", Addr: "127.0.0.1:0"},
+		{Name: "sidecar", Network: server.NetworkUnix, Addr: path},
+	}})
+	assert.Empty(t, srv.Addr(), "Addr should be disabled when listeners are set")
+	addrs := srv.ListenerAddrs()
+	require.Len(t, addrs, 2)
+	assert.Equal(t, path, addrs[1])
+
+	internal := dialListener(t, addrs[0])
+	sidecar := setupUnixClient(t, path)
+
+	require.NoError(t, internal.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_listeners_shared"))))
+	shouldReceiveAckBefore(t, internal, 100*time.Millisecond)
+	require.NoError(t, sidecar.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_listeners_shared"))))
+	shouldReceiveAckBefore(t, sidecar, 100*time.Millisecond)
+
+	require.NoError(t, internal.Send(pdu.Marshal(command.NewPublishMessage("BTunnel_listeners_shared", "across listeners"))))
+	shouldReceiveAckBefore(t, internal, 100*time.Millisecond)
+	tunnelName, message := shouldReceiveMessageAndAckBefore(t, sidecar, 100*time.Millisecond)
+	assert.Equal(t, "BTunnel_listeners_shared", tunnelName)
+	assert.Equal(t, "across listeners", message)
+}
+
+func TestListeners_BesidesAddr(t *testing.T) {
+	srv := setupListenersServer(t, &server.ServerOption{Addr: ":0", Listeners: []server.ListenerOption{{Addr: "127.0.0.1:0"}}})
+	assert.NotEmpty(t, srv.Addr())
+	require.Len(t, srv.ListenerAddrs(), 1)
+
+	cli := setupClient(t, srv.Addr())
+	defer cli.Stop()
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_listeners_besides"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+
+	other := dialListener(t, srv.ListenerAddrs()[0])
+	require.NoError(t, other.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_listeners_besides"))))
+	shouldReceiveAckBefore(t, other, 100*time.Millisecond)
+}
+
+func TestListeners_AllowedCIDRs(t *testing.T) {
+	spy := &helpers.AuditSpy{}
+	srv := setupListenersServer(t, &server.ServerOption{Audit: spy, Listeners: []server.ListenerOption{
+		{Name: "private", Addr: "127.0.0.1:0", AllowedCIDRs: []string{"10.0.0.0/8"}},
+		{Name: "loopback", Addr: "127.0.0.1:0", AllowedCIDRs: []string{"10.0.0.0/8", "127.0.0.0/8"}},
+	}})
+
+	shouldBeClosedBefore(t, dialListener(t, srv.ListenerAddrs()[0]), 100*time.Millisecond)
+	event := shouldAuditBefore(t, spy, audit.ConnectionRejected, 100*time.Millisecond)
+	assert.Equal(t, "listener private: address not allowed", event.Reason)
+
+	allowed := dialListener(t, srv.ListenerAddrs()[1])
+	require.NoError(t, allowed.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_listeners_unknown"))))
+	shouldReceiveNackBefore(t, allowed, 100*time.Millisecond)
+}
+
+func TestListeners_InvalidCIDR(t *testing.T) {
+	srv := server.NewServerWithOption(&server.ServerOption{Listeners: []server.ListenerOption{
+		{Addr: "127.0.0.1:0", AllowedCIDRs: []string{"not a cidr"}},
+	}})
+	assert.ErrorContains(t, srv.Start(), "invalid allowed cidr")
+}
+
+func TestListeners_MaxConnections(t *testing.T) {
+	spy := &helpers.AuditSpy{}
+	srv := setupListenersServer(t, &server.ServerOption{Audit: spy, Listeners: []server.ListenerOption{
+		{Name: "limited", Addr: "127.0.0.1:0", MaxConnections: 1},
+	}})
+	addr := srv.ListenerAddrs()[0]
+
+	first := dialListener(t, addr)
+	require.NoError(t, first.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_listeners_unknown"))))
+	shouldReceiveNackBefore(t, first, 100*time.Millisecond)
+
+	shouldBeClosedBefore(t, dialListener(t, addr), 100*time.Millisecond)
+	event := shouldAuditBefore(t, spy, audit.ConnectionRejected, 100*time.Millisecond)
+	assert.Equal(t, "listener limited: quota listener_connections", event.Reason)
+
+	// The connection is released once the first client disconnects
+	require.NoError(t, first.Close())
+	require.Eventually(t, func() bool {
+		cli := dialListener(t, addr)
+		if cli.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_listeners_unknown"))) != nil {
+			return false
+		}
+		select {
+		case cmd, open := <-cli.Commands():
+			_, ok := cmd.(*command.Nack)
+			return open && ok
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestListeners_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certs := generateCertificates(t, dir)
+	opts, err := server.ParseListenerOption("tls://127.0.0.1:0?name=public&cert=" + certs.serverCertFile +
+		"&key=" + certs.serverKeyFile + "&client-ca=" + certs.caFile)
+	require.NoError(t, err)
+	spy := &helpers.AuditSpy{}
+	srv := setupListenersServer(t, &server.ServerOption{Audit: spy, Listeners: []server.ListenerOption{opts}})
+	addr := srv.ListenerAddrs()[0]
+
+	// A client without certificate is rejected
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool})
+	if err == nil {
+		shouldBeClosedBefore(t, setupConnClient(t, conn), 100*time.Millisecond)
+	}
+	event := shouldAuditBefore(t, spy, audit.ConnectionRejected, 100*time.Millisecond)
+	assert.Contains(t, event.Reason, "listener public: tls handshake")
+
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.clientCert}})
+	require.NoError(t, err)
+	cli := setupConnClient(t, conn)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_listeners_tls"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestListeners_ReloadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certs := generateCertificates(t, dir)
+	opts, err := server.ParseListenerOption("tls://127.0.0.1:0?cert=" + certs.serverCertFile +
+		"&key=" + certs.serverKeyFile + "&client-ca=" + certs.caFile)
+	require.NoError(t, err)
+	srv := setupListenersServer(t, &server.ServerOption{Listeners: []server.ListenerOption{opts}})
+	addr := srv.ListenerAddrs()[0]
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.clientCert}})
+	require.NoError(t, err)
+	established := setupConnClient(t, conn)
+
+	// The certificates are renewed by another CA, overwriting the files
+	renewed := generateCertificates(t, t.TempDir())
+	for from, to := range map[string]string{
+		renewed.caFile: certs.caFile, renewed.serverCertFile: certs.serverCertFile, renewed.serverKeyFile: certs.serverKeyFile,
+	} {
+		content, err := os.ReadFile(from)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(to, content, 0o600))
+	}
+	require.NoError(t, srv.ReloadCertificates())
+
+	// The next handshakes use the renewed server certificate and client CA
+	_, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.clientCert}})
+	assert.Error(t, err, "the previous CA shouldn't be trusted anymore")
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: renewed.pool, Certificates: []tls.Certificate{renewed.clientCert}})
+	require.NoError(t, err)
+	cli := setupConnClient(t, conn)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_listeners_reload"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+
+	// The established connection is kept
+	require.NoError(t, established.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_listeners_reload"))))
+	shouldReceiveAckBefore(t, established, 100*time.Millisecond)
+
+	// Invalid files keep the current certificates
+	require.NoError(t, os.WriteFile(certs.serverKeyFile, []byte("invalid"), 0o600))
+	assert.ErrorContains(t, srv.ReloadCertificates(), "load tls certificate")
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: renewed.pool, Certificates: []tls.Certificate{renewed.clientCert}})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestListeners_TLSHandshakeTimeout(t *testing.T) {
+	certs := generateCertificates(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certs.serverCertFile, certs.serverKeyFile)
+	require.NoError(t, err)
+	mock.Do(t, &server.TLSHandshakeTimeout, 50*time.Millisecond)
+
+	srv := setupListenersServer(t, &server.ServerOption{Listeners: []server.ListenerOption{
+		{Addr: "127.0.0.1:0", TLS: &tls.Config{Certificates: []tls.Certificate{cert}}},
+	}})
+
+	// A client never starting the handshake is disconnected
+	cli := dialListener(t, srv.ListenerAddrs()[0])
+	shouldBeClosedBefore(t, cli, 200*time.Millisecond)
+}
+
+func TestListeners_ParseListenerOption(t *testing.T) {
+	opts, err := server.ParseListenerOption("tcp://10.0.0.1:19917?allow=10.0.0.0/8,192.168.0.0/16&max-connections=100&read-timeout=30s")
+	require.NoError(t, err)
+	assert.Equal(t, server.ListenerOption{
+		Network:        server.NetworkTCP,
+		Addr:           "10.0.0.1:19917",
+		AllowedCIDRs:   []string{"10.0.0.0/8", "192.168.0.0/16"},
+		MaxConnections: 100,
+		ReadTimeout:    30 * time.Second,
+	}, opts)
+
+	opts, err = server.ParseListenerOption("unix:///run/tunnel.sock?mode=0600&name=sidecar")
+	require.NoError(t, err)
+	assert.Equal(t, server.ListenerOption{Name: "sidecar", Network: server.NetworkUnix, Addr: "/run/tunnel.sock", Mode: 0o600}, opts)
+
+	for spec, expectedErr := range map[string]string{
+		"udp://:19917":                       "unknown scheme",
+		"tls://:19917":                       "tls requires cert and key files",
+		"tls://:19917?cert=missing&key=none": "load tls certificate",
+		"unix:///run/tunnel.sock?mode=rw":    "invalid mode",
+		"tcp://:19917?max-connections=many":  "invalid max-connections",
+		"tcp://:19917?read-timeout=forever":  "invalid read-timeout",
+	} {
+		_, err = server.ParseListenerOption(spec)
+		assert.ErrorContains(t, err, expectedErr, spec)
+	}
+}
@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/logging"
+)
+
+func TestLogging_JSONFormat(t *testing.T) {
+	var output bytes.Buffer
+	logger := logging.New(&logging.Option{Format: logging.FormatJSON, Output: &output})
+
+	logger.Info("Message sent", "client", "c1")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(output.Bytes(), &record))
+	assert.Equal(t, "Message sent", record["msg"])
+	assert.Equal(t, "c1", record["client"])
+}
+
+func TestLogging_RuntimeLevel(t *testing.T) {
+	var output bytes.Buffer
+	level := new(slog.LevelVar)
+	logger := logging.New(&logging.Option{Output: &output, Level: level})
+
+	logger.Debug("Hidden")
+	level.Set(slog.LevelDebug)
+	logger.Debug("Shown")
+
+	assert.NotContains(t, output.String(), "Hidden")
+	assert.Contains(t, output.String(), "Shown")
+}
+
+func TestLogging_PayloadRedaction(t *testing.T) {
+	var output bytes.Buffer
+	logger := logging.New(&logging.Option{Output: &output, RedactPayloads: true})
+
+	logger.Info("Received payload", logging.PayloadKey, []byte("secret"))
+
+	assert.NotContains(t, output.String(), "secret")
+	assert.Contains(t, output.String(), "[REDACTED 6 bytes]")
+}
+
+func TestLogging_PayloadTruncation(t *testing.T) {
+	var output bytes.Buffer
+	logger := logging.New(&logging.Option{Output: &output, MaxPayloadBytes: 4})
+
+	logger.Info("Received payload", logging.PayloadKey, "abcdefgh")
+	logger.Info("Received payload", logging.PayloadKey, "abc")
+
+	assert.Contains(t, output.String(), "abcd...[TRUNCATED 8 bytes]")
+	assert.NotContains(t, output.String(), "abcdefgh")
+	assert.Contains(t, output.String(), "payload=abc\n")
+}
+
+func TestLogging_Sampling(t *testing.T) {
+	var output bytes.Buffer
+	logger := logging.New(&logging.Option{
+		Output:   &output,
+		Sampling: logging.SamplingOption{First: 2, Thereafter: 3, Tick: time.Hour},
+	}).With("client", "c1")
+
+	for range 8 {
+		logger.Info("Message sent")
+	}
+	logger.Warn("Timeout") // Warnings are never sampled
+	logger.Warn("Timeout")
+	logger.Info("Other message")
+
+	// Keeps the 2 first, then the 5th and the 8th
+	assert.Equal(t, 4, strings.Count(output.String(), "Message sent"))
+	assert.Equal(t, 2, strings.Count(output.String(), "Timeout"))
+	assert.Equal(t, 1, strings.Count(output.String(), "Other message"))
+}
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/mqtt"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupMQTTServer(t *testing.T, opts *server.ServerOption) *server.Server {
+	opts.Addr = ":0"
+	opts.MQTTAddr = "127.0.0.1:0"
+	srv := server.NewServerWithOption(opts)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func setupMQTTClient(t *testing.T, srv *server.Server, clientID string) *helpers.MQTTClientSpy {
+	cli, err := helpers.NewMQTTClientSpy(srv.MQTTAddr())
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+	returnCode, err := cli.Connect(clientID)
+	require.NoError(t, err)
+	require.Equal(t, mqtt.ConnectionAccepted, returnCode)
+	return cli
+}
+
+func shouldReceivePacketBefore[P mqtt.Packet](t *testing.T, cli *helpers.MQTTClientSpy, timeout time.Duration) P {
+	select {
+	case packet := <-cli.Packets():
+		typed, ok := packet.(P)
+		require.True(t, ok, "Unexpected packet %T", packet)
+		return typed
+	case <-time.After(timeout):
+		require.FailNow(t, "Packet should have been received")
+	}
+	var zero P
+	return zero
+}
+
+func shouldNotReceivePacketBefore(t *testing.T, cli *helpers.MQTTClientSpy, timeout time.Duration) {
+	select {
+	case packet := <-cli.Packets():
+		assert.FailNow(t, "No packet should have been received", "%T", packet)
+	case <-time.After(timeout):
+	}
+}
+
+func mqttSubscribe(t *testing.T, cli *helpers.MQTTClientSpy, filter string, qos byte) byte {
+	require.NoError(t, cli.Send(&mqtt.Subscribe{PacketID: 1, Filters: []mqtt.TopicFilter{{Topic: filter, QoS: qos}}}))
+	suback := shouldReceivePacketBefore[*mqtt.Suback](t, cli, 100*time.Millisecond)
+	assert.Equal(t, uint16(1), suback.PacketID)
+	require.Len(t, suback.ReturnCodes, 1)
+	return suback.ReturnCodes[0]
+}
+
+func TestMQTT_Disabled(t *testing.T) {
+	srv := setupServer(t)
+	defer srv.Stop()
+	assert.Empty(t, srv.MQTTAddr())
+}
+
+func TestMQTT_PublishToTunnel(t *testing.T) {
+	listener := setupListenedTunnel(t, "sensors.temp")
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+
+	require.NoError(t, device.Send(&mqtt.Publish{QoS: 1, PacketID: 7, Topic: "sensors/temp", Payload: []byte("21 5")}))
+	assert.Equal(t, uint16(7), shouldReceivePacketBefore[*mqtt.Puback](t, device, 100*time.Millisecond).PacketID)
+	assert.Equal(t, "21 5", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+
+	require.NoError(t, device.Send(&mqtt.Publish{QoS: 0, Topic: "sensors/temp", Payload: []byte("22")}))
+	assert.Equal(t, "22", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	shouldNotReceivePacketBefore(t, device, 50*time.Millisecond)
+}
+
+func TestMQTT_PublishUnsupportedPayload(t *testing.T) {
+	listener := setupListenedTunnel(t, "sensors.unsupported")
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+
+	require.NoError(t, device.Send(&mqtt.Publish{QoS: 1, PacketID: 7, Topic: "sensors/unsupported", Payload: []byte(`{"temp": 21.5}`)}))
+	select {
+	case _, open := <-device.Packets():
+		assert.False(t, open, "Connection should have been closed")
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Connection should have been closed")
+	}
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+}
+
+func TestMQTT_SharesTunnelWithTunnelProtocolClients(t *testing.T) {
+	tunnelName := "sensors.humidity"
+	srv := setupMQTTServer(t, &server.ServerOption{PublishConfirm: tunnel.ConfirmAll})
+	device := setupMQTTClient(t, srv, "device")
+	cli := setupClient(t, srv.Addr())
+	defer cli.Stop()
+
+	// Subscribing creates the Tunnel
+	assert.Equal(t, byte(1), mqttSubscribe(t, device, "sensors/humidity", 1))
+	assert.Contains(t, tunnel.AllStats(), tunnelName)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "from sdk"))))
+	publish := shouldReceivePacketBefore[*mqtt.Publish](t, device, 100*time.Millisecond)
+	assert.Equal(t, "sensors/humidity", publish.Topic)
+	assert.Equal(t, byte(1), publish.QoS)
+	assert.Equal(t, "from sdk", string(publish.Payload))
+
+	// The publication is confirmed once the device acknowledged it
+	shouldNotReceiveCommandsBefore(t, cli, 50*time.Millisecond)
+	require.NoError(t, device.Send(&mqtt.Puback{PacketID: publish.PacketID}))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestMQTT_QoS0Subscription(t *testing.T) {
+	tunnelName := "sensors.qos0"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+
+	assert.Equal(t, byte(0), mqttSubscribe(t, device, "sensors/qos0", 0))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "fire and forget"))
+	publish := shouldReceivePacketBefore[*mqtt.Publish](t, device, 100*time.Millisecond)
+	assert.Equal(t, byte(0), publish.QoS)
+	assert.Equal(t, "fire and forget", string(publish.Payload))
+}
+
+func TestMQTT_QoS2DowngradedToQoS1(t *testing.T) {
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+	assert.Equal(t, byte(1), mqttSubscribe(t, device, "sensors/qos2", 2))
+}
+
+func TestMQTT_WildcardsRejected(t *testing.T) {
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+	assert.Equal(t, mqtt.SubscriptionFailure, mqttSubscribe(t, device, "sensors/+", 1))
+	assert.Equal(t, mqtt.SubscriptionFailure, mqttSubscribe(t, device, "sensors/#", 1))
+}
+
+func TestMQTT_SharedSubscription(t *testing.T) {
+	tunnelName := "sensors.shared"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	first := setupMQTTClient(t, srv, "first")
+	second := setupMQTTClient(t, srv, "second")
+	assert.Equal(t, byte(0), mqttSubscribe(t, first, "$share/workers/sensors/shared", 0))
+	assert.Equal(t, byte(0), mqttSubscribe(t, second, "$share/workers/sensors/shared", 0))
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "shared"))
+	var publish *mqtt.Publish
+	select {
+	case packet := <-first.Packets():
+		publish = packet.(*mqtt.Publish)
+	case packet := <-second.Packets():
+		publish = packet.(*mqtt.Publish)
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "Publish should have been received")
+	}
+	assert.Equal(t, "sensors/shared", publish.Topic)
+	shouldNotReceivePacketBefore(t, first, 50*time.Millisecond)
+	shouldNotReceivePacketBefore(t, second, 0)
+}
+
+func TestMQTT_Unsubscribe(t *testing.T) {
+	tunnelName := "sensors.unsubscribed"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+	mqttSubscribe(t, device, "sensors/unsubscribed", 0)
+
+	require.NoError(t, device.Send(&mqtt.Unsubscribe{PacketID: 2, Topics: []string{"sensors/unsubscribed"}}))
+	assert.Equal(t, uint16(2), shouldReceivePacketBefore[*mqtt.Unsuback](t, device, 100*time.Millisecond).PacketID)
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "not received"))
+	shouldNotReceivePacketBefore(t, device, 50*time.Millisecond)
+}
+
+func TestMQTT_Ping(t *testing.T) {
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+	require.NoError(t, device.Send(&mqtt.Pingreq{}))
+	shouldReceivePacketBefore[*mqtt.Pingresp](t, device, 100*time.Millisecond)
+}
+
+func TestMQTT_UnsupportedProtocolLevel(t *testing.T) {
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device, err := helpers.NewMQTTClientSpy(srv.MQTTAddr())
+	require.NoError(t, err)
+	defer device.Close()
+
+	require.NoError(t, device.Send(&mqtt.Connect{ProtocolName: "MQIsdp", ProtocolLevel: 3, CleanSession: true, ClientID: "old"}))
+	assert.Equal(t, mqtt.UnacceptableProtocol, shouldReceivePacketBefore[*mqtt.Connack](t, device, 100*time.Millisecond).ReturnCode)
+	_, open := <-device.Packets()
+	assert.False(t, open, "Connection should have been closed")
+}
+
+func TestMQTT_QoS2PublicationClosesConnection(t *testing.T) {
+	srv := setupMQTTServer(t, &server.ServerOption{})
+	device := setupMQTTClient(t, srv, "device")
+
+	require.NoError(t, device.Send(&mqtt.Publish{QoS: 2, PacketID: 3, Topic: "sensors/exactly_once", Payload: []byte("once")}))
+	select {
+	case _, open := <-device.Packets():
+		assert.False(t, open, "Connection should have been closed")
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Connection should have been closed")
+	}
+}
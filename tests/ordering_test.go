@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func TestOrdering_PerPublisherUnderConcurrentPublishers(t *testing.T) {
+	const nbPublishers, nbMessages = 4, 2000
+	tunnelName := "BTunnel_ordering_concurrent"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+
+	listeners := []*helpers.ListenerSpy{
+		helpers.NewListenerSpyWithCapacity("ordering_listener_1", nbPublishers*nbMessages),
+		helpers.NewListenerSpyWithCapacity("ordering_listener_2", nbPublishers*nbMessages),
+	}
+	for _, listener := range listeners {
+		require.NoError(t, tunnel.Listen(tunnelName, listener))
+		t.Cleanup(func() { tunnel.StopListen(listener.ID()) })
+	}
+
+	var wg sync.WaitGroup
+	for publisher := range nbPublishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range nbMessages {
+				assert.NoError(t, tunnel.PublishMessage("sender", tunnelName, fmt.Sprintf("%d %d", publisher, seq)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, listener := range listeners {
+		nextSeq := make([]int, nbPublishers)
+		for range nbPublishers * nbMessages {
+			var publisher, seq int
+			_, err := fmt.Sscanf(shouldNotifyBefore(t, listener, time.Second), "%d %d", &publisher, &seq)
+			require.NoError(t, err)
+			require.Equal(t, nextSeq[publisher], seq, "%s: out of order message from publisher %d", listener.ID(), publisher)
+			nextSeq[publisher]++
+		}
+	}
+}
+
+func TestOrdering_ThroughServer(t *testing.T) {
+	const nbMessages = 2000
+	tunnelName := "BTunnel_ordering_server"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+
+	srv := setupServer(t)
+	t.Cleanup(srv.Stop)
+	publisher := setupClient(t, srv.Addr())
+	t.Cleanup(publisher.Stop)
+	listener := setupClient(t, srv.Addr())
+	t.Cleanup(listener.Stop)
+
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	// The results of the goroutines are asserted by the test goroutine
+	published := make(chan error, 1)
+	acked := make(chan int, 1)
+	go func() { // Publishes back-to-back, without waiting for acks
+		for seq := range nbMessages {
+			if err := publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, fmt.Sprintf("seq %d", seq)))); err != nil {
+				published <- err
+				return
+			}
+		}
+		published <- nil
+	}()
+	go func() { // Consumes publisher acks so the server never blocks on them
+		acks := 0
+		defer func() { acked <- acks }()
+		for range nbMessages {
+			select {
+			case cmd := <-publisher.Commands():
+				if _, ok := cmd.(*command.Ack); !ok {
+					return
+				}
+				acks++
+			case <-time.After(time.Second):
+				return
+			}
+		}
+	}()
+
+	for seq := range nbMessages {
+		_, msg := shouldReceiveMessageAndAckBefore(t, listener, time.Second)
+		require.Equal(t, fmt.Sprintf("seq %d", seq), msg)
+	}
+	require.NoError(t, <-published)
+	assert.Equal(t, nbMessages, <-acked, "Every publication should have been acked")
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/codingLayce/tunnel-server/server"
 	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
 	"github.com/codingLayce/tunnel.go/pdu"
 	"github.com/codingLayce/tunnel.go/pdu/command"
 )
@@ -27,12 +28,24 @@ func setupClient(t *testing.T, addr string) *helpers.ClientSpy {
 	return cli
 }
 
+func setupListenedTunnel(t *testing.T, tunnelName string) *helpers.ListenerSpy {
+	return setupListenedTunnelWithOption(t, tunnelName, &tunnel.BroadcastOption{})
+}
+
+func setupListenedTunnelWithOption(t *testing.T, tunnelName string, opts *tunnel.BroadcastOption) *helpers.ListenerSpy {
+	require.NoError(t, tunnel.CreateBroadcastWithOption(tunnelName, opts))
+	listener := helpers.NewListenerSpy(tunnelName + "_listener")
+	require.NoError(t, tunnel.Listen(tunnelName, listener))
+	t.Cleanup(func() { tunnel.StopListen(listener.ID()) })
+	return listener
+}
+
 func setupServerAndClient(t *testing.T) (*server.Server, *helpers.ClientSpy) {
 	srv := setupServer(t)
 	return srv, setupClient(t, srv.Addr())
 }
 
-func shouldReceiveAckBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.Duration) {
+func shouldReceiveAckBefore(t *testing.T, cli helpers.Client, timeout time.Duration) {
 	select {
 	case cmd := <-cli.Commands():
 		_, ok := cmd.(*command.Ack)
@@ -42,7 +55,7 @@ func shouldReceiveAckBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.D
 	}
 }
 
-func shouldReceiveNackBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.Duration) {
+func shouldReceiveNackBefore(t *testing.T, cli helpers.Client, timeout time.Duration) {
 	select {
 	case cmd := <-cli.Commands():
 		_, ok := cmd.(*command.Nack)
@@ -52,7 +65,7 @@ func shouldReceiveNackBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.
 	}
 }
 
-func shouldReceiveMessageAndAckBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.Duration) (tunnelName, message string) {
+func shouldReceiveMessageAndAckBefore(t *testing.T, cli helpers.Client, timeout time.Duration) (tunnelName, message string) {
 	select {
 	case cmd := <-cli.Commands():
 		receiveMessage, ok := cmd.(*command.ReceiveMessage)
@@ -66,7 +79,7 @@ func shouldReceiveMessageAndAckBefore(t *testing.T, cli *helpers.ClientSpy, time
 	return "", ""
 }
 
-func shouldReceiveMessageAndNackBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.Duration) (tunnelName, message string) {
+func shouldReceiveMessageAndNackBefore(t *testing.T, cli helpers.Client, timeout time.Duration) (tunnelName, message string) {
 	select {
 	case cmd := <-cli.Commands():
 		receiveMessage, ok := cmd.(*command.ReceiveMessage)
@@ -80,10 +93,28 @@ func shouldReceiveMessageAndNackBefore(t *testing.T, cli *helpers.ClientSpy, tim
 	return "", ""
 }
 
-func shouldNotReceiveCommandsBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.Duration) {
+func shouldNotReceiveCommandsBefore(t *testing.T, cli helpers.Client, timeout time.Duration) {
 	select {
 	case <-cli.Commands():
 		assert.FailNow(t, "No commands should have been received")
 	case <-time.After(timeout):
 	}
 }
+
+func shouldNotifyBefore(t *testing.T, listener *helpers.ListenerSpy, timeout time.Duration) string {
+	select {
+	case msg := <-listener.Messages():
+		return msg
+	case <-time.After(timeout):
+		assert.FailNow(t, "Listener should have been notified", listener.ID())
+	}
+	return ""
+}
+
+func shouldNotNotifyBefore(t *testing.T, listener *helpers.ListenerSpy, timeout time.Duration) {
+	select {
+	case msg := <-listener.Messages():
+		assert.FailNow(t, "Listener shouldn't have been notified", "%s received %q", listener.ID(), msg)
+	case <-time.After(timeout):
+	}
+}
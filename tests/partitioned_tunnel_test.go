@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupPartitionedTunnel(t *testing.T, tunnelName string, nbPartitions int, listenerIDs ...string) []*helpers.ListenerSpy {
+	require.NoError(t, tunnel.CreatePartitioned(tunnelName, nbPartitions))
+	var listeners []*helpers.ListenerSpy
+	for _, id := range listenerIDs {
+		listener := helpers.NewListenerSpyWithCapacity(id, 1000)
+		require.NoError(t, tunnel.Listen(tunnelName, listener))
+		t.Cleanup(func() { tunnel.StopListen(listener.ID()) })
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// receiveFromAny collects nb messages from the listeners, indexed by listener id.
+func receiveFromAny(t *testing.T, nb int, listeners ...*helpers.ListenerSpy) map[string][]string {
+	received := make(map[string][]string)
+	for range nb {
+		select {
+		case msg := <-listeners[0].Messages():
+			received[listeners[0].ID()] = append(received[listeners[0].ID()], msg)
+		case msg := <-listeners[1].Messages():
+			received[listeners[1].ID()] = append(received[listeners[1].ID()], msg)
+		case <-time.After(time.Second):
+			require.FailNow(t, "Listeners should have been notified")
+		}
+	}
+	return received
+}
+
+func TestPartitionedTunnel_SameKeyInOrderToSingleListener(t *testing.T) {
+	const nbKeys, nbMessages = 8, 50
+	tunnelName := "PTunnel_same_key"
+	listeners := setupPartitionedTunnel(t, tunnelName, 4, "partition_listener_1", "partition_listener_2")
+
+	for seq := range nbMessages {
+		for key := range nbKeys {
+			require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{
+				SenderID: "sender",
+				Msg:      fmt.Sprintf("%d %d", key, seq),
+				Key:      fmt.Sprintf("key%d", key),
+			}))
+		}
+	}
+
+	received := receiveFromAny(t, nbKeys*nbMessages, listeners...)
+	assert.NotEmpty(t, received[listeners[0].ID()], "Partitions should be spread between listeners")
+	assert.NotEmpty(t, received[listeners[1].ID()], "Partitions should be spread between listeners")
+
+	keyOwner := make(map[int]string)
+	nextSeq := make(map[int]int)
+	for listenerID, messages := range received {
+		for _, msg := range messages {
+			var key, seq int
+			_, err := fmt.Sscanf(msg, "%d %d", &key, &seq)
+			require.NoError(t, err)
+
+			if owner, exists := keyOwner[key]; exists {
+				require.Equal(t, owner, listenerID, "Key %d delivered to several listeners", key)
+			}
+			keyOwner[key] = listenerID
+			require.Equal(t, nextSeq[key], seq, "Key %d delivered out of order", key)
+			nextSeq[key]++
+		}
+	}
+}
+
+func TestPartitionedTunnel_HeldUntilListenerRegisters(t *testing.T) {
+	tunnelName := "PTunnel_held"
+	require.NoError(t, tunnel.CreatePartitioned(tunnelName, 2))
+
+	for seq := range 3 {
+		require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: fmt.Sprintf("seq %d", seq), Key: "key"}))
+	}
+
+	listener := helpers.NewListenerSpy("partition_late_listener")
+	require.NoError(t, tunnel.Listen(tunnelName, listener))
+	t.Cleanup(func() { tunnel.StopListen(listener.ID()) })
+
+	for seq := range 3 {
+		assert.Equal(t, fmt.Sprintf("seq %d", seq), shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	}
+}
+
+func TestPartitionedTunnel_RebalanceOnUnregister(t *testing.T) {
+	const nbKeys = 8
+	tunnelName := "PTunnel_rebalance"
+	listeners := setupPartitionedTunnel(t, tunnelName, 2, "partition_rebalance_1", "partition_rebalance_2")
+
+	tunnel.StopListen(listeners[0].ID())
+
+	for key := range nbKeys {
+		require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: "msg", Key: fmt.Sprintf("key%d", key)}))
+	}
+
+	// Every partition is now assigned to the remaining listener
+	for range nbKeys {
+		shouldNotifyBefore(t, listeners[1], 100*time.Millisecond)
+	}
+	shouldNotNotifyBefore(t, listeners[0], 50*time.Millisecond)
+}
+
+func TestPartitionedTunnel_InvalidNumberOfPartitions(t *testing.T) {
+	err := tunnel.CreatePartitioned("PTunnel_invalid", 0)
+	assert.EqualError(t, err, "invalid number of partitions 0: must be at least 1")
+}
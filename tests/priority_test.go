@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/test-helper/mock"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+// setupBlockedPriorityTunnel creates a priority Tunnel whose dispatch is blocked until the first message is read from the listener.
+func setupBlockedPriorityTunnel(t *testing.T, tunnelName string) *helpers.ListenerSpy {
+	require.NoError(t, tunnel.CreateBroadcastWithOption(tunnelName, &tunnel.BroadcastOption{Priority: true}))
+
+	listener := helpers.NewListenerSpyWithCapacity(tunnelName+"_listener", 0)
+	require.NoError(t, tunnel.Listen(tunnelName, listener))
+	t.Cleanup(func() { tunnel.StopListen(listener.ID()); listener.Close() })
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "blocker"))
+	time.Sleep(10 * time.Millisecond) // Let the dispatch loop block on the listener
+	return listener
+}
+
+func TestPriority_HigherPriorityFirst(t *testing.T) {
+	tunnelName := "BTunnel_priority_order"
+	listener := setupBlockedPriorityTunnel(t, tunnelName)
+
+	for i, priority := range []uint8{0, 5, 9, 5, 0, 9} {
+		require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{
+			SenderID: "sender",
+			Msg:      fmt.Sprintf("p%d n%d", priority, i),
+			Priority: priority,
+		}))
+	}
+
+	assert.Equal(t, "blocker", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	var received []string
+	for range 6 {
+		received = append(received, shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	}
+	assert.Equal(t, []string{"p9 n2", "p9 n5", "p5 n1", "p5 n3", "p0 n0", "p0 n4"}, received)
+}
+
+func TestPriority_NoStarvationUnderLoad(t *testing.T) {
+	mock.Do(t, &tunnel.PriorityAgingStep, 10)
+	tunnelName := "BTunnel_priority_starvation"
+	listener := setupBlockedPriorityTunnel(t, tunnelName)
+
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: "low"}))
+	for i := range 200 {
+		require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{
+			SenderID: "sender",
+			Msg:      fmt.Sprintf("high %d", i),
+			Priority: tunnel.MaxPriority,
+		}))
+	}
+
+	assert.Equal(t, "blocker", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	lowPosition := -1
+	for i := range 201 {
+		if shouldNotifyBefore(t, listener, 100*time.Millisecond) == "low" {
+			lowPosition = i
+		}
+	}
+	// The low priority message is overtaken by less than MaxPriority * PriorityAgingStep newer messages
+	assert.Equal(t, tunnel.MaxPriority*10-1, lowPosition)
+}
+
+func TestPriority_InvalidPriority(t *testing.T) {
+	tunnelName := "BTunnel_priority_invalid"
+	require.NoError(t, tunnel.CreateBroadcastWithOption(tunnelName, &tunnel.BroadcastOption{Priority: true}))
+
+	err := tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: "msg", Priority: tunnel.MaxPriority + 1})
+	assert.EqualError(t, err, "invalid priority 10: cannot be greater than 9")
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupConfirmServerAndClients(t *testing.T, mode tunnel.ConfirmMode) (publisher, listener *helpers.ClientSpy) {
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", PublishConfirm: mode})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	publisher = setupClient(t, srv.Addr())
+	t.Cleanup(publisher.Stop)
+	listener = setupClient(t, srv.Addr())
+	t.Cleanup(listener.Stop)
+	return publisher, listener
+}
+
+func TestPublishConfirm_AckAfterListenerAck(t *testing.T) {
+	tunnelName := "BTunnel_confirm_ack"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	publisher, listener := setupConfirmServerAndClients(t, tunnel.ConfirmAll)
+
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "confirmed message"))))
+
+	var receiveMessage *command.ReceiveMessage
+	select {
+	case cmd := <-listener.Commands():
+		var ok bool
+		receiveMessage, ok = cmd.(*command.ReceiveMessage)
+		require.True(t, ok, "Command should be a ReceiveMessage")
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "ReceiveMessage command should have been received")
+	}
+
+	// Not acked while the listener didn't ack
+	shouldNotReceiveCommandsBefore(t, publisher, 50*time.Millisecond)
+
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewAckWithTransactionID(receiveMessage.TransactionID()))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+}
+
+func TestPublishConfirm_NackWhenListenerNack(t *testing.T) {
+	tunnelName := "BTunnel_confirm_nack"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	publisher, listener := setupConfirmServerAndClients(t, tunnel.ConfirmAll)
+
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "nacked message"))))
+
+	_, msg := shouldReceiveMessageAndNackBefore(t, listener, 100*time.Millisecond)
+	assert.Equal(t, "nacked message", msg)
+	shouldReceiveNackBefore(t, publisher, 100*time.Millisecond)
+}
+
+func TestPublishConfirm_OneWithoutListener(t *testing.T) {
+	tunnelName := "BTunnel_confirm_one_without_listener"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	publisher, _ := setupConfirmServerAndClients(t, tunnel.ConfirmOne)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "lost message"))))
+
+	shouldReceiveNackBefore(t, publisher, 100*time.Millisecond)
+}
+
+func TestPublishConfirm_OneAmongSeveralListeners(t *testing.T) {
+	tunnelName := "BTunnel_confirm_one"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	publisher, listener := setupConfirmServerAndClients(t, tunnel.ConfirmOne)
+
+	acking := helpers.NewListenerSpy("confirm_one_spy")
+	require.NoError(t, tunnel.Listen(tunnelName, acking))
+	t.Cleanup(func() { tunnel.StopListen(acking.ID()) })
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "message"))))
+
+	shouldReceiveMessageAndNackBefore(t, listener, 100*time.Millisecond)
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+}
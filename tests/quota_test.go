@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupQuotaServer(t *testing.T, quotas server.QuotaOption) *server.Server {
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", Quotas: quotas})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func shouldBeDisconnectedBefore(t *testing.T, cli *helpers.ClientSpy, timeout time.Duration) {
+	select {
+	case <-cli.Done():
+	case <-time.After(timeout):
+		assert.FailNow(t, "Client should have been disconnected")
+	}
+}
+
+// shouldBeAccepted waits for the connection to be accepted, as each one is accepted in its own goroutine.
+func shouldBeAccepted(t *testing.T, cli *helpers.ClientSpy) {
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_quota_unknown"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestQuota_MaxConnections(t *testing.T) {
+	srv := setupQuotaServer(t, server.QuotaOption{MaxConnections: 1})
+	c1 := setupClient(t, srv.Addr())
+	shouldBeAccepted(t, c1)
+
+	c2 := setupClient(t, srv.Addr())
+	t.Cleanup(c2.Stop)
+	shouldBeDisconnectedBefore(t, c2, 100*time.Millisecond)
+
+	// The connection is released on disconnection
+	c1.Stop()
+	time.Sleep(10 * time.Millisecond)
+	c3 := setupClient(t, srv.Addr())
+	t.Cleanup(c3.Stop)
+	shouldBeAccepted(t, c3)
+}
+
+func TestQuota_MaxConnectionsPerIP(t *testing.T) {
+	srv := setupQuotaServer(t, server.QuotaOption{MaxConnectionsPerIP: 2})
+	c1 := setupClient(t, srv.Addr())
+	t.Cleanup(c1.Stop)
+	c2 := setupClient(t, srv.Addr())
+	t.Cleanup(c2.Stop)
+	shouldBeAccepted(t, c1)
+	shouldBeAccepted(t, c2)
+
+	c3 := setupClient(t, srv.Addr())
+	t.Cleanup(c3.Stop)
+	shouldBeDisconnectedBefore(t, c3, 100*time.Millisecond)
+}
+
+func TestQuota_MaxTunnelsPerOwner(t *testing.T) {
+	srv := setupQuotaServer(t, server.QuotaOption{MaxTunnelsPerOwner: 1})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	// A failed creation doesn't count
+	require.NoError(t, tunnel.CreateBroadcast("BTunnel_quota_owner_existing"))
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_quota_owner_existing"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_quota_owner_1"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_quota_owner_2"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestQuota_MaxListenersPerTunnel(t *testing.T) {
+	tunnelName := "BTunnel_quota_listeners"
+	srv := setupQuotaServer(t, server.QuotaOption{MaxListenersPerTunnel: 1})
+	c1 := setupClient(t, srv.Addr())
+	t.Cleanup(c1.Stop)
+	c2 := setupClient(t, srv.Addr())
+	t.Cleanup(c2.Stop)
+
+	require.NoError(t, c1.Send(pdu.Marshal(command.NewCreateTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, c1, 100*time.Millisecond)
+
+	require.NoError(t, c1.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, c1, 100*time.Millisecond)
+	// Listening again doesn't count as another listener
+	require.NoError(t, c1.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, c1, 100*time.Millisecond)
+
+	require.NoError(t, c2.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveNackBefore(t, c2, 100*time.Millisecond)
+}
+
+func TestQuota_MaxMessageBytes(t *testing.T) {
+	tunnelName := "BTunnel_quota_message_bytes"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupQuotaServer(t, server.QuotaOption{MaxMessageBytes: 5})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "12345"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "123456"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/ratelimit"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupRateLimitedServer(t *testing.T, limits server.RateLimitOption) *server.Server {
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", RateLimits: limits})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func rateLimitedCount(scope string) int64 {
+	count, ok := metrics.RateLimited.Get(scope).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
+
+func TestRateLimit_PerClient(t *testing.T) {
+	tunnelName := "BTunnel_rate_limit_client"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupRateLimitedServer(t, server.RateLimitOption{
+		PerClient: ratelimit.Limit{Rate: 1, Burst: 2},
+	})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+	limitedBefore := rateLimitedCount("client")
+
+	for range 2 {
+		require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+		shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	}
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+	assert.Equal(t, limitedBefore+1, rateLimitedCount("client"))
+
+	// Other commands aren't limited
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestRateLimit_ClientOverride(t *testing.T) {
+	tunnelName := "BTunnel_rate_limit_client_override"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupRateLimitedServer(t, server.RateLimitOption{
+		PerClient: ratelimit.Limit{Rate: 1, Burst: 1},
+		Clients:   map[string]ratelimit.Limit{"127.0.0.1": {}, "::1": {}}, // Unlimited local clients
+	})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	for range 5 {
+		require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+		shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	}
+}
+
+func TestRateLimit_PerTunnel(t *testing.T) {
+	limitedTunnel := "BTunnel_rate_limit_tunnel"
+	otherTunnel := "BTunnel_rate_limit_tunnel_other"
+	require.NoError(t, tunnel.CreateBroadcast(limitedTunnel))
+	require.NoError(t, tunnel.CreateBroadcast(otherTunnel))
+	srv := setupRateLimitedServer(t, server.RateLimitOption{
+		Tunnels: map[string]ratelimit.Limit{limitedTunnel: {Rate: 1, Burst: 1}},
+	})
+	c1 := setupClient(t, srv.Addr())
+	t.Cleanup(c1.Stop)
+	c2 := setupClient(t, srv.Addr())
+	t.Cleanup(c2.Stop)
+
+	require.NoError(t, c1.Send(pdu.Marshal(command.NewPublishMessage(limitedTunnel, "msg"))))
+	shouldReceiveAckBefore(t, c1, 100*time.Millisecond)
+	require.NoError(t, c2.Send(pdu.Marshal(command.NewPublishMessage(limitedTunnel, "msg"))))
+	shouldReceiveNackBefore(t, c2, 100*time.Millisecond)
+	require.NoError(t, c2.Send(pdu.Marshal(command.NewPublishMessage(otherTunnel, "msg"))))
+	shouldReceiveAckBefore(t, c2, 100*time.Millisecond)
+}
+
+func TestRateLimit_GlobalRefill(t *testing.T) {
+	tunnelName := "BTunnel_rate_limit_global"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupRateLimitedServer(t, server.RateLimitOption{
+		Global: ratelimit.Limit{Rate: 20, Burst: 1},
+	})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+
+	time.Sleep(60 * time.Millisecond) // A token is added every 50ms
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
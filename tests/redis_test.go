@@ -0,0 +1,271 @@
+package tests
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/resp"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupRedisServer(t *testing.T, opts *server.ServerOption) *server.Server {
+	opts.Addr = ":0"
+	opts.RedisAddr = "127.0.0.1:0"
+	srv := server.NewServerWithOption(opts)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func setupRedisClient(t *testing.T, srv *server.Server) *helpers.RedisClientSpy {
+	cli, err := helpers.NewRedisClientSpy(srv.RedisAddr())
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func shouldReceiveReplyBefore(t *testing.T, cli *helpers.RedisClientSpy, timeout time.Duration) any {
+	select {
+	case reply, open := <-cli.Replies():
+		require.True(t, open, "Connection should be open")
+		return reply
+	case <-time.After(timeout):
+		require.FailNow(t, "Reply should have been received")
+	}
+	return nil
+}
+
+func shouldNotReceiveReplyBefore(t *testing.T, cli *helpers.RedisClientSpy, timeout time.Duration) {
+	select {
+	case reply := <-cli.Replies():
+		assert.FailNow(t, "No reply should have been received", "%v", reply)
+	case <-time.After(timeout):
+	}
+}
+
+func shouldReceiveErrorReplyBefore(t *testing.T, cli *helpers.RedisClientSpy, timeout time.Duration) resp.Error {
+	reply := shouldReceiveReplyBefore(t, cli, timeout)
+	replyErr, ok := reply.(resp.Error)
+	require.True(t, ok, "Error reply expected, got %v", reply)
+	return replyErr
+}
+
+func TestRedis_Disabled(t *testing.T) {
+	srv := setupServer(t)
+	defer srv.Stop()
+	assert.Empty(t, srv.RedisAddr())
+}
+
+func TestRedis_Ping(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.Send("PING"))
+	assert.Equal(t, resp.SimpleString("PONG"), shouldReceiveReplyBefore(t, cli, 100*time.Millisecond))
+	require.NoError(t, cli.Send("ping", "hello"))
+	assert.Equal(t, "hello", shouldReceiveReplyBefore(t, cli, 100*time.Millisecond))
+
+	// Inline command
+	require.NoError(t, cli.SendRaw([]byte("PING\r\n")))
+	assert.Equal(t, resp.SimpleString("PONG"), shouldReceiveReplyBefore(t, cli, 100*time.Millisecond))
+}
+
+func TestRedis_PublishToTunnel(t *testing.T) {
+	listener := setupListenedTunnel(t, "orders.created")
+	srv := setupRedisServer(t, &server.ServerOption{})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.Send("PUBLISH", "orders:created", "order 42"))
+	assert.Equal(t, int64(1), shouldReceiveReplyBefore(t, cli, 100*time.Millisecond))
+	assert.Equal(t, "order 42", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestRedis_PublishWithoutTunnel(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.Send("PUBLISH", "nobody:listens", "lost"))
+	assert.Equal(t, int64(0), shouldReceiveReplyBefore(t, cli, 100*time.Millisecond))
+	assert.NotContains(t, tunnel.AllStats(), "nobody.listens")
+}
+
+func TestRedis_SubscribeSharesTunnelWithTunnelProtocolClients(t *testing.T) {
+	tunnelName := "news.sport"
+	srv := setupRedisServer(t, &server.ServerOption{PublishConfirm: tunnel.ConfirmAll})
+	subscriber := setupRedisClient(t, srv)
+	cli := setupClient(t, srv.Addr())
+	defer cli.Stop()
+
+	// Subscribing creates the Tunnel
+	require.NoError(t, subscriber.Send("SUBSCRIBE", "news:sport"))
+	assert.Equal(t, []any{"subscribe", "news:sport", int64(1)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+	assert.Contains(t, tunnel.AllStats(), tunnelName)
+
+	// The message is acknowledged once written
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "goal"))))
+	assert.Equal(t, []any{"message", "news:sport", "goal"}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestRedis_Unsubscribe(t *testing.T) {
+	tunnelName := "news.weather"
+	srv := setupRedisServer(t, &server.ServerOption{})
+	subscriber := setupRedisClient(t, srv)
+
+	require.NoError(t, subscriber.Send("SUBSCRIBE", "news:weather", "news:traffic"))
+	assert.Equal(t, []any{"subscribe", "news:weather", int64(1)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+	assert.Equal(t, []any{"subscribe", "news:traffic", int64(2)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+
+	require.NoError(t, subscriber.Send("UNSUBSCRIBE", "news:weather"))
+	assert.Equal(t, []any{"unsubscribe", "news:weather", int64(1)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "not received"))
+	shouldNotReceiveReplyBefore(t, subscriber, 50*time.Millisecond)
+
+	// Without channel, unsubscribes from all of them
+	require.NoError(t, subscriber.Send("UNSUBSCRIBE"))
+	assert.Equal(t, []any{"unsubscribe", "news:traffic", int64(0)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+
+	// Back to the regular mode
+	require.NoError(t, subscriber.Send("PING"))
+	assert.Equal(t, resp.SimpleString("PONG"), shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+}
+
+func TestRedis_PatternSubscription(t *testing.T) {
+	require.NoError(t, tunnel.CreateBroadcast("metrics.cpu"))
+	require.NoError(t, tunnel.CreateBroadcast("metrics.memory"))
+	srv := setupRedisServer(t, &server.ServerOption{})
+	subscriber := setupRedisClient(t, srv)
+
+	require.NoError(t, subscriber.Send("PSUBSCRIBE", "metrics:*"))
+	assert.Equal(t, []any{"psubscribe", "metrics:*", int64(1)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+
+	require.NoError(t, tunnel.PublishMessage("sender", "metrics.memory", "42%"))
+	assert.Equal(t, []any{"pmessage", "metrics:*", "metrics:memory", "42%"}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+
+	require.NoError(t, subscriber.Send("PUNSUBSCRIBE"))
+	assert.Equal(t, []any{"punsubscribe", "metrics:*", int64(0)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+	require.NoError(t, tunnel.PublishMessage("sender", "metrics.cpu", "not received"))
+	shouldNotReceiveReplyBefore(t, subscriber, 50*time.Millisecond)
+}
+
+func TestRedis_PatternSubscriptionListensTunnelsCreatedAfterward(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{})
+	subscriber := setupRedisClient(t, srv)
+	require.NoError(t, subscriber.Send("PSUBSCRIBE", "alerts:*"))
+	assert.Equal(t, []any{"psubscribe", "alerts:*", int64(1)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+
+	require.NoError(t, tunnel.CreateBroadcast("alerts.disk"))
+	require.NoError(t, tunnel.CreateBroadcast("other.disk"))
+	require.NoError(t, tunnel.PublishMessage("sender", "other.disk", "not received"))
+	require.NoError(t, tunnel.PublishMessage("sender", "alerts.disk", "disk full"))
+	assert.Equal(t, []any{"pmessage", "alerts:*", "alerts:disk", "disk full"}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+
+	require.NoError(t, subscriber.Send("PUNSUBSCRIBE", "alerts:*"))
+	assert.Equal(t, []any{"punsubscribe", "alerts:*", int64(0)}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+	require.NoError(t, tunnel.CreateBroadcast("alerts.cpu"))
+	require.NoError(t, tunnel.PublishMessage("sender", "alerts.cpu", "not received"))
+	shouldNotReceiveReplyBefore(t, subscriber, 50*time.Millisecond)
+}
+
+func TestRedis_SubscribedMode(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{})
+	subscriber := setupRedisClient(t, srv)
+	require.NoError(t, subscriber.Send("SUBSCRIBE", "news:subscribed_mode"))
+	shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond)
+
+	require.NoError(t, subscriber.Send("PUBLISH", "news:subscribed_mode", "forbidden"))
+	assert.Contains(t, shouldReceiveErrorReplyBefore(t, subscriber, 100*time.Millisecond).Error(), "only (P)SUBSCRIBE")
+
+	require.NoError(t, subscriber.Send("PING"))
+	assert.Equal(t, []any{"pong", ""}, shouldReceiveReplyBefore(t, subscriber, 100*time.Millisecond))
+}
+
+func TestRedis_UnsupportedCommands(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.Send("GET", "key"))
+	assert.Equal(t, resp.Error("ERR unknown command 'get'"), shouldReceiveErrorReplyBefore(t, cli, 100*time.Millisecond))
+	require.NoError(t, cli.Send("PUBLISH", "channel"))
+	assert.Equal(t, resp.Error("ERR wrong number of arguments for 'publish' command"), shouldReceiveErrorReplyBefore(t, cli, 100*time.Millisecond))
+	require.NoError(t, cli.Send("SUBSCRIBE", "invalid channel"))
+	assert.Contains(t, shouldReceiveErrorReplyBefore(t, cli, 100*time.Millisecond).Error(), "cannot subscribe to 'invalid channel'")
+}
+
+func TestRedis_RejectedPublication(t *testing.T) {
+	setupListenedTunnel(t, "orders.large")
+	srv := setupRedisServer(t, &server.ServerOption{Quotas: server.QuotaOption{MaxMessageBytes: 4}})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.Send("PUBLISH", "orders:large", "too large"))
+	assert.Equal(t, resp.Error("ERR message too large"), shouldReceiveErrorReplyBefore(t, cli, 100*time.Millisecond))
+}
+
+func TestRedis_PublishUnsupportedMessage(t *testing.T) {
+	listener := setupListenedTunnel(t, "orders.unsupported")
+	srv := setupRedisServer(t, &server.ServerOption{})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.Send("PUBLISH", "orders:unsupported", `{"order": 42}`))
+	assert.Contains(t, string(shouldReceiveErrorReplyBefore(t, cli, 100*time.Millisecond)), "ERR message unsupported by the Tunnel protocol")
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+}
+
+func TestRedis_MaxConnections(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{Quotas: server.QuotaOption{MaxConnections: 1}})
+	first := setupRedisClient(t, srv)
+	require.NoError(t, first.Send("PING"))
+	shouldReceiveReplyBefore(t, first, 100*time.Millisecond)
+
+	second := setupRedisClient(t, srv)
+	assert.Equal(t, resp.Error("ERR max number of clients reached"), shouldReceiveErrorReplyBefore(t, second, 100*time.Millisecond))
+	_, open := <-second.Replies()
+	assert.False(t, open, "Connection should have been closed")
+}
+
+func TestRedis_Quit(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.Send("QUIT"))
+	assert.Equal(t, resp.SimpleString("OK"), shouldReceiveReplyBefore(t, cli, 100*time.Millisecond))
+	_, open := <-cli.Replies()
+	assert.False(t, open, "Connection should have been closed")
+}
+
+func TestRedis_NestedCommandRejected(t *testing.T) {
+	srv := setupRedisServer(t, &server.ServerOption{})
+	cli := setupRedisClient(t, srv)
+
+	require.NoError(t, cli.SendRaw([]byte(strings.Repeat("*1\r\n", 500))))
+	assert.Contains(t, shouldReceiveErrorReplyBefore(t, cli, 100*time.Millisecond).Error(), "command arguments must be bulk strings")
+	_, open := <-cli.Replies()
+	assert.False(t, open, "Connection should have been closed")
+
+	// The server keeps serving the other clients
+	other := setupRedisClient(t, srv)
+	require.NoError(t, other.Send("PING"))
+	assert.Equal(t, resp.SimpleString("PONG"), shouldReceiveReplyBefore(t, other, 100*time.Millisecond))
+}
+
+func TestRedis_ReadMaxArrayDepth(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader(strings.Repeat("*1\r\n", 100_000) + ":1\r\n"))
+	_, err := resp.Read(reader)
+	assert.ErrorIs(t, err, resp.ErrProtocol)
+
+	reader = bufio.NewReader(strings.NewReader("*2\r\n*1\r\n:1\r\n$2\r\nok\r\n"))
+	value, err := resp.Read(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []any{[]any{int64(1)}, "ok"}, value)
+}
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/ratelimit"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func TestReload_RateLimits(t *testing.T) {
+	tunnelName := "BTunnel_reload_rate_limits"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupRateLimitedServer(t, server.RateLimitOption{})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	srv.SetRateLimits(server.RateLimitOption{Global: ratelimit.Limit{Rate: 1, Burst: 1}})
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+
+	// The connection is kept across reloads
+	srv.SetRateLimits(server.RateLimitOption{})
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "msg"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestReload_Quotas(t *testing.T) {
+	srv := setupQuotaServer(t, server.QuotaOption{})
+	c1 := setupClient(t, srv.Addr())
+	t.Cleanup(c1.Stop)
+	c2 := setupClient(t, srv.Addr())
+	t.Cleanup(c2.Stop)
+	shouldBeAccepted(t, c1)
+	shouldBeAccepted(t, c2)
+
+	// Exceeding connections are kept, only new ones are rejected
+	srv.SetQuotas(server.QuotaOption{MaxConnections: 1})
+	c3 := setupClient(t, srv.Addr())
+	t.Cleanup(c3.Stop)
+	shouldBeDisconnectedBefore(t, c3, 100*time.Millisecond)
+
+	require.NoError(t, c2.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_reload_unknown"))))
+	shouldReceiveNackBefore(t, c2, 100*time.Millisecond)
+}
+
+func TestReload_Snapshot(t *testing.T) {
+	tunnelName := "BTunnel_reload_snapshot"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupRateLimitedServer(t, server.RateLimitOption{})
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	assert.Eventually(t, func() bool { return srv.Snapshot().Clients == 1 }, 100*time.Millisecond, time.Millisecond)
+	snapshot := srv.Snapshot()
+	assert.False(t, snapshot.Draining)
+	assert.Contains(t, snapshot.Tunnels, tunnelName)
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func TestScheduledMessage_PublishAfter(t *testing.T) {
+	tunnelName := "BTunnel_scheduled_after"
+	listener := setupListenedTunnel(t, tunnelName)
+
+	_, err := tunnel.PublishMessageAfter(tunnelName, tunnel.Message{SenderID: "sender", Msg: "later"}, 100*time.Millisecond)
+	require.NoError(t, err)
+
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+	assert.Equal(t, "later", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestScheduledMessage_PublishAtInDeliveryTimeOrder(t *testing.T) {
+	tunnelName := "BTunnel_scheduled_at"
+	listener := setupListenedTunnel(t, tunnelName)
+
+	now := time.Now()
+	_, err := tunnel.PublishMessageAt(tunnelName, tunnel.Message{SenderID: "sender", Msg: "third"}, now.Add(60*time.Millisecond))
+	require.NoError(t, err)
+	_, err = tunnel.PublishMessageAt(tunnelName, tunnel.Message{SenderID: "sender", Msg: "first"}, now.Add(20*time.Millisecond))
+	require.NoError(t, err)
+	_, err = tunnel.PublishMessageAt(tunnelName, tunnel.Message{SenderID: "sender", Msg: "second"}, now.Add(40*time.Millisecond))
+	require.NoError(t, err)
+
+	assert.Equal(t, "first", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Equal(t, "second", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	assert.Equal(t, "third", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+}
+
+func TestScheduledMessage_PublishAtInThePast(t *testing.T) {
+	tunnelName := "BTunnel_scheduled_past"
+	listener := setupListenedTunnel(t, tunnelName)
+
+	_, err := tunnel.PublishMessageAt(tunnelName, tunnel.Message{SenderID: "sender", Msg: "now"}, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+
+	assert.Equal(t, "now", shouldNotifyBefore(t, listener, 50*time.Millisecond))
+}
+
+func TestScheduledMessage_Cancel(t *testing.T) {
+	tunnelName := "BTunnel_scheduled_cancel"
+	listener := setupListenedTunnel(t, tunnelName)
+
+	cancelledID, err := tunnel.PublishMessageAfter(tunnelName, tunnel.Message{SenderID: "sender", Msg: "cancelled"}, 20*time.Millisecond)
+	require.NoError(t, err)
+	_, err = tunnel.PublishMessageAfter(tunnelName, tunnel.Message{SenderID: "sender", Msg: "kept"}, 40*time.Millisecond)
+	require.NoError(t, err)
+
+	require.NoError(t, tunnel.CancelScheduled(cancelledID))
+
+	assert.Equal(t, "kept", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+
+	// Cannot cancel twice
+	assert.EqualError(t, tunnel.CancelScheduled(cancelledID), `unknown scheduled message "`+cancelledID+`"`)
+}
+
+func TestScheduledMessage_PublishFailureNotConfirmed(t *testing.T) {
+	tunnelName := "BTunnel_scheduled_failure"
+	require.NoError(t, tunnel.CreateBroadcastWithOption(tunnelName, &tunnel.BroadcastOption{BufferSize: 1}))
+	listener := helpers.NewListenerSpyWithCapacity(tunnelName+"_listener", 0)
+	require.NoError(t, tunnel.Listen(tunnelName, listener))
+	t.Cleanup(func() { tunnel.StopListen(listener.ID()); listener.Close() })
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "filling"))
+
+	// The Tunnel is still full when the message is due
+	confirm := tunnel.NewConfirmation(tunnel.ConfirmOne)
+	_, err := tunnel.PublishMessageAfter(tunnelName, tunnel.Message{SenderID: "sender", Msg: "rejected", Confirm: confirm}, 20*time.Millisecond)
+	require.NoError(t, err)
+
+	select {
+	case <-confirm.Done():
+		assert.False(t, confirm.Confirmed(), "A message rejected by the Tunnel shouldn't be confirmed")
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "The confirmation should have been resolved")
+	}
+}
+
+func TestScheduledMessage_UnknownTunnel(t *testing.T) {
+	_, err := tunnel.PublishMessageAfter("BTunnel_scheduled_unknown", tunnel.Message{SenderID: "sender", Msg: "msg"}, time.Second)
+	assert.EqualError(t, err, `unknown tunnel "BTunnel_scheduled_unknown"`)
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+// setupInFlightMessage publishes a message to a listening client which doesn't acknowledge it yet.
+// Returns the listening client and the transaction id of the in-flight message.
+func setupInFlightMessage(t *testing.T, srv *server.Server, tunnelName string) (publisher, listener *helpers.ClientSpy, transactionID string) {
+	publisher = setupClient(t, srv.Addr())
+	t.Cleanup(publisher.Stop)
+	listener = setupClient(t, srv.Addr())
+	t.Cleanup(listener.Stop)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewCreateTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "inflight"))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	select {
+	case cmd := <-listener.Commands():
+		require.IsType(t, &command.ReceiveMessage{}, cmd)
+		return publisher, listener, cmd.TransactionID()
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Message should have been received")
+	}
+	return nil, nil, ""
+}
+
+func shutdownAsync(srv *server.Server, timeout time.Duration) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+	return done
+}
+
+func TestShutdown_WaitsInFlightDeliveries(t *testing.T) {
+	srv := setupServer(t)
+	publisher, listener, transactionID := setupInFlightMessage(t, srv, "BTunnel_shutdown_drain")
+
+	done := shutdownAsync(srv, time.Second)
+	assert.Eventually(t, srv.Draining, 100*time.Millisecond, time.Millisecond)
+
+	// New publications are rejected while draining
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage("BTunnel_shutdown_drain", "rejected"))))
+	shouldReceiveNackBefore(t, publisher, 100*time.Millisecond)
+
+	select {
+	case <-done:
+		assert.FailNow(t, "Shutdown should wait for the in-flight message")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewAckWithTransactionID(transactionID))))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Shutdown should complete once the in-flight message is acknowledged")
+	}
+	shouldBeDisconnectedBefore(t, listener, 100*time.Millisecond)
+	shouldBeDisconnectedBefore(t, publisher, 100*time.Millisecond)
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	srv := setupServer(t)
+	_, listener, _ := setupInFlightMessage(t, srv, "BTunnel_shutdown_deadline")
+
+	select {
+	case err := <-shutdownAsync(srv, 50*time.Millisecond):
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(200 * time.Millisecond):
+		assert.FailNow(t, "Shutdown should complete at its deadline")
+	}
+	shouldBeDisconnectedBefore(t, listener, 100*time.Millisecond)
+}
+
+func TestShutdown_RejectsNewConnections(t *testing.T) {
+	srv := setupServer(t)
+	setupInFlightMessage(t, srv, "BTunnel_shutdown_connections")
+
+	done := shutdownAsync(srv, 200*time.Millisecond)
+	assert.Eventually(t, srv.Draining, 100*time.Millisecond, time.Millisecond)
+
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+	shouldBeDisconnectedBefore(t, cli, 100*time.Millisecond)
+	<-done
+}
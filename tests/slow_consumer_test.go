@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/audit"
+	"github.com/codingLayce/tunnel-server/metrics"
+	"github.com/codingLayce/tunnel-server/mqtt"
+	"github.com/codingLayce/tunnel-server/resp"
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/stomp"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+	"github.com/codingLayce/tunnel.go/test-helper/mock"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupSlowConsumerServer(t *testing.T, tunnelName string, opts server.SlowConsumerOption) *helpers.ClientSpy {
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", SlowConsumer: opts})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	cli := setupClient(t, srv.Addr())
+	t.Cleanup(cli.Stop)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	return cli
+}
+
+func TestSlowConsumer_Evicted(t *testing.T) {
+	tunnelName := "BTunnel_slow_consumer_evicted"
+	cli := setupSlowConsumerServer(t, tunnelName, server.SlowConsumerOption{MaxPending: 1, Grace: 50 * time.Millisecond})
+	evictedBefore := metrics.SlowConsumersEvicted.Value()
+
+	for range 3 {
+		require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "msg"))
+	}
+	// Reads the first message without acknowledging it: the two others stay pending
+	select {
+	case cmd := <-cli.Commands():
+		require.IsType(t, &command.ReceiveMessage{}, cmd)
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Message should have been received")
+	}
+
+	shouldBeDisconnectedBefore(t, cli, 300*time.Millisecond)
+	assert.Equal(t, evictedBefore+1, metrics.SlowConsumersEvicted.Value())
+}
+
+func TestSlowConsumer_KeepingUp(t *testing.T) {
+	tunnelName := "BTunnel_slow_consumer_keeping_up"
+	cli := setupSlowConsumerServer(t, tunnelName, server.SlowConsumerOption{MaxPending: 1, Grace: 200 * time.Millisecond})
+
+	// Above the threshold for less than the grace period
+	for range 3 {
+		require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "msg"))
+	}
+	for range 3 {
+		shouldReceiveMessageAndAckBefore(t, cli, 100*time.Millisecond)
+	}
+
+	select {
+	case <-cli.Done():
+		assert.FailNow(t, "Client should not have been evicted")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestSlowConsumer_WriteTimeout(t *testing.T) {
+	mock.Do(t, &server.WriteTimeout, 50*time.Millisecond)
+	tunnelName := "BTunnel_write_timeout"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	spy := &helpers.AuditSpy{}
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: "127.0.0.1:0", Audit: spy})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+
+	// A client listening to the Tunnel, then never reading its connection
+	conn, err := net.Dial("tcp", srv.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.(*net.TCPConn).SetReadBuffer(4096))
+	_, err = conn.Write(pdu.Marshal(command.NewListenTunnel(tunnelName)))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	ack, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	cmd, err := pdu.Unmarshal(ack)
+	require.NoError(t, err)
+	require.IsType(t, &command.Ack{}, cmd)
+
+	// Larger than the socket buffers: its write cannot complete
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, strings.Repeat("x", 8<<20)))
+
+	event := shouldAuditBefore(t, spy, audit.ForcedDisconnect, 5*time.Second)
+	assert.Contains(t, event.Reason, "write failure")
+	assert.Eventually(t, func() bool { return srv.Snapshot().Clients == 0 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return tunnel.AllStats()[tunnelName].BufferDepth == 0 }, time.Second, time.Millisecond,
+		"The messages of the evicted client should be released")
+}
+
+var slowConsumerOption = server.SlowConsumerOption{MaxPending: 1, Grace: 50 * time.Millisecond}
+
+func TestSlowConsumer_MQTTEvicted(t *testing.T) {
+	tunnelName := "slow.mqtt"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupMQTTServer(t, &server.ServerOption{SlowConsumer: slowConsumerOption})
+	subscriber := setupMQTTClient(t, srv, "slow")
+	require.Equal(t, byte(1), mqttSubscribe(t, subscriber, "slow/mqtt", 1))
+	evictedBefore := metrics.SlowConsumersEvicted.Value()
+
+	// Never acknowledges the first message: the two others stay pending
+	for range 3 {
+		require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "msg"))
+	}
+	shouldReceivePacketBefore[*mqtt.Publish](t, subscriber, 100*time.Millisecond)
+
+	assert.Eventually(t, func() bool { return metrics.SlowConsumersEvicted.Value() == evictedBefore+1 }, 300*time.Millisecond, time.Millisecond)
+	select {
+	case _, open := <-subscriber.Packets():
+		assert.False(t, open, "Connection should have been closed")
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Connection should have been closed")
+	}
+}
+
+func TestSlowConsumer_STOMPEvicted(t *testing.T) {
+	tunnelName := "slow.stomp"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupSTOMPServer(t, &server.ServerOption{SlowConsumer: slowConsumerOption})
+	subscriber := setupSTOMPClient(t, srv)
+	stompSubscribe(t, subscriber, "sub", "/slow/stomp", "client-individual")
+	evictedBefore := metrics.SlowConsumersEvicted.Value()
+
+	for range 3 {
+		require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "msg"))
+	}
+	shouldReceiveSTOMPFrameBefore(t, subscriber, stomp.CommandMessage, 100*time.Millisecond)
+
+	shouldBeSTOMPDisconnectedBefore(t, subscriber, 300*time.Millisecond)
+	assert.Equal(t, evictedBefore+1, metrics.SlowConsumersEvicted.Value())
+}
+
+// bigMessage fills the socket buffers of a client not reading its messages in a few publications.
+var bigMessage = strings.Repeat("x", 1<<20)
+
+func TestSlowConsumer_RedisEvicted(t *testing.T) {
+	tunnelName := "slow.redis"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupRedisServer(t, &server.ServerOption{SlowConsumer: slowConsumerOption})
+	evictedBefore := metrics.SlowConsumersEvicted.Value()
+
+	// A subscriber never reading its messages once subscribed (the client spy would buffer them)
+	conn, err := net.Dial("tcp", srv.RedisAddr())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.(*net.TCPConn).SetReadBuffer(4096))
+	_, err = conn.Write(resp.AppendCommand(nil, "SUBSCRIBE", "slow:redis"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = resp.Read(bufio.NewReader(conn))
+	require.NoError(t, err)
+
+	for range 32 {
+		require.NoError(t, tunnel.PublishMessage("sender", tunnelName, bigMessage))
+	}
+
+	assert.Eventually(t, func() bool { return metrics.SlowConsumersEvicted.Value() == evictedBefore+1 }, time.Second, time.Millisecond)
+}
+
+func TestSlowConsumer_EventSubscriberEvicted(t *testing.T) {
+	tunnelName := "BTunnel_slow_consumer_sse"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupHTTPServer(t, &server.ServerOption{SlowConsumer: slowConsumerOption})
+	resp, err := http.Get("http://" + srv.HTTPAddr() + "/tunnels/" + tunnelName + "/events")
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	evictedBefore := metrics.SlowConsumersEvicted.Value()
+
+	// Waits for a first event, as the Tunnel is listened once the headers sent
+	listening := make(chan struct{})
+	go func() {
+		for {
+			tunnel.PublishMessage("sender", tunnelName, "ready")
+			select {
+			case <-listening:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	_, err = bufio.NewReader(resp.Body).ReadString('\n')
+	close(listening)
+	require.NoError(t, err)
+
+	// The subscriber doesn't read its events anymore
+	for range 32 {
+		require.NoError(t, tunnel.PublishMessage("sender", tunnelName, bigMessage))
+	}
+
+	assert.Eventually(t, func() bool { return metrics.SlowConsumersEvicted.Value() == evictedBefore+1 }, time.Second, time.Millisecond)
+}
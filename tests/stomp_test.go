@@ -0,0 +1,236 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/stomp"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupSTOMPServer(t *testing.T, opts *server.ServerOption) *server.Server {
+	opts.Addr = ":0"
+	opts.STOMPAddr = "127.0.0.1:0"
+	srv := server.NewServerWithOption(opts)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func setupSTOMPClient(t *testing.T, srv *server.Server) *helpers.STOMPClientSpy {
+	cli, err := helpers.NewSTOMPClientSpy(srv.STOMPAddr())
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+	connected, err := cli.Connect()
+	require.NoError(t, err)
+	require.Equal(t, stomp.CommandConnected, connected.Command, connected.Header("message"))
+	return cli
+}
+
+func shouldReceiveSTOMPFrameBefore(t *testing.T, cli *helpers.STOMPClientSpy, command string, timeout time.Duration) *stomp.Frame {
+	select {
+	case frame, open := <-cli.Frames():
+		require.True(t, open, "Connection should be open")
+		require.Equal(t, command, frame.Command, "Unexpected frame: %s", frame.Header("message"))
+		return frame
+	case <-time.After(timeout):
+		require.FailNow(t, "Frame should have been received", command)
+	}
+	return nil
+}
+
+func shouldNotReceiveSTOMPFrameBefore(t *testing.T, cli *helpers.STOMPClientSpy, timeout time.Duration) {
+	select {
+	case frame := <-cli.Frames():
+		assert.FailNow(t, "No frame should have been received", "%v", frame)
+	case <-time.After(timeout):
+	}
+}
+
+func shouldBeSTOMPDisconnectedBefore(t *testing.T, cli *helpers.STOMPClientSpy, timeout time.Duration) {
+	select {
+	case frame, open := <-cli.Frames():
+		assert.False(t, open, "Connection should have been closed, received %v", frame)
+	case <-time.After(timeout):
+		assert.FailNow(t, "Connection should have been closed")
+	}
+}
+
+func stompSubscribe(t *testing.T, cli *helpers.STOMPClientSpy, subscriptionID, destination, ackMode string) {
+	require.NoError(t, cli.Send(stomp.NewFrame(stomp.CommandSubscribe,
+		"id", subscriptionID, "destination", destination, "ack", ackMode, "receipt", "sub-"+subscriptionID)))
+	receipt := shouldReceiveSTOMPFrameBefore(t, cli, stomp.CommandReceipt, 100*time.Millisecond)
+	assert.Equal(t, "sub-"+subscriptionID, receipt.Header("receipt-id"))
+}
+
+func TestSTOMP_Disabled(t *testing.T) {
+	srv := setupServer(t)
+	defer srv.Stop()
+	assert.Empty(t, srv.STOMPAddr())
+}
+
+func TestSTOMP_Connect(t *testing.T) {
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	cli, err := helpers.NewSTOMPClientSpy(srv.STOMPAddr())
+	require.NoError(t, err)
+	defer cli.Close()
+
+	connected, err := cli.Connect()
+	require.NoError(t, err)
+	assert.Equal(t, stomp.CommandConnected, connected.Command)
+	assert.Equal(t, "1.2", connected.Header("version"))
+	assert.Equal(t, "0,0", connected.Header("heart-beat"))
+}
+
+func TestSTOMP_UnsupportedVersion(t *testing.T) {
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	cli, err := helpers.NewSTOMPClientSpy(srv.STOMPAddr())
+	require.NoError(t, err)
+	defer cli.Close()
+
+	require.NoError(t, cli.Send(stomp.NewFrame(stomp.CommandConnect, "accept-version", "1.0,1.1")))
+	errFrame := shouldReceiveSTOMPFrameBefore(t, cli, stomp.CommandError, 100*time.Millisecond)
+	assert.Equal(t, "Supported protocol versions are 1.2", errFrame.Header("message"))
+	shouldBeSTOMPDisconnectedBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestSTOMP_SendToTunnel(t *testing.T) {
+	listener := setupListenedTunnel(t, "orders.stomp")
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	cli := setupSTOMPClient(t, srv)
+
+	send := stomp.NewFrame(stomp.CommandSend, "destination", "/orders/stomp", "receipt", "r1")
+	send.Body = []byte("order 42")
+	require.NoError(t, cli.Send(send))
+	assert.Equal(t, "r1", shouldReceiveSTOMPFrameBefore(t, cli, stomp.CommandReceipt, 100*time.Millisecond).Header("receipt-id"))
+	assert.Equal(t, "order 42", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+
+	// Raw frame preceded by heart-beats, without content-length nor receipt
+	require.NoError(t, cli.SendRaw([]byte("\n\r\nSEND\ndestination:orders.stomp\n\nraw order\x00")))
+	assert.Equal(t, "raw order", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	shouldNotReceiveSTOMPFrameBefore(t, cli, 50*time.Millisecond)
+}
+
+func TestSTOMP_SendUnsupportedBody(t *testing.T) {
+	listener := setupListenedTunnel(t, "orders.stomp_unsupported")
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	cli := setupSTOMPClient(t, srv)
+
+	send := stomp.NewFrame(stomp.CommandSend, "destination", "/orders/stomp_unsupported", "receipt", "r1")
+	send.Body = []byte(`{"order": 42}`)
+	require.NoError(t, cli.Send(send))
+	errFrame := shouldReceiveSTOMPFrameBefore(t, cli, stomp.CommandError, 100*time.Millisecond)
+	assert.Equal(t, "r1", errFrame.Header("receipt-id"))
+	assert.Contains(t, errFrame.Header("message"), "Message unsupported by the Tunnel protocol")
+	shouldBeSTOMPDisconnectedBefore(t, cli, 100*time.Millisecond)
+	shouldNotNotifyBefore(t, listener, 50*time.Millisecond)
+}
+
+func TestSTOMP_SendToUnknownDestination(t *testing.T) {
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	cli := setupSTOMPClient(t, srv)
+
+	send := stomp.NewFrame(stomp.CommandSend, "destination", "/nowhere/stomp", "receipt", "r1")
+	send.Body = []byte("order 42")
+	require.NoError(t, cli.Send(send))
+	errFrame := shouldReceiveSTOMPFrameBefore(t, cli, stomp.CommandError, 100*time.Millisecond)
+	assert.Equal(t, "r1", errFrame.Header("receipt-id"))
+	assert.Contains(t, errFrame.Header("message"), "unknown tunnel")
+	shouldBeSTOMPDisconnectedBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestSTOMP_SubscribeAutoAck(t *testing.T) {
+	tunnelName := "news.stomp_auto"
+	srv := setupSTOMPServer(t, &server.ServerOption{PublishConfirm: tunnel.ConfirmAll})
+	subscriber := setupSTOMPClient(t, srv)
+	cli := setupClient(t, srv.Addr())
+	defer cli.Stop()
+
+	// Subscribing creates the Tunnel
+	stompSubscribe(t, subscriber, "0", "/news/stomp_auto", "auto")
+	assert.Contains(t, tunnel.AllStats(), tunnelName)
+
+	// The message is acknowledged once written
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "headline"))))
+	message := shouldReceiveSTOMPFrameBefore(t, subscriber, stomp.CommandMessage, 100*time.Millisecond)
+	assert.Equal(t, "0", message.Header("subscription"))
+	assert.Equal(t, "/news/stomp_auto", message.Header("destination"))
+	assert.NotEmpty(t, message.Header("message-id"))
+	assert.Empty(t, message.Header("ack"))
+	assert.Equal(t, "headline", string(message.Body))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestSTOMP_SubscribeClientAck(t *testing.T) {
+	tunnelName := "news.stomp_client"
+	srv := setupSTOMPServer(t, &server.ServerOption{PublishConfirm: tunnel.ConfirmAll})
+	subscriber := setupSTOMPClient(t, srv)
+	cli := setupClient(t, srv.Addr())
+	defer cli.Stop()
+	stompSubscribe(t, subscriber, "sub", "/news/stomp_client", "client-individual")
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "acked"))))
+	message := shouldReceiveSTOMPFrameBefore(t, subscriber, stomp.CommandMessage, 100*time.Millisecond)
+	require.NotEmpty(t, message.Header("ack"))
+
+	// The publication is confirmed once the subscriber acknowledged the message
+	shouldNotReceiveCommandsBefore(t, cli, 50*time.Millisecond)
+	require.NoError(t, subscriber.Send(stomp.NewFrame(stomp.CommandAck, "id", message.Header("ack"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "nacked"))))
+	message = shouldReceiveSTOMPFrameBefore(t, subscriber, stomp.CommandMessage, 100*time.Millisecond)
+	require.NoError(t, subscriber.Send(stomp.NewFrame(stomp.CommandNack, "id", message.Header("ack"), "receipt", "n1")))
+	assert.Equal(t, "n1", shouldReceiveSTOMPFrameBefore(t, subscriber, stomp.CommandReceipt, 100*time.Millisecond).Header("receipt-id"))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestSTOMP_Unsubscribe(t *testing.T) {
+	tunnelName := "news.stomp_unsubscribed"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	subscriber := setupSTOMPClient(t, srv)
+	stompSubscribe(t, subscriber, "0", tunnelName, "auto")
+
+	require.NoError(t, subscriber.Send(stomp.NewFrame(stomp.CommandUnsubscribe, "id", "0", "receipt", "u1")))
+	assert.Equal(t, "u1", shouldReceiveSTOMPFrameBefore(t, subscriber, stomp.CommandReceipt, 100*time.Millisecond).Header("receipt-id"))
+
+	require.NoError(t, tunnel.PublishMessage("sender", tunnelName, "not received"))
+	shouldNotReceiveSTOMPFrameBefore(t, subscriber, 50*time.Millisecond)
+}
+
+func TestSTOMP_TransactionsNotSupported(t *testing.T) {
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	cli := setupSTOMPClient(t, srv)
+
+	require.NoError(t, cli.Send(stomp.NewFrame(stomp.CommandBegin, "transaction", "tx1")))
+	assert.Equal(t, "Transactions not supported", shouldReceiveSTOMPFrameBefore(t, cli, stomp.CommandError, 100*time.Millisecond).Header("message"))
+	shouldBeSTOMPDisconnectedBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestSTOMP_Disconnect(t *testing.T) {
+	srv := setupSTOMPServer(t, &server.ServerOption{})
+	cli := setupSTOMPClient(t, srv)
+
+	require.NoError(t, cli.Send(stomp.NewFrame(stomp.CommandDisconnect, "receipt", "bye")))
+	assert.Equal(t, "bye", shouldReceiveSTOMPFrameBefore(t, cli, stomp.CommandReceipt, 100*time.Millisecond).Header("receipt-id"))
+	shouldBeSTOMPDisconnectedBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestSTOMP_HeaderEscaping(t *testing.T) {
+	frame := stomp.NewFrame(stomp.CommandMessage, "key:with", "line\nbreak")
+	assert.Equal(t, "MESSAGE\nkey\\cwith:line\\nbreak\n\n\x00", string(stomp.Marshal(frame)))
+
+	// CONNECT headers aren't escaped
+	frame = stomp.NewFrame(stomp.CommandConnect, "passcode", "a:b")
+	assert.Equal(t, "CONNECT\npasscode:a:b\n\n\x00", string(stomp.Marshal(frame)))
+}
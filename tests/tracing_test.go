@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupMemoryExporter(t *testing.T) *tracing.MemoryExporter {
+	exporter := tracing.NewMemoryExporter()
+	tracing.SetExporter(exporter)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+	return exporter
+}
+
+// spanNamed returns the first exported span with the given name.
+func spanNamed(t *testing.T, exporter *tracing.MemoryExporter, name string) tracing.Span {
+	var found tracing.Span
+	require.Eventually(t, func() bool {
+		for _, span := range exporter.Spans() {
+			if span.Name == name {
+				found = span
+				return true
+			}
+		}
+		return false
+	}, 100*time.Millisecond, time.Millisecond, "Span %q should have been exported", name)
+	return found
+}
+
+func TestTracing_ParseTraceParent(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := tracing.ParseTraceParent(traceParent)
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, traceParent, sc.TraceParent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err = tracing.ParseTraceParent(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTracing_PropagatesPublisherTrace(t *testing.T) {
+	tunnelName := "BTunnel_tracing_propagation"
+	exporter := setupMemoryExporter(t)
+	listener := setupListenedTunnel(t, tunnelName)
+	parent, err := tracing.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: "traced", Trace: parent}))
+	assert.Equal(t, "traced", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+
+	route := spanNamed(t, exporter, "route")
+	deliver := spanNamed(t, exporter, "deliver")
+	assert.Equal(t, parent.TraceID.String(), route.TraceID)
+	assert.Equal(t, parent.SpanID.String(), route.ParentSpanID)
+	assert.Equal(t, tunnelName, route.Attributes["tunnel"])
+	assert.Equal(t, "1", route.Attributes["recipients"])
+	assert.Equal(t, parent.TraceID.String(), deliver.TraceID)
+	assert.Equal(t, route.SpanID, deliver.ParentSpanID)
+	assert.Equal(t, listener.ID(), deliver.Attributes["listener"])
+	assert.Equal(t, "true", deliver.Attributes["acked"])
+}
+
+func TestTracing_NotSampled(t *testing.T) {
+	tunnelName := "BTunnel_tracing_not_sampled"
+	exporter := setupMemoryExporter(t)
+	listener := setupListenedTunnel(t, tunnelName)
+	parent, err := tracing.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	require.NoError(t, err)
+
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: "untraced", Trace: parent}))
+	assert.Equal(t, "untraced", shouldNotifyBefore(t, listener, 100*time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, exporter.Spans())
+}
+
+func TestTracing_ServerSpans(t *testing.T) {
+	tunnelName := "BTunnel_tracing_server"
+	exporter := setupMemoryExporter(t)
+	srv := setupServer(t)
+	t.Cleanup(srv.Stop)
+	publisher := setupClient(t, srv.Addr())
+	t.Cleanup(publisher.Stop)
+	listener := setupClient(t, srv.Addr())
+	t.Cleanup(listener.Stop)
+
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewCreateTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	require.NoError(t, listener.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, listener, 100*time.Millisecond)
+	require.NoError(t, publisher.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "traced"))))
+	shouldReceiveAckBefore(t, publisher, 100*time.Millisecond)
+	shouldReceiveMessageAndAckBefore(t, listener, 100*time.Millisecond)
+
+	receive := spanNamed(t, exporter, "receive")
+	route := spanNamed(t, exporter, "route")
+	deliver := spanNamed(t, exporter, "deliver")
+	ack := spanNamed(t, exporter, "ack")
+	for _, span := range []tracing.Span{route, deliver, ack} {
+		assert.Equal(t, receive.TraceID, span.TraceID)
+	}
+	assert.Empty(t, receive.ParentSpanID)
+	assert.Equal(t, receive.SpanID, route.ParentSpanID)
+	assert.Equal(t, route.SpanID, deliver.ParentSpanID)
+	assert.Equal(t, deliver.SpanID, ack.ParentSpanID)
+	assert.Equal(t, "ack", ack.Attributes["outcome"])
+}
+
+func TestTracing_FileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	exporter, err := tracing.NewFileExporter(path)
+	require.NoError(t, err)
+	tracing.SetExporter(exporter)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+
+	span := tracing.Start(tracing.SpanContext{}, "operation")
+	span.SetAttribute("key", "value")
+	span.End()
+	require.NoError(t, exporter.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	require.True(t, scanner.Scan())
+	var exported tracing.Span
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &exported))
+	assert.Equal(t, "operation", exported.Name)
+	assert.Equal(t, span.Context().TraceID.String(), exported.TraceID)
+	assert.Equal(t, "value", exported.Attributes["key"])
+	assert.False(t, scanner.Scan(), "Only one span should have been exported")
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupUnixClient(t *testing.T, path string) *helpers.ConnClientSpy {
+	cli, err := helpers.NewUnixClientSpy(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func TestUnixSocket_Disabled(t *testing.T) {
+	srv := setupServer(t)
+	defer srv.Stop()
+	assert.Empty(t, srv.UnixSocketPath())
+}
+
+func TestUnixSocket_SharesTunnelsWithTCPClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", UnixSocketPath: path, UnixSocketMode: 0o600})
+	require.NoError(t, srv.Start())
+	defer srv.Stop()
+	assert.Equal(t, path, srv.UnixSocketPath())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	sidecar := setupUnixClient(t, path)
+	tcpClient := setupClient(t, srv.Addr())
+	defer tcpClient.Stop()
+
+	require.NoError(t, sidecar.Send(pdu.Marshal(command.NewCreateTunnel("BTunnel_unix"))))
+	shouldReceiveAckBefore(t, sidecar, 100*time.Millisecond)
+	require.NoError(t, tcpClient.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_unix"))))
+	shouldReceiveAckBefore(t, tcpClient, 100*time.Millisecond)
+
+	require.NoError(t, sidecar.Send(pdu.Marshal(command.NewPublishMessage("BTunnel_unix", "from sidecar"))))
+	shouldReceiveAckBefore(t, sidecar, 100*time.Millisecond)
+	tunnelName, message := shouldReceiveMessageAndAckBefore(t, tcpClient, 100*time.Millisecond)
+	assert.Equal(t, "BTunnel_unix", tunnelName)
+	assert.Equal(t, "from sidecar", message)
+}
+
+func TestUnixSocket_InsteadOfTCP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	srv := server.NewServerWithOption(&server.ServerOption{UnixSocketPath: path})
+	require.NoError(t, srv.Start())
+	assert.Empty(t, srv.Addr())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, server.DefaultUnixSocketMode, info.Mode().Perm())
+
+	cli := setupUnixClient(t, path)
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_unix_unknown"))))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+
+	// Stopping closes the connections and removes the socket file
+	srv.Stop()
+	select {
+	case <-srv.Done():
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Server should be stopped")
+	}
+	_, open := <-cli.Commands()
+	assert.False(t, open, "Connection should have been closed")
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUnixSocket_ConnectionsHaveTheirOwnIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	srv := server.NewServerWithOption(&server.ServerOption{
+		UnixSocketPath: path,
+		Quotas:         server.QuotaOption{MaxConnectionsPerIP: 1},
+	})
+	require.NoError(t, srv.Start())
+	defer srv.Stop()
+
+	first := setupUnixClient(t, path)
+	second := setupUnixClient(t, path)
+	for _, cli := range []*helpers.ConnClientSpy{first, second} {
+		require.NoError(t, cli.Send(pdu.Marshal(command.NewListenTunnel("BTunnel_unix_identity"))))
+		shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+	}
+}
+
+func TestUnixSocket_ReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	srv := server.NewServerWithOption(&server.ServerOption{UnixSocketPath: path})
+	require.NoError(t, srv.Start())
+	defer srv.Stop()
+	setupUnixClient(t, path)
+}
+
+func TestUnixSocket_RefusesToReplaceRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	require.NoError(t, os.WriteFile(path, []byte("not a socket"), 0o600))
+
+	srv := server.NewServerWithOption(&server.ServerOption{UnixSocketPath: path})
+	assert.ErrorContains(t, srv.Start(), "isn't a socket")
+}
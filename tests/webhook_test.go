@@ -0,0 +1,261 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel-server/webhook"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+type webhookRequest struct {
+	header http.Header
+	body   string
+}
+
+// setupWebhookReceiver records the requests, responding with the status returned by respond for each attempt (starting at 1).
+func setupWebhookReceiver(t *testing.T, respond func(attempt int) int) (*httptest.Server, <-chan webhookRequest) {
+	requests := make(chan webhookRequest, 100)
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- webhookRequest{header: r.Header, body: string(body)}
+		w.WriteHeader(respond(int(attempts.Add(1))))
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver, requests
+}
+
+func setupWebhook(t *testing.T, tunnelName string, opts *webhook.Option) *webhook.Subscription {
+	sub, err := webhook.Subscribe(tunnelName, opts)
+	require.NoError(t, err)
+	t.Cleanup(sub.Close)
+	return sub
+}
+
+func shouldReceiveWebhookBefore(t *testing.T, requests <-chan webhookRequest, timeout time.Duration) webhookRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(timeout):
+		assert.FailNow(t, "Webhook should have been called")
+	}
+	return webhookRequest{}
+}
+
+func publishConfirmed(t *testing.T, tunnelName, message string) *tunnel.Confirmation {
+	confirm := tunnel.NewConfirmation(tunnel.ConfirmAll)
+	require.NoError(t, tunnel.Publish(tunnelName, tunnel.Message{SenderID: "sender", Msg: message, Confirm: confirm}))
+	return confirm
+}
+
+func shouldBeConfirmedBefore(t *testing.T, confirm *tunnel.Confirmation, confirmed bool, timeout time.Duration) {
+	select {
+	case <-confirm.Done():
+		assert.Equal(t, confirmed, confirm.Confirmed())
+	case <-time.After(timeout):
+		assert.FailNow(t, "Publication should have been confirmed or not")
+	}
+}
+
+func TestWebhook_DeliversSignedMessage(t *testing.T) {
+	tunnelName := "BTunnel_webhook_signed"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	receiver, requests := setupWebhookReceiver(t, func(int) int { return http.StatusNoContent })
+	setupWebhook(t, tunnelName, &webhook.Option{URL: receiver.URL, Secret: "s3cr3t"})
+
+	confirm := publishConfirmed(t, tunnelName, "signed message")
+	req := shouldReceiveWebhookBefore(t, requests, 100*time.Millisecond)
+	assert.Equal(t, "signed message", req.body)
+	assert.Equal(t, tunnelName, req.header.Get(webhook.TunnelHeader))
+	assert.NotEmpty(t, req.header.Get(webhook.DeliveryHeader))
+	timestamp, signature := req.header.Get(webhook.TimestampHeader), req.header.Get(webhook.SignatureHeader)
+	assert.True(t, webhook.Verify("s3cr3t", []byte(req.body), timestamp, signature))
+	assert.False(t, webhook.Verify("other", []byte(req.body), timestamp, signature))
+	assert.False(t, webhook.Verify("s3cr3t", []byte("tampered"), timestamp, signature))
+	shouldBeConfirmedBefore(t, confirm, true, 100*time.Millisecond)
+}
+
+func TestWebhook_VerifyRejectsReplays(t *testing.T) {
+	body := []byte("replayed")
+	old := strconv.FormatInt(time.Now().Add(-webhook.SignatureTolerance-time.Minute).Unix(), 10)
+	assert.False(t, webhook.Verify("s3cr3t", body, old, webhook.Sign("s3cr3t", old, body)))
+
+	// The timestamp is signed: it cannot be refreshed
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	assert.False(t, webhook.Verify("s3cr3t", body, now, webhook.Sign("s3cr3t", old, body)))
+	assert.True(t, webhook.Verify("s3cr3t", body, now, webhook.Sign("s3cr3t", now, body)))
+	assert.False(t, webhook.Verify("s3cr3t", body, "not a timestamp", webhook.Sign("s3cr3t", "not a timestamp", body)))
+}
+
+func TestWebhook_RedirectNotFollowed(t *testing.T) {
+	tunnelName := "BTunnel_webhook_redirect"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	_, requests := setupWebhookReceiver(t, func(int) int { return http.StatusOK })
+	redirecting := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data", http.StatusTemporaryRedirect))
+	t.Cleanup(redirecting.Close)
+	setupWebhook(t, tunnelName, &webhook.Option{URL: redirecting.URL, MaxRetries: -1})
+
+	confirm := publishConfirmed(t, tunnelName, "redirected")
+	shouldBeConfirmedBefore(t, confirm, false, 100*time.Millisecond)
+	assert.Empty(t, requests)
+}
+
+func TestWebhook_LargeResponseBody(t *testing.T) {
+	tunnelName := "BTunnel_webhook_large_response"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		chunk := bytes.Repeat([]byte("x"), 1<<20)
+		for { // Endless, until the webhook stops reading
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	setupWebhook(t, tunnelName, &webhook.Option{URL: receiver.URL})
+
+	confirm := publishConfirmed(t, tunnelName, "acknowledged without reading the whole response")
+	shouldBeConfirmedBefore(t, confirm, true, time.Second)
+}
+
+func TestWebhook_RetriesWithBackoff(t *testing.T) {
+	tunnelName := "BTunnel_webhook_retries"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	receiver, requests := setupWebhookReceiver(t, func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	setupWebhook(t, tunnelName, &webhook.Option{URL: receiver.URL, Backoff: 20 * time.Millisecond})
+
+	start := time.Now()
+	confirm := publishConfirmed(t, tunnelName, "retried")
+	first := shouldReceiveWebhookBefore(t, requests, 100*time.Millisecond)
+	second := shouldReceiveWebhookBefore(t, requests, 100*time.Millisecond)
+	third := shouldReceiveWebhookBefore(t, requests, 100*time.Millisecond)
+	shouldBeConfirmedBefore(t, confirm, true, 100*time.Millisecond)
+
+	// Backoffs of 20ms then 40ms
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+	// All the attempts are the same delivery
+	assert.Equal(t, first.header.Get(webhook.DeliveryHeader), second.header.Get(webhook.DeliveryHeader))
+	assert.Equal(t, first.header.Get(webhook.DeliveryHeader), third.header.Get(webhook.DeliveryHeader))
+}
+
+func TestWebhook_NackOnceRetriesExhausted(t *testing.T) {
+	tunnelName := "BTunnel_webhook_exhausted"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	receiver, requests := setupWebhookReceiver(t, func(int) int { return http.StatusServiceUnavailable })
+	setupWebhook(t, tunnelName, &webhook.Option{URL: receiver.URL, MaxRetries: 1, Backoff: time.Millisecond})
+
+	confirm := publishConfirmed(t, tunnelName, "refused")
+	shouldReceiveWebhookBefore(t, requests, 100*time.Millisecond)
+	shouldReceiveWebhookBefore(t, requests, 100*time.Millisecond)
+	shouldBeConfirmedBefore(t, confirm, false, 100*time.Millisecond)
+	assert.Empty(t, requests)
+}
+
+func TestWebhook_NackOnTimeout(t *testing.T) {
+	tunnelName := "BTunnel_webhook_timeout"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	t.Cleanup(receiver.Close)
+	t.Cleanup(func() { close(release) })
+	setupWebhook(t, tunnelName, &webhook.Option{URL: receiver.URL, Timeout: 20 * time.Millisecond, MaxRetries: -1})
+
+	confirm := publishConfirmed(t, tunnelName, "too slow")
+	shouldBeConfirmedBefore(t, confirm, false, 200*time.Millisecond)
+}
+
+func TestWebhook_InvalidURL(t *testing.T) {
+	tunnelName := "BTunnel_webhook_invalid"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	_, err := webhook.Subscribe(tunnelName, &webhook.Option{URL: "ftp://example.com"})
+	assert.Error(t, err)
+	_, err = webhook.Subscribe("BTunnel_webhook_unknown", &webhook.Option{URL: "http://example.com"})
+	assert.ErrorIs(t, err, tunnel.ErrUnknownTunnel)
+}
+
+func TestWebhook_HTTPGateway(t *testing.T) {
+	tunnelName := "BTunnel_webhook_gateway"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	receiver, requests := setupWebhookReceiver(t, func(int) int { return http.StatusOK })
+	srv := setupHTTPServer(t, &server.ServerOption{WebhookAllowedHosts: []string{"127.0.0.1"}})
+
+	body, err := json.Marshal(server.WebhookRequest{URL: receiver.URL, Secret: "s3cr3t"})
+	require.NoError(t, err)
+	resp, err := http.Post("http://"+srv.HTTPAddr()+"/tunnels/"+tunnelName+"/webhooks", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	var created server.WebhookResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, tunnelName, created.Tunnel)
+
+	assert.Equal(t, http.StatusAccepted, httpPublish(t, srv, tunnelName, "pushed"))
+	req := shouldReceiveWebhookBefore(t, requests, 100*time.Millisecond)
+	assert.Equal(t, "pushed", req.body)
+	assert.True(t, webhook.Verify("s3cr3t", []byte(req.body), req.header.Get(webhook.TimestampHeader), req.header.Get(webhook.SignatureHeader)))
+
+	deleteWebhook := func() int {
+		req, err := http.NewRequest(http.MethodDelete, "http://"+srv.HTTPAddr()+"/webhooks/"+created.ID, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, deleteWebhook())
+	assert.Equal(t, http.StatusNotFound, deleteWebhook())
+
+	assert.Equal(t, http.StatusAccepted, httpPublish(t, srv, tunnelName, "not pushed"))
+	select {
+	case req := <-requests:
+		assert.FailNow(t, "Webhook shouldn't have been called", req.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// postWebhook subscribes a webhook through the HTTP gateway. Returns the status of the response.
+func postWebhook(t *testing.T, srv *server.Server, tunnelName, webhookURL string) int {
+	body, err := json.Marshal(server.WebhookRequest{URL: webhookURL})
+	require.NoError(t, err)
+	resp, err := http.Post("http://"+srv.HTTPAddr()+"/tunnels/"+tunnelName+"/webhooks", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebhook_HTTPGatewayAllowedHosts(t *testing.T) {
+	tunnelName := "BTunnel_webhook_gateway_hosts"
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+
+	// None by default
+	srv := setupHTTPServer(t, &server.ServerOption{})
+	assert.Equal(t, http.StatusForbidden, postWebhook(t, srv, tunnelName, "http://127.0.0.1:8080/hook"))
+
+	srv = setupHTTPServer(t, &server.ServerOption{WebhookAllowedHosts: []string{"hooks.example.com", "api.example.com:8443"}})
+	assert.Equal(t, http.StatusForbidden, postWebhook(t, srv, tunnelName, "http://169.254.169.254/latest/meta-data"))
+	assert.Equal(t, http.StatusForbidden, postWebhook(t, srv, tunnelName, "http://hooks.example.com@127.0.0.1/hook"))
+	assert.Equal(t, http.StatusForbidden, postWebhook(t, srv, tunnelName, "https://api.example.com/hook"))
+	assert.Equal(t, http.StatusCreated, postWebhook(t, srv, tunnelName, "https://hooks.example.com:9000/hook"))
+	assert.Equal(t, http.StatusCreated, postWebhook(t, srv, tunnelName, "https://api.example.com:8443/hook"))
+	webhook.UnsubscribeAll()
+}
@@ -0,0 +1,279 @@
+package tests
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codingLayce/tunnel-server/server"
+	"github.com/codingLayce/tunnel-server/tests/helpers"
+	"github.com/codingLayce/tunnel-server/tunnel"
+	"github.com/codingLayce/tunnel-server/websocket"
+	"github.com/codingLayce/tunnel.go/id"
+	"github.com/codingLayce/tunnel.go/pdu"
+	"github.com/codingLayce/tunnel.go/pdu/command"
+	"github.com/codingLayce/tunnel.go/test-helper/mock"
+)
+
+// /!\ State is kept during all tests execution /!\
+
+func setupWebSocketServer(t *testing.T) *server.Server {
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", WebSocketAddr: "127.0.0.1:0"})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func setupWebSocketClient(t *testing.T, srv *server.Server) *helpers.WebSocketClientSpy {
+	cli, err := helpers.NewWebSocketClientSpy(srv.WebSocketAddr())
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func shouldReceiveFrameBefore(t *testing.T, cli *helpers.WebSocketClientSpy, timeout time.Duration) server.WebSocketFrame {
+	select {
+	case frame := <-cli.Frames():
+		return frame
+	case <-time.After(timeout):
+		assert.FailNow(t, "Frame should have been received")
+	}
+	return server.WebSocketFrame{}
+}
+
+func shouldNotReceiveFrameBefore(t *testing.T, cli *helpers.WebSocketClientSpy, timeout time.Duration) {
+	select {
+	case frame := <-cli.Frames():
+		assert.FailNow(t, "No frame should have been received", "%+v", frame)
+	case <-time.After(timeout):
+	}
+}
+
+func TestWebSocket_Disabled(t *testing.T) {
+	srv := setupServer(t)
+	defer srv.Stop()
+	assert.Empty(t, srv.WebSocketAddr())
+}
+
+func TestWebSocket_SharesTunnelWithTunnelProtocolClients(t *testing.T) {
+	tunnelName := "BTunnel_websocket_shared"
+	srv := setupWebSocketServer(t)
+	browser := setupWebSocketClient(t, srv)
+	cli := setupClient(t, srv.Addr())
+	defer cli.Stop()
+
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameCreate, TransactionID: "create01", Tunnel: tunnelName}))
+	assert.Equal(t, server.WebSocketFrame{Type: server.FrameAck, TransactionID: "create01"}, shouldReceiveFrameBefore(t, browser, 100*time.Millisecond))
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameListen, TransactionID: "listen01", Tunnel: tunnelName}))
+	assert.Equal(t, server.WebSocketFrame{Type: server.FrameAck, TransactionID: "listen01"}, shouldReceiveFrameBefore(t, browser, 100*time.Millisecond))
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewListenTunnel(tunnelName))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+
+	// Go SDK client to browser
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "from sdk"))))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+	frame := shouldReceiveFrameBefore(t, browser, 100*time.Millisecond)
+	assert.Equal(t, server.FrameMessage, frame.Type)
+	assert.Equal(t, tunnelName, frame.Tunnel)
+	assert.Equal(t, "from sdk", frame.Message)
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameAck, TransactionID: frame.TransactionID}))
+
+	// Browser to Go SDK client
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FramePublish, TransactionID: "publish1", Tunnel: tunnelName, Message: "from browser"}))
+	assert.Equal(t, server.WebSocketFrame{Type: server.FrameAck, TransactionID: "publish1"}, shouldReceiveFrameBefore(t, browser, 100*time.Millisecond))
+	receivedTunnel, message := shouldReceiveMessageAndAckBefore(t, cli, 100*time.Millisecond)
+	assert.Equal(t, tunnelName, receivedTunnel)
+	assert.Equal(t, "from browser", message)
+	// The sender doesn't receive its own message
+	shouldNotReceiveFrameBefore(t, browser, 50*time.Millisecond)
+}
+
+func TestWebSocket_AcknowledgementsConfirmPublication(t *testing.T) {
+	tunnelName := "BTunnel_websocket_confirm"
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", WebSocketAddr: "127.0.0.1:0", PublishConfirm: tunnel.ConfirmAll})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	browser := setupWebSocketClient(t, srv)
+	cli := setupClient(t, srv.Addr())
+	defer cli.Stop()
+
+	require.NoError(t, tunnel.CreateBroadcast(tunnelName))
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameListen, TransactionID: "listen02", Tunnel: tunnelName}))
+	assert.Equal(t, server.FrameAck, shouldReceiveFrameBefore(t, browser, 100*time.Millisecond).Type)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "nacked"))))
+	frame := shouldReceiveFrameBefore(t, browser, 100*time.Millisecond)
+	shouldNotReceiveCommandsBefore(t, cli, 50*time.Millisecond)
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameNack, TransactionID: frame.TransactionID}))
+	shouldReceiveNackBefore(t, cli, 100*time.Millisecond)
+
+	require.NoError(t, cli.Send(pdu.Marshal(command.NewPublishMessage(tunnelName, "acked"))))
+	frame = shouldReceiveFrameBefore(t, browser, 100*time.Millisecond)
+	assert.Equal(t, "acked", frame.Message)
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameAck, TransactionID: frame.TransactionID}))
+	shouldReceiveAckBefore(t, cli, 100*time.Millisecond)
+}
+
+func TestWebSocket_InvalidFrames(t *testing.T) {
+	srv := setupWebSocketServer(t)
+	browser := setupWebSocketClient(t, srv)
+
+	require.NoError(t, browser.SendRaw([]byte("not json")))
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: "delete", TransactionID: "delete01", Tunnel: "BTunnel_websocket_invalid"}))
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameCreate, TransactionID: "bad-id", Tunnel: "BTunnel_websocket_invalid"}))
+	shouldNotReceiveFrameBefore(t, browser, 50*time.Millisecond)
+
+	// The connection is kept
+	require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameCreate, TransactionID: "create02", Tunnel: "BTunnel_websocket_invalid"}))
+	assert.Equal(t, server.WebSocketFrame{Type: server.FrameAck, TransactionID: "create02"}, shouldReceiveFrameBefore(t, browser, 100*time.Millisecond))
+}
+
+func TestWebSocket_RejectsPlainHTTP(t *testing.T) {
+	srv := setupWebSocketServer(t)
+
+	resp, err := http.Get("http://" + srv.WebSocketAddr() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebSocket_ClosedOnStop(t *testing.T) {
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", WebSocketAddr: "127.0.0.1:0"})
+	require.NoError(t, srv.Start())
+	browser := setupWebSocketClient(t, srv)
+	require.Eventually(t, func() bool { return srv.Snapshot().Clients == 1 }, 100*time.Millisecond, time.Millisecond)
+
+	srv.Stop()
+	select {
+	case _, open := <-browser.Frames():
+		assert.False(t, open, "Connection should have been closed")
+	case <-time.After(100 * time.Millisecond):
+		assert.FailNow(t, "Connection should have been closed")
+	}
+	assert.Equal(t, 0, srv.Snapshot().Clients)
+}
+
+// webSocketHandshake sends a WebSocket handshake from a web page of the origin. Returns the status of the response.
+func webSocketHandshake(t *testing.T, srv *server.Server, origin string) int {
+	req, err := http.NewRequest(http.MethodGet, "http://"+srv.WebSocketAddr()+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebSocket_AllowedOrigins(t *testing.T) {
+	srv := server.NewServerWithOption(&server.ServerOption{
+		Addr:                    ":0",
+		WebSocketAddr:           "127.0.0.1:0",
+		WebSocketAllowedOrigins: []string{"https://app.example.com"},
+	})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+
+	assert.Equal(t, http.StatusSwitchingProtocols, webSocketHandshake(t, srv, ""), "Not a browser")
+	assert.Equal(t, http.StatusSwitchingProtocols, webSocketHandshake(t, srv, "http://"+srv.WebSocketAddr()), "Same origin")
+	assert.Equal(t, http.StatusSwitchingProtocols, webSocketHandshake(t, srv, "https://APP.example.com"))
+	assert.Equal(t, http.StatusForbidden, webSocketHandshake(t, srv, "https://evil.example.com"))
+	assert.Equal(t, http.StatusForbidden, webSocketHandshake(t, srv, "http://app.example.com"))
+}
+
+func TestWebSocket_AnyOrigin(t *testing.T) {
+	srv := server.NewServerWithOption(&server.ServerOption{Addr: ":0", WebSocketAddr: "127.0.0.1:0", WebSocketAllowedOrigins: []string{"*"}})
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+
+	assert.Equal(t, http.StatusSwitchingProtocols, webSocketHandshake(t, srv, "https://anywhere.example.com"))
+}
+
+func TestWebSocket_CrossOriginForbiddenByDefault(t *testing.T) {
+	srv := setupWebSocketServer(t)
+	assert.Equal(t, http.StatusForbidden, webSocketHandshake(t, srv, "https://evil.example.com"))
+}
+
+func TestWebSocket_HandshakeTimeout(t *testing.T) {
+	mock.Do(t, &server.WebSocketHandshakeTimeout, 50*time.Millisecond)
+	srv := setupWebSocketServer(t)
+
+	// A client never ending its handshake request is disconnected
+	conn, err := net.Dial("tcp", srv.WebSocketAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "Connection should have been closed")
+}
+
+func TestWebSocket_ReadTimeout(t *testing.T) {
+	mock.Do(t, &server.WebSocketHandshakeTimeout, 50*time.Millisecond)
+	mock.Do(t, &server.WebSocketReadTimeout, 100*time.Millisecond)
+	srv := setupWebSocketServer(t)
+	browser := setupWebSocketClient(t, srv)
+
+	// Still connected after the handshake timeout, as long as not idle
+	for range 3 {
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, browser.Send(server.WebSocketFrame{Type: server.FrameCreate, TransactionID: id.New(), Tunnel: "BTunnel_websocket_read_timeout"}))
+		shouldReceiveFrameBefore(t, browser, 100*time.Millisecond)
+	}
+
+	// Disconnected once idle
+	select {
+	case _, open := <-browser.Frames():
+		assert.False(t, open, "Connection should have been closed")
+	case <-time.After(300 * time.Millisecond):
+		assert.FailNow(t, "Connection should have been closed")
+	}
+}
+
+// shouldCloseWithStatusAfter sends the raw client frame (masked with a zero key) and returns the status of the close
+// frame answering it.
+func shouldCloseWithStatusAfter(t *testing.T, srv *server.Server, header byte, payload []byte) uint16 {
+	conn, err := websocket.Dial(srv.WebSocketAddr(), "/")
+	require.NoError(t, err)
+	defer conn.Close()
+	frame := []byte{header}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(payload)))
+	}
+	frame = append(append(frame, 0, 0, 0, 0), payload...)
+	_, err = conn.NetConn().Write(frame)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.NetConn().SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	var closeFrame [4]byte
+	_, err = io.ReadFull(conn.NetConn(), closeFrame[:])
+	require.NoError(t, err, "Close frame should have been received")
+	require.Equal(t, []byte{0x88, 2}, closeFrame[:2], "Close frame with a status expected")
+	return binary.BigEndian.Uint16(closeFrame[2:])
+}
+
+func TestWebSocket_ProtocolErrors(t *testing.T) {
+	srv := setupWebSocketServer(t)
+
+	// Control frames cannot be fragmented nor longer than 125 bytes
+	assert.Equal(t, uint16(1002), shouldCloseWithStatusAfter(t, srv, 0x09, []byte("ping")))
+	assert.Equal(t, uint16(1002), shouldCloseWithStatusAfter(t, srv, 0x89, make([]byte, 126)))
+	// Continuation without a fragmented message
+	assert.Equal(t, uint16(1002), shouldCloseWithStatusAfter(t, srv, 0x80, []byte("orphan")))
+	// Text not UTF-8
+	assert.Equal(t, uint16(1007), shouldCloseWithStatusAfter(t, srv, 0x81, []byte{0xff, 0xfe}))
+}
@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// MemoryExporter keeps the spans in memory. Meant for tests and local debugging.
+type MemoryExporter struct {
+	spans []Span
+	mtx   sync.Mutex
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (e *MemoryExporter) Export(span Span) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns a copy of the exported spans, in their export order.
+func (e *MemoryExporter) Spans() []Span {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	spans := make([]Span, len(e.spans))
+	copy(spans, e.spans)
+	return spans
+}
+
+func (e *MemoryExporter) Reset() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.spans = nil
+}
+
+// WriterExporter writes the spans as JSON lines.
+type WriterExporter struct {
+	encoder *json.Encoder
+	closer  io.Closer
+	mtx     sync.Mutex
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{encoder: json.NewEncoder(w)}
+}
+
+// NewStdoutExporter writes the spans to the standard output.
+func NewStdoutExporter() *WriterExporter {
+	return NewWriterExporter(os.Stdout)
+}
+
+// NewFileExporter appends the spans to the file, created if needed.
+func NewFileExporter(path string) (*WriterExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open trace file: %w", err)
+	}
+	e := NewWriterExporter(file)
+	e.closer = file
+	return e, nil
+}
+
+func (e *WriterExporter) Export(span Span) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if err := e.encoder.Encode(span); err != nil {
+		slog.Warn("Cannot export span", "span", span.Name, "error", err)
+	}
+}
+
+// Close the underlying file, if any.
+func (e *WriterExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
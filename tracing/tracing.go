@@ -0,0 +1,192 @@
+// Package tracing records the spans of the messages path, from their publication to their acknowledgements.
+// Trace contexts are compatible with the W3C Trace Context traceparent header.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext identifies a span and its trace. The zero value is invalid and starts a new trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled indicates whether the spans of the trace are recorded.
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent formats the context as a W3C traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceParent parses a W3C traceparent header value: "VERSION-TRACE_ID-PARENT_ID-FLAGS".
+func ParseTraceParent(value string) (SpanContext, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q: expecting 4 fields", value)
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q: unsupported version", value)
+	}
+
+	var sc SpanContext
+	if err := decodeHex(sc.TraceID[:], traceID); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent trace id: %w", err)
+	}
+	if err := decodeHex(sc.SpanID[:], spanID); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent parent id: %w", err)
+	}
+	var flagsByte [1]byte
+	if err := decodeHex(flagsByte[:], flags); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent flags: %w", err)
+	}
+	sc.Sampled = flagsByte[0]&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q: zero id", value)
+	}
+	return sc, nil
+}
+
+func decodeHex(dst []byte, value string) error {
+	if len(value) != hex.EncodedLen(len(dst)) || strings.ToLower(value) != value {
+		return fmt.Errorf("%q must be %d lowercase hex characters", value, hex.EncodedLen(len(dst)))
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err
+}
+
+// Span is a recorded operation.
+type Span struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+}
+
+// ActiveSpan is a span being recorded. It's exported once ended.
+type ActiveSpan struct {
+	ctx       SpanContext
+	span      Span
+	recording bool
+	mtx       sync.Mutex
+}
+
+// Start a span, child of the parent. Starts a new sampled trace if the parent is invalid.
+// The span is only recorded if the trace is sampled and an Exporter is set.
+func Start(parent SpanContext, name string) *ActiveSpan {
+	ctx := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	if !parent.IsValid() {
+		ctx = SpanContext{TraceID: newTraceID(), Sampled: true}
+	}
+	ctx.SpanID = newSpanID()
+
+	span := &ActiveSpan{ctx: ctx, recording: ctx.Sampled && currentExporter() != nil}
+	if span.recording {
+		span.span = Span{
+			Name:    name,
+			TraceID: ctx.TraceID.String(),
+			SpanID:  ctx.SpanID.String(),
+			Start:   time.Now(),
+		}
+		if parent.IsValid() {
+			span.span.ParentSpanID = parent.SpanID.String()
+		}
+	}
+	return span
+}
+
+// Context of the span, to propagate to its children.
+func (s *ActiveSpan) Context() SpanContext {
+	return s.ctx
+}
+
+func (s *ActiveSpan) SetAttribute(key, value string) {
+	if !s.recording {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.span.Attributes == nil {
+		s.span.Attributes = make(map[string]string)
+	}
+	s.span.Attributes[key] = value
+}
+
+// End the span and exports it.
+func (s *ActiveSpan) End() {
+	if !s.recording {
+		return
+	}
+	s.mtx.Lock()
+	s.span.End = time.Now()
+	span := s.span
+	s.mtx.Unlock()
+
+	if exporter := currentExporter(); exporter != nil {
+		exporter.Export(span)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+// Exporter receives the ended spans.
+type Exporter interface {
+	Export(span Span)
+}
+
+type exporterHolder struct{ exporter Exporter }
+
+var exporter atomic.Pointer[exporterHolder]
+
+// SetExporter sets the Exporter of the spans. A nil Exporter disables the recording.
+func SetExporter(e Exporter) {
+	if e == nil {
+		exporter.Store(nil)
+		return
+	}
+	exporter.Store(&exporterHolder{exporter: e})
+}
+
+func currentExporter() Exporter {
+	holder := exporter.Load()
+	if holder == nil {
+		return nil
+	}
+	return holder.exporter
+}
@@ -2,70 +2,303 @@ package tunnel
 
 import (
 	"context"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/codingLayce/tunnel.go/common/maps"
+
+	"github.com/codingLayce/tunnel-server/tracing"
 )
 
+type BroadcastOption struct {
+	// Priority enables the dispatch of higher priority pending messages first.
+	Priority bool
+
+	// DedupWindow enables the deduplication of messages by id: a message with an id already seen during the window is dropped.
+	DedupWindow time.Duration
+	// DedupCapacity is the maximum number of ids remembered. Defaults to DefaultDedupCapacity.
+	DedupCapacity int
+
+	// BufferSize is the maximum number of in-flight messages. Defaults to DefaultBufferSize.
+	BufferSize int
+	// Overflow is the policy applied to a publication when the buffer is full. Defaults to OverflowReject.
+	Overflow OverflowPolicy
+
+	// MaxListeners is the maximum number of listeners, groups members included. Unlimited if zero.
+	MaxListeners int
+}
+
+func (opts *BroadcastOption) defaults() {
+	if opts.DedupCapacity <= 0 {
+		opts.DedupCapacity = DefaultDedupCapacity
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+}
+
 type Broadcaster struct {
-	name      string
-	listeners *maps.SyncMap[string, Listener]
-	messages  chan Message
+	name string
+	// listeners registered on their own. They receive every message.
+	listeners *maps.SyncMap[string, *delivery]
+
+	// newQueue creates the queue of pending messages of each listener.
+	newQueue func() queue
+
+	// pending messages waiting for dispatch. notify is signaled when a message is pushed.
+	pending    queue
+	pendingMtx sync.Mutex
+	notify     chan struct{}
+
+	// dedup is nil when deduplication is disabled. Guarded by pendingMtx.
+	dedup *dedupIndex
+
+	buffer       *buffer
+	maxListeners int
+
+	// groups of listeners sharing the load. Each group receives every message once.
+	groups map[string]*group
+	// registrationMtx makes the (un)registration of a listener atomic.
+	registrationMtx sync.Mutex
 
 	ctx    context.Context
 	stopFn context.CancelFunc
 	wg     sync.WaitGroup
 }
 
-func newBroadcaster(name string) *Broadcaster {
+func newBroadcaster(name string, opts *BroadcastOption) *Broadcaster {
+	opts.defaults()
+
+	newQueue := func() queue { return &fifoQueue{} }
+	if opts.Priority {
+		newQueue = func() queue { return &priorityQueue{} }
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	b := &Broadcaster{
-		name:      name,
-		listeners: maps.NewSyncMap[string, Listener](),
-		messages:  make(chan Message),
-		ctx:       ctx,
-		stopFn:    cancel,
+		name:         name,
+		listeners:    maps.NewSyncMap[string, *delivery](),
+		newQueue:     newQueue,
+		pending:      &fifoQueue{},
+		buffer:       newBuffer(opts.BufferSize, opts.Overflow),
+		maxListeners: opts.MaxListeners,
+		notify:       make(chan struct{}, 1),
+		groups:       make(map[string]*group),
+		ctx:          ctx,
+		stopFn:       cancel,
 	}
+	if opts.DedupWindow > 0 {
+		b.dedup = newDedupIndex(opts.DedupWindow, opts.DedupCapacity)
+	}
+	b.wg.Add(1)
 	go b.start()
 	return b
 }
 
-func (b *Broadcaster) RegisterListener(listener Listener) {
-	b.listeners.Put(listener.ID(), listener)
+// RegisterListener registers the listener to the given group.
+// An empty group registers the listener on its own: it receives every message.
+// A listener already registered is moved to the given group, keeping its pending messages.
+func (b *Broadcaster) RegisterListener(listener Listener, groupName string) error {
+	b.registrationMtx.Lock()
+	defer b.registrationMtx.Unlock()
+
+	member, exists := b.detach(listener.ID())
+	if !exists {
+		if b.maxListeners > 0 && b.countListeners() >= b.maxListeners {
+			return ErrTooManyListeners
+		}
+		member = newDelivery(b.name, listener, b.newQueue())
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			member.start()
+		}()
+	}
+
+	if groupName == "" {
+		member.setRedeliver(nil)
+		b.listeners.Put(listener.ID(), member)
+		return nil
+	}
+	g, exists := b.groups[groupName]
+	if !exists {
+		g = &group{}
+		b.groups[groupName] = g
+	}
+	g.add(member)
+	return nil
+}
+
+// countListeners registered on their own and in groups. Must be called with the registration lock held.
+func (b *Broadcaster) countListeners() int {
+	count := b.listeners.Len()
+	for _, g := range b.groups {
+		count += g.len()
+	}
+	return count
 }
 
 func (b *Broadcaster) UnregisterListener(id string) {
-	b.listeners.Delete(id)
+	b.registrationMtx.Lock()
+	defer b.registrationMtx.Unlock()
+
+	if member, exists := b.detach(id); exists {
+		member.stop()
+	}
+}
+
+// detach the listener from the Broadcaster without stopping its delivery.
+// Must be called with the registration lock held.
+func (b *Broadcaster) detach(id string) (*delivery, bool) {
+	if member, exists := b.listeners.Get(id); exists {
+		b.listeners.Delete(id)
+		return member, true
+	}
+	for name, g := range b.groups {
+		member, exists := g.remove(id)
+		if !exists {
+			continue
+		}
+		if g.len() == 0 {
+			delete(b.groups, name)
+		}
+		return member, true
+	}
+	return nil, false
+}
+
+func (b *Broadcaster) PublishMessage(msg Message) error {
+	if b.isDuplicate(msg) {
+		msg.Confirm.acknowledge() // Confirms the duplicate so its publisher stops retrying.
+		return nil
+	}
+
+	acquired, err := b.buffer.acquire(b.ctx)
+	if err != nil {
+		b.forgetID(msg) // Rejected, so its retry isn't a duplicate.
+		return err
+	}
+	if !acquired { // Dropped by the overflow policy: never delivered
+		msg.Confirm.reject()
+		return nil
+	}
+	msg.inFlight = &inFlight{release: b.buffer.release}
+
+	b.pendingMtx.Lock()
+	b.pending.push(msg)
+	b.pendingMtx.Unlock()
+
+	select { // Wake up the dispatch loop if it isn't already notified.
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return nil
 }
 
-func (b *Broadcaster) PublishMessage(msg Message) {
-	select {
-	case b.messages <- msg:
-	case <-b.ctx.Done():
+func (b *Broadcaster) isDuplicate(msg Message) bool {
+	if b.dedup == nil || msg.ID == "" {
+		return false
 	}
+	b.pendingMtx.Lock()
+	defer b.pendingMtx.Unlock()
+	return b.dedup.seen(msg.ID)
+}
+
+func (b *Broadcaster) forgetID(msg Message) {
+	if b.dedup == nil || msg.ID == "" {
+		return
+	}
+	b.pendingMtx.Lock()
+	defer b.pendingMtx.Unlock()
+	b.dedup.remove(msg.ID)
+}
+
+func (b *Broadcaster) Stats() Stats {
+	return b.buffer.stats()
 }
 
 func (b *Broadcaster) start() {
-	b.wg.Add(1)
 	defer b.wg.Done()
 
 	for {
 		select {
-		case msg := <-b.messages:
-			b.listeners.Foreach(func(id string, listener Listener) {
-				if msg.SenderID == id {
-					return
-				}
-				// TODO: goroutine for each listener
-				listener.NotifyMessage(b.name, msg.Msg)
-			})
+		case <-b.notify:
+			b.dispatchPending()
 		case <-b.ctx.Done():
 			return
 		}
 	}
 }
 
+// dispatchPending dispatches messages until there is no more pending ones or the Broadcaster is stopped.
+func (b *Broadcaster) dispatchPending() {
+	for b.ctx.Err() == nil {
+		b.pendingMtx.Lock()
+		msg, ok := b.pending.pop()
+		b.pendingMtx.Unlock()
+		if !ok {
+			return
+		}
+		b.dispatch(msg)
+	}
+}
+
+// dispatch the message to the delivery of each recipient.
+// Every delivery notifies its messages in the dispatch order.
+func (b *Broadcaster) dispatch(msg Message) {
+	route := tracing.Start(msg.Trace, "route")
+	defer route.End()
+	route.SetAttribute("tunnel", b.name)
+	msg.Trace = route.Context()
+	recipients := 0
+
+	b.listeners.Foreach(func(id string, member *delivery) {
+		if msg.SenderID == id {
+			return
+		}
+		msg.expect()
+		recipients++
+		if !member.push(msg) { // Stopped meanwhile
+			msg.report(false)
+		}
+	})
+
+	for _, g := range b.snapshotGroups() {
+		if member, ok := g.pick(msg.SenderID); ok {
+			msg.expect()
+			recipients++
+			if !member.push(msg) && !g.redeliver(msg) { // Stopped meanwhile
+				msg.report(false)
+			}
+		}
+	}
+	msg.seal()
+	route.SetAttribute("recipients", strconv.Itoa(recipients))
+}
+
+func (b *Broadcaster) snapshotGroups() []*group {
+	b.registrationMtx.Lock()
+	defer b.registrationMtx.Unlock()
+	groups := make([]*group, 0, len(b.groups))
+	for _, g := range b.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// Stop the Broadcaster and waits for its deliveries to end.
 func (b *Broadcaster) Stop() {
 	b.stopFn()
+
+	b.registrationMtx.Lock()
+	b.listeners.Foreach(func(_ string, member *delivery) {
+		member.stop()
+	})
+	for _, g := range b.groups {
+		g.stop()
+	}
+	b.registrationMtx.Unlock()
+
 	b.wg.Wait()
 }
@@ -0,0 +1,175 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultBufferSize is the maximum number of in-flight messages of a Tunnel when not configured.
+const DefaultBufferSize = 10_000
+
+// ErrTunnelFull is returned when publishing to a Tunnel whose buffer is full with the OverflowReject policy.
+var ErrTunnelFull = errors.New("tunnel full")
+
+// OverflowPolicy defines how a Tunnel handles a publication when its buffer is full.
+type OverflowPolicy byte
+
+const (
+	// OverflowReject rejects the publication with ErrTunnelFull.
+	OverflowReject OverflowPolicy = iota
+	// OverflowBlock blocks the publisher until there is room in the buffer.
+	OverflowBlock
+	// OverflowDrop silently drops the message. It is acknowledged to its publisher, unless publisher confirms are enabled.
+	OverflowDrop
+)
+
+// ParseOverflowPolicy parses the name of an OverflowPolicy: "reject", "block" or "drop".
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "reject":
+		return OverflowReject, nil
+	case "block":
+		return OverflowBlock, nil
+	case "drop":
+		return OverflowDrop, nil
+	default:
+		return 0, fmt.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// Stats of a Tunnel.
+type Stats struct {
+	// BufferDepth is the number of in-flight messages: published but not yet notified to all of their listeners.
+	BufferDepth int `json:"buffer_depth"`
+	BufferSize  int `json:"buffer_size"`
+	Rejected    int `json:"rejected"`
+	Dropped     int `json:"dropped"`
+}
+
+// buffer bounds the number of in-flight messages of a Tunnel.
+type buffer struct {
+	size   int
+	policy OverflowPolicy
+
+	depth    int
+	rejected int
+	dropped  int
+	mtx      sync.Mutex
+	// space is signaled when a message leaves the buffer.
+	space chan struct{}
+}
+
+func newBuffer(size int, policy OverflowPolicy) *buffer {
+	return &buffer{
+		size:   size,
+		policy: policy,
+		space:  make(chan struct{}, 1),
+	}
+}
+
+// acquire room for a message, applying the overflow policy when the buffer is full.
+// Returns false (and no error) when the message must be dropped.
+func (b *buffer) acquire(ctx context.Context) (bool, error) {
+	for {
+		b.mtx.Lock()
+		if b.depth < b.size {
+			b.depth++
+			if b.depth < b.size {
+				b.signalSpace() // Chain the wake up of the other blocked publishers
+			}
+			b.mtx.Unlock()
+			return true, nil
+		}
+		switch b.policy {
+		case OverflowReject:
+			b.rejected++
+			b.mtx.Unlock()
+			return false, ErrTunnelFull
+		case OverflowDrop:
+			b.dropped++
+			b.mtx.Unlock()
+			return false, nil
+		}
+		b.mtx.Unlock()
+
+		select {
+		case <-b.space:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+func (b *buffer) release() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.depth--
+	b.signalSpace()
+}
+
+// signalSpace wakes up a blocked publisher, if any. Must be called with the lock held.
+func (b *buffer) signalSpace() {
+	select {
+	case b.space <- struct{}{}:
+	default:
+	}
+}
+
+func (b *buffer) stats() Stats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return Stats{
+		BufferDepth: b.depth,
+		BufferSize:  b.size,
+		Rejected:    b.rejected,
+		Dropped:     b.dropped,
+	}
+}
+
+// inFlight tracks the deliveries of a message to release it from the buffer once they're all done.
+// A nil inFlight is valid and ignores every report.
+type inFlight struct {
+	pending int
+	sealed  bool
+	release func()
+	mtx     sync.Mutex
+}
+
+func (f *inFlight) expect() {
+	if f == nil {
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.pending++
+}
+
+func (f *inFlight) report() {
+	if f == nil {
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.pending--
+	f.evaluate()
+}
+
+func (f *inFlight) seal() {
+	if f == nil {
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.sealed = true
+	f.evaluate()
+}
+
+// evaluate releases the message once sealed without pending delivery. Must be called with the lock held.
+func (f *inFlight) evaluate() {
+	if f.sealed && f.pending == 0 && f.release != nil {
+		f.release()
+		f.release = nil
+	}
+}
@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ConfirmMode defines when a published message is confirmed to its publisher.
+type ConfirmMode byte
+
+const (
+	// ConfirmNone confirms the message as soon as it's queued by the Tunnel.
+	ConfirmNone ConfirmMode = iota
+	// ConfirmOne confirms the message once at least one listener acked it.
+	ConfirmOne
+	// ConfirmAll confirms the message once every listener it has been delivered to acked it.
+	ConfirmAll
+)
+
+// ParseConfirmMode parses the name of a ConfirmMode: "none", "one" or "all".
+func ParseConfirmMode(name string) (ConfirmMode, error) {
+	switch name {
+	case "none":
+		return ConfirmNone, nil
+	case "one":
+		return ConfirmOne, nil
+	case "all":
+		return ConfirmAll, nil
+	default:
+		return 0, fmt.Errorf("unknown confirm mode %q", name)
+	}
+}
+
+// Confirmation tracks the acknowledgements of a message by its listeners.
+// A nil Confirmation is valid and ignores every report.
+type Confirmation struct {
+	mode ConfirmMode
+
+	expected int
+	acked    int
+	sealed   bool // Every delivery has been expected.
+
+	confirmed bool
+	done      chan struct{}
+	mtx       sync.Mutex
+}
+
+func NewConfirmation(mode ConfirmMode) *Confirmation {
+	c := &Confirmation{
+		mode: mode,
+		done: make(chan struct{}),
+	}
+	if mode == ConfirmNone {
+		c.resolve(true)
+	}
+	return c
+}
+
+// Done is closed once the Confirmation is resolved.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Confirmed indicates whether the message has been confirmed. Only meaningful once Done is closed.
+func (c *Confirmation) Confirmed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.confirmed
+}
+
+// expect a delivery to a listener.
+func (c *Confirmation) expect() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.expected++
+}
+
+// report the outcome of an expected delivery.
+func (c *Confirmation) report(isAck bool) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.expected--
+	if isAck {
+		c.acked++
+	}
+	c.evaluate(isAck)
+}
+
+// seal indicates that every delivery has been expected.
+func (c *Confirmation) seal() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.sealed = true
+	c.evaluate(true)
+}
+
+// acknowledge confirms the message regardless of its deliveries.
+func (c *Confirmation) acknowledge() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.resolve(true)
+}
+
+// reject the message regardless of its deliveries, as it hasn't been published.
+func (c *Confirmation) reject() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.resolve(false)
+}
+
+// evaluate resolves the Confirmation if possible. Must be called with the lock held.
+func (c *Confirmation) evaluate(lastIsAck bool) {
+	switch c.mode {
+	case ConfirmOne:
+		if c.acked > 0 {
+			c.resolve(true)
+		} else if c.sealed && c.expected == 0 {
+			c.resolve(false)
+		}
+	case ConfirmAll:
+		if !lastIsAck {
+			c.resolve(false)
+		} else if c.sealed && c.expected == 0 {
+			c.resolve(true)
+		}
+	}
+}
+
+func (c *Confirmation) resolve(confirmed bool) {
+	select { // Only the first resolution counts
+	case <-c.done:
+	default:
+		c.confirmed = confirmed
+		close(c.done)
+	}
+}
@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"container/list"
+	"time"
+)
+
+// DefaultDedupCapacity is the maximum number of message ids remembered by a Tunnel when not configured.
+const DefaultDedupCapacity = 10_000
+
+// dedupIndex remembers the ids of the messages seen during the window.
+// Memory is bounded: the oldest ids are forgotten once the capacity is reached.
+type dedupIndex struct {
+	window   time.Duration
+	capacity int
+
+	ids   map[string]*list.Element
+	order *list.List // Seen ids, from the oldest to the newest.
+}
+
+type dedupEntry struct {
+	id     string
+	seenAt time.Time
+}
+
+func newDedupIndex(window time.Duration, capacity int) *dedupIndex {
+	return &dedupIndex{
+		window:   window,
+		capacity: capacity,
+		ids:      make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// seen records the id and indicates whether it has already been seen during the window.
+func (d *dedupIndex) seen(id string) bool {
+	now := time.Now()
+	d.expire(now)
+
+	if _, exists := d.ids[id]; exists {
+		return true
+	}
+
+	d.ids[id] = d.order.PushBack(dedupEntry{id: id, seenAt: now})
+	if d.order.Len() > d.capacity {
+		d.forget(d.order.Front())
+	}
+	return false
+}
+
+// remove the id, so that it isn't a duplicate anymore.
+func (d *dedupIndex) remove(id string) {
+	if elem, exists := d.ids[id]; exists {
+		d.forget(elem)
+	}
+}
+
+func (d *dedupIndex) expire(now time.Time) {
+	for oldest := d.order.Front(); oldest != nil; oldest = d.order.Front() {
+		if now.Sub(oldest.Value.(dedupEntry).seenAt) < d.window {
+			return
+		}
+		d.forget(oldest)
+	}
+}
+
+func (d *dedupIndex) forget(elem *list.Element) {
+	delete(d.ids, elem.Value.(dedupEntry).id)
+	d.order.Remove(elem)
+}
@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+)
+
+// delivery notifies messages to a single listener, in its own goroutine.
+// Messages are notified one at a time, in the order of the pending queue (see fifoQueue and priorityQueue).
+type delivery struct {
+	tunnelName string
+	listener   Listener
+
+	pending queue
+	mtx     sync.Mutex
+	notify  chan struct{}
+	// redeliver hands over a message the listener couldn't acknowledge because it left.
+	// Returns false if nobody can take it over. Nil when the listener isn't part of a group.
+	redeliver func(msg Message) bool
+
+	ctx    context.Context
+	stopFn context.CancelFunc
+}
+
+func newDelivery(tunnelName string, listener Listener, pending queue) *delivery {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &delivery{
+		tunnelName: tunnelName,
+		listener:   listener,
+		pending:    pending,
+		notify:     make(chan struct{}, 1),
+		ctx:        ctx,
+		stopFn:     cancel,
+	}
+	return d
+}
+
+func (d *delivery) ID() string {
+	return d.listener.ID()
+}
+
+// push the message to the pending queue. Returns false if the delivery is stopped.
+func (d *delivery) push(msg Message) bool {
+	d.mtx.Lock()
+	if d.ctx.Err() != nil {
+		d.mtx.Unlock()
+		return false
+	}
+	d.pending.push(msg)
+	reportBacklog(d.listener, d.tunnelName, d.pending.len())
+	d.mtx.Unlock()
+
+	select { // Wake up the delivery loop if it isn't already notified.
+	case d.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (d *delivery) setRedeliver(redeliver func(msg Message) bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.redeliver = redeliver
+}
+
+// handOver the message to another listener if the delivery has a redeliver function.
+// Reports the message as not acknowledged otherwise.
+func (d *delivery) handOver(msg Message) {
+	d.mtx.Lock()
+	redeliver := d.redeliver
+	d.mtx.Unlock()
+	if redeliver != nil && redeliver(msg) {
+		return
+	}
+	msg.report(false)
+}
+
+// start the delivery loop. Blocks until the delivery is stopped.
+func (d *delivery) start() {
+	for {
+		select {
+		case <-d.notify:
+			d.deliverPending()
+		case <-d.ctx.Done():
+			d.discardPending()
+			return
+		}
+	}
+}
+
+func (d *delivery) deliverPending() {
+	for d.ctx.Err() == nil {
+		d.mtx.Lock()
+		msg, ok := d.pending.pop()
+		if ok {
+			reportBacklog(d.listener, d.tunnelName, d.pending.len())
+		}
+		d.mtx.Unlock()
+		if !ok {
+			return
+		}
+		isAck := notify(d.listener, d.tunnelName, msg)
+		if !isAck && d.ctx.Err() != nil { // The listener left while being notified
+			d.handOver(msg)
+			continue
+		}
+		msg.report(isAck)
+	}
+}
+
+// discardPending hands over the messages that won't be delivered.
+func (d *delivery) discardPending() {
+	d.mtx.Lock()
+	var discarded []Message
+	for msg, ok := d.pending.pop(); ok; msg, ok = d.pending.pop() {
+		discarded = append(discarded, msg)
+	}
+	if len(discarded) > 0 {
+		reportBacklog(d.listener, d.tunnelName, 0)
+	}
+	d.mtx.Unlock()
+
+	for _, msg := range discarded {
+		d.handOver(msg)
+	}
+}
+
+func (d *delivery) stopped() bool {
+	return d.ctx.Err() != nil
+}
+
+// stop the delivery without waiting for the message being notified.
+func (d *delivery) stop() {
+	d.stopFn()
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"slices"
+	"sync"
+)
+
+// group is a set of listeners sharing the load of a Tunnel.
+// Each message is delivered to a single member, picked in a round-robin fashion.
+// The messages of a member leaving the group before acknowledging them are redelivered to another member.
+type group struct {
+	members []*delivery
+	next    int
+	mtx     sync.Mutex
+}
+
+func (g *group) add(member *delivery) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.members = append(g.members, member)
+	member.setRedeliver(g.redeliver)
+}
+
+// remove the member with the given id and rebalances the round-robin cursor.
+// Returns the removed member, if any.
+func (g *group) remove(id string) (*delivery, bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	idx := slices.IndexFunc(g.members, func(member *delivery) bool { return member.ID() == id })
+	if idx == -1 {
+		return nil, false
+	}
+	member := g.members[idx]
+	g.members = slices.Delete(g.members, idx, idx+1)
+	if idx < g.next {
+		g.next--
+	}
+	if g.next >= len(g.members) {
+		g.next = 0
+	}
+	return member, true
+}
+
+func (g *group) len() int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return len(g.members)
+}
+
+// pick the next member able to receive a message from the given sender.
+// Returns false if no member can receive it.
+func (g *group) pick(senderID string) (*delivery, bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for i := 0; i < len(g.members); i++ {
+		member := g.members[(g.next+i)%len(g.members)]
+		if member.ID() == senderID || member.stopped() {
+			continue
+		}
+		g.next = (g.next + i + 1) % len(g.members)
+		return member, true
+	}
+	return nil, false
+}
+
+// redeliver the message to the next member able to receive it.
+// Returns false if no member can receive it.
+func (g *group) redeliver(msg Message) bool {
+	for {
+		member, ok := g.pick(msg.SenderID)
+		if !ok {
+			return false
+		}
+		if member.push(msg) {
+			return true
+		}
+	}
+}
+
+func (g *group) stop() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for _, member := range g.members {
+		member.stop()
+	}
+}
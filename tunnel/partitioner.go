@@ -0,0 +1,289 @@
+package tunnel
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/codingLayce/tunnel-server/tracing"
+)
+
+// PartitionOption configures a Partitioner.
+type PartitionOption struct {
+	// Partitions is the number of partitions of the Tunnel.
+	Partitions int
+
+	// BufferSize is the maximum number of in-flight messages. Defaults to DefaultBufferSize.
+	BufferSize int
+	// Overflow is the policy applied to a publication when the buffer is full. Defaults to OverflowReject.
+	Overflow OverflowPolicy
+
+	// MaxListeners is the maximum number of listeners. Unlimited if zero.
+	MaxListeners int
+}
+
+func (opts *PartitionOption) defaults() {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+}
+
+// Partitioner is a Tunnel split into partitions.
+// A message is routed to a partition by the hash of its key (round-robin when it has no key).
+// Each partition is delivered in order to exactly one listener: partitions are spread between
+// the listeners and rebalanced when a listener registers or unregisters.
+// Unlike the Broadcaster, the publisher can receive its own messages and groups aren't supported.
+type Partitioner struct {
+	name       string
+	partitions []*partition
+	next       int // Partition of the next message without key.
+
+	listeners map[string]Listener
+	mtx       sync.Mutex
+
+	buffer       *buffer
+	maxListeners int
+
+	ctx    context.Context
+	stopFn context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newPartitioner(name string, opts *PartitionOption) *Partitioner {
+	opts.defaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Partitioner{
+		name:         name,
+		listeners:    make(map[string]Listener),
+		buffer:       newBuffer(opts.BufferSize, opts.Overflow),
+		maxListeners: opts.MaxListeners,
+		ctx:          ctx,
+		stopFn:       cancel,
+	}
+	for range opts.Partitions {
+		part := &partition{tunnelName: name, wake: make(chan struct{}, 1)}
+		p.partitions = append(p.partitions, part)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			part.start(ctx)
+		}()
+	}
+	return p
+}
+
+// RegisterListener registers the listener and rebalances the partitions. The group is ignored.
+func (p *Partitioner) RegisterListener(listener Listener, _ string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	_, exists := p.listeners[listener.ID()]
+	if !exists && p.maxListeners > 0 && len(p.listeners) >= p.maxListeners {
+		return ErrTooManyListeners
+	}
+	p.listeners[listener.ID()] = listener
+	p.rebalance()
+	return nil
+}
+
+func (p *Partitioner) UnregisterListener(id string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if _, exists := p.listeners[id]; !exists {
+		return
+	}
+	delete(p.listeners, id)
+	p.rebalance()
+}
+
+// rebalance assigns the partitions to the listeners in a round-robin fashion. Must be called with the lock held.
+func (p *Partitioner) rebalance() {
+	ids := make([]string, 0, len(p.listeners))
+	for id := range p.listeners {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids) // Stable assignment for the same set of listeners
+
+	for idx, part := range p.partitions {
+		var owner Listener
+		if len(ids) > 0 {
+			owner = p.listeners[ids[idx%len(ids)]]
+		}
+		part.assign(owner)
+	}
+}
+
+func (p *Partitioner) PublishMessage(msg Message) error {
+	acquired, err := p.buffer.acquire(p.ctx)
+	if err != nil {
+		return err
+	}
+	if !acquired { // Dropped by the overflow policy: never delivered
+		msg.Confirm.reject()
+		return nil
+	}
+	msg.inFlight = &inFlight{release: p.buffer.release}
+
+	route := tracing.Start(msg.Trace, "route")
+	defer route.End()
+	route.SetAttribute("tunnel", p.name)
+	msg.Trace = route.Context()
+
+	msg.expect()
+	msg.seal()
+	part := p.partitionOf(msg.Key)
+	route.SetAttribute("partition", strconv.Itoa(slices.Index(p.partitions, part)))
+	part.push(msg)
+	return nil
+}
+
+func (p *Partitioner) Stats() Stats {
+	return p.buffer.stats()
+}
+
+func (p *Partitioner) partitionOf(key string) *partition {
+	if key == "" {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.next = (p.next + 1) % len(p.partitions)
+		return p.partitions[p.next]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return p.partitions[hash.Sum32()%uint32(len(p.partitions))]
+}
+
+// Stop the Partitioner and waits for its partitions to end.
+func (p *Partitioner) Stop() {
+	p.stopFn()
+	p.wg.Wait()
+}
+
+// partition delivers its messages one at a time, in order, to its owner.
+type partition struct {
+	tunnelName string
+
+	pending fifoQueue
+	owner   Listener
+	mtx     sync.Mutex
+	// wake is signaled when a message is pushed or the owner changes.
+	wake chan struct{}
+}
+
+func (part *partition) push(msg Message) {
+	part.mtx.Lock()
+	part.pending.push(msg)
+	part.reportBacklog()
+	part.mtx.Unlock()
+	part.signal()
+}
+
+func (part *partition) assign(owner Listener) {
+	part.mtx.Lock()
+	if part.owner != nil && part.pending.len() > 0 { // The backlog moves to the new owner
+		reportBacklog(part.owner, part.tunnelName, 0)
+	}
+	part.owner = owner
+	part.reportBacklog()
+	part.mtx.Unlock()
+	part.signal()
+}
+
+// reportBacklog of the partition to its owner, if any. Must be called with the lock held.
+func (part *partition) reportBacklog() {
+	if part.owner != nil {
+		reportBacklog(part.owner, part.tunnelName, part.pending.len())
+	}
+}
+
+func (part *partition) signal() {
+	select { // Wake up the delivery loop if it isn't already notified.
+	case part.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start the delivery loop. Blocks until the context is done.
+func (part *partition) start(ctx context.Context) {
+	for {
+		msg, ok := part.next(ctx)
+		if !ok || !part.deliver(ctx, msg) {
+			part.discardPending()
+			return
+		}
+	}
+}
+
+// deliver the message to the owner. If the owner is unassigned while notifying the message,
+// the message is delivered again to the new owner.
+// Returns false if the context is done before the message is delivered.
+func (part *partition) deliver(ctx context.Context, msg Message) bool {
+	for {
+		owner, ok := part.waitOwner(ctx)
+		if !ok {
+			msg.report(false)
+			return false
+		}
+		isAck := notify(owner, part.tunnelName, msg)
+		if isAck || !part.isUnassigned(owner) {
+			msg.report(isAck)
+			return true
+		}
+	}
+}
+
+// next waits for a pending message and pops it.
+func (part *partition) next(ctx context.Context) (Message, bool) {
+	for {
+		part.mtx.Lock()
+		msg, ok := part.pending.pop()
+		if ok {
+			part.reportBacklog()
+		}
+		part.mtx.Unlock()
+		if ok {
+			return msg, true
+		}
+
+		select {
+		case <-part.wake:
+		case <-ctx.Done():
+			return Message{}, false
+		}
+	}
+}
+
+func (part *partition) waitOwner(ctx context.Context) (Listener, bool) {
+	for {
+		part.mtx.Lock()
+		owner := part.owner
+		part.mtx.Unlock()
+		if owner != nil {
+			return owner, true
+		}
+
+		select {
+		case <-part.wake:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// discardPending reports the messages that won't be delivered as not acknowledged.
+func (part *partition) discardPending() {
+	part.mtx.Lock()
+	defer part.mtx.Unlock()
+	for msg, ok := part.pending.pop(); ok; msg, ok = part.pending.pop() {
+		msg.report(false)
+	}
+	part.reportBacklog()
+}
+
+func (part *partition) isUnassigned(listener Listener) bool {
+	part.mtx.Lock()
+	defer part.mtx.Unlock()
+	return part.owner == nil || part.owner.ID() != listener.ID()
+}
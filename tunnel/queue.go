@@ -0,0 +1,90 @@
+package tunnel
+
+import "container/heap"
+
+// MaxPriority is the highest priority a Message can have.
+const MaxPriority = 9
+
+// PriorityAgingStep is the number of newer messages after which a pending message gains one priority level.
+// It prevents low priority messages from being starved by a continuous flow of higher priority ones.
+var PriorityAgingStep = 100
+
+// queue of messages pending for dispatch.
+type queue interface {
+	push(msg Message)
+	pop() (Message, bool)
+	len() int
+}
+
+// fifoQueue dispatches messages in their publication order.
+type fifoQueue struct {
+	messages []Message
+}
+
+func (q *fifoQueue) push(msg Message) {
+	q.messages = append(q.messages, msg)
+}
+
+func (q *fifoQueue) pop() (Message, bool) {
+	if len(q.messages) == 0 {
+		return Message{}, false
+	}
+	msg := q.messages[0]
+	q.messages[0] = Message{} // Release reference for GC
+	q.messages = q.messages[1:]
+	return msg, true
+}
+
+func (q *fifoQueue) len() int { return len(q.messages) }
+
+// priorityQueue dispatches higher priority messages first, aging pending ones (see PriorityAgingStep).
+// Messages with the same effective priority are dispatched in their publication order.
+type priorityQueue struct {
+	items prioritizedItems
+	seq   int
+}
+
+func (q *priorityQueue) push(msg Message) {
+	q.seq++
+	heap.Push(&q.items, prioritizedItem{
+		msg: msg,
+		// Comparing static scores is the same as aging every pending message on each push.
+		score: int(msg.Priority)*PriorityAgingStep - q.seq,
+		seq:   q.seq,
+	})
+}
+
+func (q *priorityQueue) pop() (Message, bool) {
+	if q.items.Len() == 0 {
+		return Message{}, false
+	}
+	return heap.Pop(&q.items).(prioritizedItem).msg, true
+}
+
+func (q *priorityQueue) len() int { return q.items.Len() }
+
+type prioritizedItem struct {
+	msg   Message
+	score int
+	seq   int
+}
+
+// prioritizedItems implements heap.Interface.
+type prioritizedItems []prioritizedItem
+
+func (items prioritizedItems) Len() int { return len(items) }
+func (items prioritizedItems) Less(i, j int) bool {
+	if items[i].score == items[j].score {
+		return items[i].seq < items[j].seq
+	}
+	return items[i].score > items[j].score
+}
+func (items prioritizedItems) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+func (items *prioritizedItems) Push(x any)   { *items = append(*items, x.(prioritizedItem)) }
+func (items *prioritizedItems) Pop() any {
+	old := *items
+	item := old[len(old)-1]
+	old[len(old)-1] = prioritizedItem{} // Release reference for GC
+	*items = old[:len(old)-1]
+	return item
+}
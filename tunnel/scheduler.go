@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"container/heap"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/id"
+)
+
+// scheduledMessage is a message waiting for its delivery time.
+type scheduledMessage struct {
+	id         string
+	tunnelName string
+	msg        Message
+	at         time.Time
+	index      int // Index in the heap, maintained by scheduledMessages.
+}
+
+// scheduler holds scheduled messages in a min-heap ordered by delivery time.
+// A single timer is armed for the earliest message.
+// Scheduled messages are kept in memory only: they are lost when the server stops.
+type scheduler struct {
+	messages scheduledMessages
+	byID     map[string]*scheduledMessage
+	timer    *time.Timer
+	mtx      sync.Mutex
+}
+
+var scheduled = &scheduler{byID: make(map[string]*scheduledMessage)}
+
+// PublishMessageAt schedules the message to be published to the Tunnel at the given time.
+// Returns the id of the scheduled message, to be used to cancel it.
+func PublishMessageAt(tunnelName string, msg Message, at time.Time) (string, error) {
+	if msg.Priority > MaxPriority {
+		return "", fmt.Errorf("invalid priority %d: cannot be greater than %d", msg.Priority, MaxPriority)
+	}
+	if !tunnels.Has(tunnelName) {
+		return "", fmt.Errorf("%w %q", ErrUnknownTunnel, tunnelName)
+	}
+	return scheduled.schedule(tunnelName, msg, at), nil
+}
+
+// PublishMessageAfter schedules the message to be published to the Tunnel once the delay is elapsed.
+// Returns the id of the scheduled message, to be used to cancel it.
+func PublishMessageAfter(tunnelName string, msg Message, delay time.Duration) (string, error) {
+	return PublishMessageAt(tunnelName, msg, time.Now().Add(delay))
+}
+
+// CancelScheduled cancels the scheduled message with the given id.
+// Returns an error if no message is scheduled with this id (already published or unknown).
+func CancelScheduled(messageID string) error {
+	if !scheduled.cancel(messageID) {
+		return fmt.Errorf("unknown scheduled message %q", messageID)
+	}
+	return nil
+}
+
+func (s *scheduler) schedule(tunnelName string, msg Message, at time.Time) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	messageID := id.New()
+	for s.byID[messageID] != nil { // Prevent (unlikely) collisions
+		messageID = id.New()
+	}
+
+	scheduledMsg := &scheduledMessage{id: messageID, tunnelName: tunnelName, msg: msg, at: at}
+	heap.Push(&s.messages, scheduledMsg)
+	s.byID[messageID] = scheduledMsg
+	s.arm()
+	return messageID
+}
+
+func (s *scheduler) cancel(messageID string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	scheduledMsg, exists := s.byID[messageID]
+	if !exists {
+		return false
+	}
+	heap.Remove(&s.messages, scheduledMsg.index)
+	delete(s.byID, messageID)
+	s.arm()
+	return true
+}
+
+// arm the timer for the earliest scheduled message. Must be called with the lock held.
+func (s *scheduler) arm() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.messages.Len() == 0 {
+		return
+	}
+	s.timer = time.AfterFunc(time.Until(s.messages[0].at), s.publishDue)
+}
+
+func (s *scheduler) publishDue() {
+	s.mtx.Lock()
+	var due []*scheduledMessage
+	now := time.Now()
+	for s.messages.Len() > 0 && !s.messages[0].at.After(now) {
+		scheduledMsg := heap.Pop(&s.messages).(*scheduledMessage)
+		delete(s.byID, scheduledMsg.id)
+		due = append(due, scheduledMsg)
+	}
+	s.arm()
+	s.mtx.Unlock()
+
+	for _, scheduledMsg := range due {
+		if err := Publish(scheduledMsg.tunnelName, scheduledMsg.msg); err != nil {
+			slog.Warn("Cannot publish scheduled message", "message_id", scheduledMsg.id, "error", err)
+			scheduledMsg.msg.Confirm.reject()
+		}
+	}
+}
+
+// stop drops every scheduled message.
+func (s *scheduler) stop() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.messages = nil
+	s.byID = make(map[string]*scheduledMessage)
+	s.arm()
+}
+
+// scheduledMessages implements heap.Interface.
+type scheduledMessages []*scheduledMessage
+
+func (messages scheduledMessages) Len() int           { return len(messages) }
+func (messages scheduledMessages) Less(i, j int) bool { return messages[i].at.Before(messages[j].at) }
+func (messages scheduledMessages) Swap(i, j int) {
+	messages[i], messages[j] = messages[j], messages[i]
+	messages[i].index = i
+	messages[j].index = j
+}
+func (messages *scheduledMessages) Push(x any) {
+	scheduledMsg := x.(*scheduledMessage)
+	scheduledMsg.index = len(*messages)
+	*messages = append(*messages, scheduledMsg)
+}
+func (messages *scheduledMessages) Pop() any {
+	old := *messages
+	scheduledMsg := old[len(old)-1]
+	old[len(old)-1] = nil // Release reference for GC
+	*messages = old[:len(old)-1]
+	return scheduledMsg
+}
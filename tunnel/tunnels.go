@@ -1,58 +1,211 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 
 	"github.com/codingLayce/tunnel.go/common/maps"
+
+	"github.com/codingLayce/tunnel-server/tracing"
 )
 
 type (
 	Tunnel interface {
-		RegisterListener(listener Listener)
+		RegisterListener(listener Listener, group string) error
 		UnregisterListener(id string)
-		PublishMessage(msg Message)
+		PublishMessage(msg Message) error
+		Stats() Stats
 		Stop()
 	}
 	Listener interface {
 		ID() string
-		NotifyMessage(tunnelName, message string)
+		// NotifyMessage delivers the message to the listener.
+		// Returns true if the listener acknowledged it.
+		NotifyMessage(tunnelName, message string) bool
+	}
+	// TracedListener is a Listener receiving the trace context of the notified messages.
+	TracedListener interface {
+		Listener
+		// NotifyTracedMessage is the same as NotifyMessage, the delivery span being the parent of the listener spans.
+		NotifyTracedMessage(trace tracing.SpanContext, tunnelName, message string) bool
+	}
+	// BacklogListener is a Listener told of its backlog: the number of its messages waiting to be notified.
+	BacklogListener interface {
+		Listener
+		// Backlog is called each time the backlog of the listener in the Tunnel changes.
+		// Called with the Tunnel locks held: must neither block nor call the Tunnel.
+		Backlog(tunnelName string, pending int)
 	}
 	Message struct {
+		// ID supplied by the publisher. Used by Tunnels with deduplication enabled to drop retries.
+		ID       string
 		SenderID string
 		Msg      string
+		// Key routes the message to a partition of a partitioned Tunnel. Messages with the same key are delivered in order.
+		Key string
+		// Priority from 0 (lowest) to MaxPriority. Only taken into account by Tunnels with priority enabled.
+		Priority uint8
+		// Confirm is notified of the listeners acknowledgements. Can be nil.
+		Confirm *Confirmation
+		// Trace is the context of the publication span. A new trace is started by the Tunnel if invalid.
+		Trace tracing.SpanContext
+
+		inFlight *inFlight
 	}
 )
 
+// expect a delivery of the message to a listener.
+func (msg Message) expect() {
+	msg.Confirm.expect()
+	msg.inFlight.expect()
+}
+
+// report the outcome of an expected delivery.
+func (msg Message) report(isAck bool) {
+	msg.Confirm.report(isAck)
+	msg.inFlight.report()
+}
+
+// seal indicates that every delivery of the message has been expected.
+func (msg Message) seal() {
+	msg.Confirm.seal()
+	msg.inFlight.seal()
+}
+
+// reportBacklog of the pending messages to the listener, if it's a BacklogListener.
+func reportBacklog(listener Listener, tunnelName string, pending int) {
+	if backlogListener, ok := listener.(BacklogListener); ok {
+		backlogListener.Backlog(tunnelName, pending)
+	}
+}
+
+// notify the message to the listener, recording the delivery span.
+func notify(listener Listener, tunnelName string, msg Message) bool {
+	span := tracing.Start(msg.Trace, "deliver")
+	span.SetAttribute("tunnel", tunnelName)
+	span.SetAttribute("listener", listener.ID())
+	defer span.End()
+
+	var isAck bool
+	if traced, ok := listener.(TracedListener); ok {
+		isAck = traced.NotifyTracedMessage(span.Context(), tunnelName, msg.Msg)
+	} else {
+		isAck = listener.NotifyMessage(tunnelName, msg.Msg)
+	}
+	span.SetAttribute("acked", strconv.FormatBool(isAck))
+	return isAck
+}
+
+// ErrTooManyListeners is returned when registering a listener to a Tunnel that reached its maximum number of listeners.
+var ErrTooManyListeners = errors.New("too many listeners")
+
+// ErrUnknownTunnel is returned when publishing or listening to a Tunnel that doesn't exist.
+var ErrUnknownTunnel = errors.New("unknown tunnel")
+
 var tunnels = maps.NewSyncMap[string, Tunnel]()
 
+// creationWatchers are called with the name of each created Tunnel, by watcher id.
+var creationWatchers = maps.NewSyncMap[string, func(tunnelName string)]()
+
+// WatchCreations calls the watcher with the name of each Tunnel created from now on, once it can be listened.
+// The watcher is called by the creating goroutine: it must neither block, create a Tunnel nor (un)watch the creations.
+func WatchCreations(watcherID string, watcher func(tunnelName string)) {
+	creationWatchers.Put(watcherID, watcher)
+}
+
+// UnwatchCreations stops calling the watcher. Once returned, the watcher isn't being called anymore.
+func UnwatchCreations(watcherID string) {
+	creationWatchers.Delete(watcherID)
+}
+
+// register the created Tunnel, then notifies the creation watchers.
+func register(tunnelName string, tunnel Tunnel) {
+	tunnels.Put(tunnelName, tunnel)
+	creationWatchers.Foreach(func(_ string, watcher func(tunnelName string)) {
+		watcher(tunnelName)
+	})
+}
+
 func CreateBroadcast(tunnelName string) error {
+	return CreateBroadcastWithOption(tunnelName, &BroadcastOption{})
+}
+
+func CreateBroadcastWithOption(tunnelName string, opts *BroadcastOption) error {
 	if tunnels.Has(tunnelName) {
 		return fmt.Errorf("tunnel named %q already exists", tunnelName)
 	}
-	tunnels.Put(tunnelName, newBroadcaster(tunnelName))
+	register(tunnelName, newBroadcaster(tunnelName, opts))
+	return nil
+}
+
+// CreatePartitioned creates a Tunnel split into the given number of partitions (see Partitioner).
+func CreatePartitioned(tunnelName string, nbPartitions int) error {
+	return CreatePartitionedWithOption(tunnelName, &PartitionOption{Partitions: nbPartitions})
+}
+
+func CreatePartitionedWithOption(tunnelName string, opts *PartitionOption) error {
+	if opts.Partitions < 1 {
+		return fmt.Errorf("invalid number of partitions %d: must be at least 1", opts.Partitions)
+	}
+	if tunnels.Has(tunnelName) {
+		return fmt.Errorf("tunnel named %q already exists", tunnelName)
+	}
+	register(tunnelName, newPartitioner(tunnelName, opts))
 	return nil
 }
 
 func Listen(tunnelName string, listener Listener) error {
+	return ListenGroup(tunnelName, "", listener)
+}
+
+// ListenGroup registers the listener as a member of the given group of the Tunnel.
+// Each group receives every message once, shared between its members.
+// An empty group name is the same as Listen.
+func ListenGroup(tunnelName, group string, listener Listener) error {
 	tunnel, exists := tunnels.Get(tunnelName)
 	if !exists {
-		return fmt.Errorf("unknown tunnel %q", tunnelName)
+		return fmt.Errorf("%w %q", ErrUnknownTunnel, tunnelName)
 	}
-	tunnel.RegisterListener(listener)
-	return nil
+	return tunnel.RegisterListener(listener, group)
+}
+
+// Exists indicates whether the Tunnel exists.
+func Exists(tunnelName string) bool {
+	_, exists := tunnels.Get(tunnelName)
+	return exists
 }
 
 func PublishMessage(senderID, tunnelName, msg string) error {
+	return Publish(tunnelName, Message{
+		SenderID: senderID,
+		Msg:      msg,
+	})
+}
+
+// Publish the message to the Tunnel. The message is queued, it doesn't wait for its dispatch.
+//
+// Ordering guarantee: messages published to a Tunnel are notified to each listener in their publication order,
+// so messages published sequentially by the same publisher are received in that order.
+// Tunnels with priority enabled only keep this order between messages of the same priority.
+func Publish(tunnelName string, msg Message) error {
+	if msg.Priority > MaxPriority {
+		return fmt.Errorf("invalid priority %d: cannot be greater than %d", msg.Priority, MaxPriority)
+	}
 	tunnel, exists := tunnels.Get(tunnelName)
 	if !exists {
-		return fmt.Errorf("unknown tunnel %q", tunnelName)
+		return fmt.Errorf("%w %q", ErrUnknownTunnel, tunnelName)
 	}
-	// No problem "GOing" this method because on stop it will return the goroutine if blocked.
-	go tunnel.PublishMessage(Message{
-		SenderID: senderID,
-		Msg:      msg,
+	return tunnel.PublishMessage(msg)
+}
+
+// AllStats returns the Stats of every Tunnel, by name.
+func AllStats() map[string]Stats {
+	stats := make(map[string]Stats)
+	tunnels.Foreach(func(name string, tunnel Tunnel) {
+		stats[name] = tunnel.Stats()
 	})
-	return nil
+	return stats
 }
 
 func StopListen(clientID string) {
@@ -61,7 +214,15 @@ func StopListen(clientID string) {
 	})
 }
 
+// StopListenTunnel unregisters the listener from the Tunnel only.
+func StopListenTunnel(tunnelName, listenerID string) {
+	if tunnel, exists := tunnels.Get(tunnelName); exists {
+		tunnel.UnregisterListener(listenerID)
+	}
+}
+
 func StopTunnels() {
+	scheduled.stop()
 	tunnels.Foreach(func(_ string, tunnel Tunnel) {
 		tunnel.Stop()
 	})
@@ -0,0 +1,280 @@
+// Package webhook delivers the messages of Tunnels to HTTP endpoints.
+//
+// A Subscription is a tunnel.Listener POSTing each message to its URL, signed with its secret along with the time of
+// the request, so that receivers can reject the replays (see Verify). Redirects aren't followed.
+// A 2xx response acknowledges the message, any other status, error or timeout is retried with an exponential backoff,
+// then nacks the message once the retries are exhausted.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codingLayce/tunnel.go/common/maps"
+	"github.com/codingLayce/tunnel.go/id"
+
+	"github.com/codingLayce/tunnel-server/tracing"
+	"github.com/codingLayce/tunnel-server/tunnel"
+)
+
+const (
+	// SignatureHeader holds the signature of the request: "sha256=" followed by the hex HMAC-SHA256, keyed by the secret,
+	// of the timestamp, a dot and the body.
+	SignatureHeader = "X-Tunnel-Signature"
+	// TimestampHeader holds the time of the request, in seconds since the Unix epoch. Signed along with the body.
+	TimestampHeader = "X-Tunnel-Timestamp"
+	// TunnelHeader holds the name of the Tunnel of the message.
+	TunnelHeader = "X-Tunnel-Name"
+	// DeliveryHeader holds the id of the delivery, the same for all the attempts of a message.
+	DeliveryHeader = "X-Tunnel-Delivery"
+
+	DefaultTimeout    = 10 * time.Second
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+
+	// maxDrainedBytes of a response body, read to reuse the connection.
+	maxDrainedBytes = 64 << 10
+)
+
+// SignatureTolerance is the maximum difference between the signed timestamp of a request and the time of its Verify.
+var SignatureTolerance = 5 * time.Minute
+
+// defaultClient doesn't follow redirects: a redirect response is a failed attempt.
+var defaultClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+type Option struct {
+	// URL receiving the messages, with the http or https scheme.
+	URL string
+	// Secret keying the signature of the messages. Unsigned if empty.
+	Secret string
+	// Group of the Tunnel to join. Receives every message if empty.
+	Group string
+
+	// Timeout of an attempt. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// MaxRetries after the first attempt. Defaults to DefaultMaxRetries, no retry if negative.
+	MaxRetries int
+	// Backoff before the first retry, doubled for each following one up to MaxBackoff.
+	// Defaults to DefaultBackoff and DefaultMaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Client sending the requests. Defaults to a client not following redirects.
+	Client *http.Client
+}
+
+func (opts *Option) defaults() {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Client == nil {
+		opts.Client = defaultClient
+	}
+}
+
+func (opts *Option) validate() error {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q: must be an absolute http or https url", opts.URL)
+	}
+	return nil
+}
+
+// ErrUnknownSubscription is returned when unsubscribing an unknown Subscription.
+var ErrUnknownSubscription = errors.New("unknown webhook subscription")
+
+var subscriptions = maps.NewSyncMap[string, *Subscription]()
+
+// Subscription delivers the messages of a Tunnel to a webhook.
+type Subscription struct {
+	id         string
+	tunnelName string
+	opts       *Option
+
+	// closed interrupts the attempts of the message being delivered.
+	closed    chan struct{}
+	closeOnce sync.Once
+	logger    *slog.Logger
+}
+
+// Subscribe the webhook to the Tunnel.
+func Subscribe(tunnelName string, opts *Option) (*Subscription, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	opts.defaults()
+
+	sub := &Subscription{
+		id:         id.New(),
+		tunnelName: tunnelName,
+		opts:       opts,
+		closed:     make(chan struct{}),
+	}
+	sub.logger = slog.Default().With("webhook", sub.id, "tunnel_name", tunnelName)
+	if err := tunnel.ListenGroup(tunnelName, opts.Group, sub); err != nil {
+		return nil, err
+	}
+	subscriptions.Put(sub.id, sub)
+	sub.logger.Info("Webhook subscribed", "url", opts.URL)
+	return sub, nil
+}
+
+// Unsubscribe the webhook Subscription of the given id.
+func Unsubscribe(subscriptionID string) error {
+	sub, exists := subscriptions.Get(subscriptionID)
+	if !exists {
+		return fmt.Errorf("%w %q", ErrUnknownSubscription, subscriptionID)
+	}
+	sub.Close()
+	return nil
+}
+
+// UnsubscribeAll the webhooks.
+func UnsubscribeAll() {
+	var all []*Subscription
+	subscriptions.Foreach(func(_ string, sub *Subscription) { // Closing deletes from the map: cannot be done while iterating
+		all = append(all, sub)
+	})
+	for _, sub := range all {
+		sub.Close()
+	}
+}
+
+func (s *Subscription) ID() string {
+	return s.id
+}
+
+func (s *Subscription) TunnelName() string {
+	return s.tunnelName
+}
+
+// Close the Subscription. The message being delivered is nacked.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		subscriptions.Delete(s.id)
+		close(s.closed)
+		tunnel.StopListen(s.id)
+		s.logger.Info("Webhook unsubscribed")
+	})
+}
+
+func (s *Subscription) NotifyMessage(tunnelName, message string) bool {
+	return s.NotifyTracedMessage(tracing.SpanContext{}, tunnelName, message)
+}
+
+// NotifyTracedMessage POSTs the message until acknowledged or the retries are exhausted.
+// The trace context is propagated with the traceparent header.
+func (s *Subscription) NotifyTracedMessage(trace tracing.SpanContext, tunnelName, message string) bool {
+	deliveryID := id.New()
+	logger := s.logger.With("delivery", deliveryID)
+
+	backoff := s.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := s.post(trace, deliveryID, tunnelName, message)
+		if err == nil {
+			logger.Info("Message delivered to webhook", "attempt", attempt+1)
+			return true
+		}
+		if attempt >= s.opts.MaxRetries {
+			logger.Warn("Cannot deliver message to webhook. Giving up", "attempt", attempt+1, "error", err)
+			return false
+		}
+		logger.Info("Cannot deliver message to webhook. Retrying", "attempt", attempt+1, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-s.closed:
+			return false
+		}
+		backoff = min(2*backoff, s.opts.MaxBackoff)
+	}
+}
+
+// post the message once. Returns an error unless the webhook responds with a 2xx status.
+func (s *Subscription) post(trace tracing.SpanContext, deliveryID, tunnelName, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	go func() { // Interrupts the attempt when closed.
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	body := []byte(message)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set(TunnelHeader, tunnelName)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	if s.opts.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(s.opts.Secret, timestamp, body))
+	}
+	if trace.IsValid() {
+		req.Header.Set("traceparent", trace.TraceParent())
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainedBytes)) // Drains the body to reuse the connection
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign the timestamp and the body with the secret, as sent in the SignatureHeader.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify the signature of the body and the timestamp, as received in the SignatureHeader and the TimestampHeader.
+// A timestamp further than SignatureTolerance from now is rejected, as the replay of an old request.
+func Verify(secret string, body []byte, timestamp, signature string) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
@@ -0,0 +1,401 @@
+// Package websocket implements the subset of the WebSocket protocol (RFC 6455) needed by the gateway:
+// the opening handshake, text messages (possibly fragmented), ping/pong and the closing handshake.
+// Extensions and subprotocols aren't supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// MaxMessageBytes is the maximum size of a received message. A bigger message closes the connection.
+	MaxMessageBytes = 1 << 20
+	// ControlWriteTimeout is the maximum duration to write the pongs answering the pings and the close frames.
+	ControlWriteTimeout = time.Second
+)
+
+// acceptGUID is concatenated to the client key to compute the accept key of the handshake.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+
+	finBit  byte = 0x80
+	rsvBits byte = 0x70
+	maskBit byte = 0x80
+
+	// maxControlPayload is the maximum payload of the control frames (close, ping and pong).
+	maxControlPayload = 125
+)
+
+// Status codes of the close frames closing the connection on a failure.
+const (
+	statusProtocolError  uint16 = 1002
+	statusInvalidPayload uint16 = 1007
+	statusMessageTooBig  uint16 = 1009
+)
+
+var (
+	// ErrMessageTooLarge is returned when receiving a message bigger than MaxMessageBytes.
+	ErrMessageTooLarge = errors.New("websocket message too large")
+	// ErrProtocol is returned when receiving a frame violating the protocol.
+	ErrProtocol = errors.New("websocket protocol error")
+	// ErrInvalidUTF8 is returned when receiving a text message that isn't valid UTF-8.
+	ErrInvalidUTF8 = errors.New("websocket text message not utf-8")
+)
+
+// Conn is a WebSocket connection. Its Write method sends a text message per call.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// client connections mask their frames and expect unmasked ones.
+	client bool
+	// onPong is called for each pong received.
+	onPong func()
+	// idleTimeout is the maximum duration to wait for a frame. No limit if zero.
+	idleTimeout time.Duration
+
+	// writeDeadline of the messages and pings, set by SetWriteDeadline. The pongs and close frames have their own.
+	writeDeadline time.Time
+	writeMtx      sync.Mutex
+	closeOnce     sync.Once
+}
+
+// Upgrade the HTTP request to a WebSocket connection.
+// Replies with an HTTP error if the request isn't a valid WebSocket handshake.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "websocket handshake must be a GET request", http.StatusMethodNotAllowed)
+		return nil, errors.New("handshake method not GET")
+	case !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "websocket handshake expected", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	case key == "":
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack: %w", err)
+	}
+	conn.SetDeadline(time.Time{}) // Clears the deadlines of the HTTP server, the connection being no longer a request.
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+	return &Conn{conn: conn, reader: rw.Reader}, nil
+}
+
+// Dial opens a client WebSocket connection to the URL path of the address. Meant for tests and tooling.
+func Dial(addr, path string) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err = conn.Write([]byte(request)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("handshake refused: %s", response.Status)
+	}
+	return &Conn{conn: conn, reader: reader, client: true}, nil
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, answering the pings in the meantime.
+// Returns io.EOF once the peer closed the connection.
+// A frame violating the protocol or a text message that isn't valid UTF-8 closes the connection with its status.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	// messageOpcode of the message being read, zero until its first frame.
+	var messageOpcode byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if errors.Is(err, ErrProtocol) {
+			return nil, c.fail(statusProtocolError, err)
+		}
+		if errors.Is(err, ErrMessageTooLarge) {
+			return nil, c.fail(statusMessageTooBig, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err = c.writeFrame(opPong, payload, ControlWriteTimeout); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			if c.onPong != nil {
+				c.onPong()
+			}
+			continue
+		case opClose:
+			c.closeWith(payload)
+			return nil, io.EOF
+		case opText, opBinary:
+			if messageOpcode != 0 {
+				return nil, c.fail(statusProtocolError, fmt.Errorf("%w: new message before the end of the fragmented one", ErrProtocol))
+			}
+			messageOpcode = opcode
+		case opContinuation:
+			if messageOpcode == 0 {
+				return nil, c.fail(statusProtocolError, fmt.Errorf("%w: unexpected continuation frame", ErrProtocol))
+			}
+		default:
+			return nil, c.fail(statusProtocolError, fmt.Errorf("%w: unknown opcode 0x%x", ErrProtocol, opcode))
+		}
+
+		message = append(message, payload...)
+		if len(message) > MaxMessageBytes {
+			return nil, c.fail(statusMessageTooBig, ErrMessageTooLarge)
+		}
+		if !fin {
+			continue
+		}
+		if messageOpcode == opText && !utf8.Valid(message) {
+			return nil, c.fail(statusInvalidPayload, ErrInvalidUTF8)
+		}
+		return message, nil
+	}
+}
+
+// fail closes the connection with the status of the error, returned.
+func (c *Conn) fail(status uint16, err error) error {
+	c.closeWith(binary.BigEndian.AppendUint16(nil, status))
+	return err
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	if c.idleTimeout > 0 {
+		if err = c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&finBit != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&maskBit != 0
+	if header[0]&rsvBits != 0 { // No extension negotiated
+		return false, 0, nil, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	if masked == c.client { // Clients must mask their frames, servers must not
+		return false, 0, nil, fmt.Errorf("%w: invalid frame masking", ErrProtocol)
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode&0x8 != 0 && (!fin || length > maxControlPayload) { // Control frames cannot be fragmented nor long
+		return false, 0, nil, fmt.Errorf("%w: fragmented or too long control frame", ErrProtocol)
+	}
+	if length > uint64(MaxMessageBytes) {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// Write sends the payload as a single text message.
+func (c *Conn) Write(payload []byte) (int, error) {
+	if err := c.writeFrame(opText, payload, 0); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// writeFrame within the deadline set by SetWriteDeadline, or within the timeout if not zero.
+func (c *Conn) writeFrame(opcode byte, payload []byte, timeout time.Duration) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, finBit|opcode)
+
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskFlag|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	deadline := c.writeDeadline
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Ping the peer, its pong being read by ReadMessage.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil, 0)
+}
+
+// SetPongHandler sets the function called by ReadMessage for each pong received. Must be set before reading.
+func (c *Conn) SetPongHandler(handler func()) {
+	c.onPong = handler
+}
+
+// SetIdleTimeout sets the maximum duration ReadMessage waits for each frame, pings and pongs included.
+// Must be set before reading.
+func (c *Conn) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// Close the connection, sending a close frame first.
+func (c *Conn) Close() error {
+	c.closeWith(nil)
+	return c.conn.Close()
+}
+
+// closeWith sends a close frame with the given status once.
+func (c *Conn) closeWith(status []byte) {
+	c.closeOnce.Do(func() {
+		c.writeFrame(opClose, status, ControlWriteTimeout)
+	})
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline of the following messages and pings, the pongs and close frames having their own.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}